@@ -6,107 +6,122 @@ package main
 import "C"
 
 import (
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"sync"
 	"unsafe"
 
-	"nanodb/internal/btree"
 	"nanodb/internal/collection"
-	"nanodb/internal/record"
+	"nanodb/internal/database"
 	"nanodb/internal/storage"
 )
 
 // Global state to keep the DB alive in memory between calls
 var (
 	openCollections = make(map[string]*collection.Collection)
-	pager           *storage.Pager
-	header          *storage.DBHeader
+	db              *database.DB
 
-	catalog  *collection.Collection
 	globalMu sync.RWMutex
 
 	activeUsers uint
+
+	// open transactions by handle. Calls on a transaction only take txMu,
+	// never globalMu, since other calls can wait on globalMu for the
+	// write lock the transaction holds.
+	transactions = make(map[int64]*database.Tx)
+	lastTx       int64
+	txMu         sync.Mutex
 )
 
 //export NanoInit
 func NanoInit(path *C.char) {
-	globalMu.Lock()
-	defer globalMu.Unlock()
-
-	activeUsers++
-
-	if pager != nil {
-		return
-	}
-
-	goPath := C.GoString(path)
-
-	p, err := storage.OpenPager(goPath)
-	if err != nil {
+	if err := initInternal(C.GoString(path), nil); err != nil {
 		panic(err)
 	}
-	pager = p
+}
 
-	h, err := pager.ReadHeader()
+// NanoInitWithKey opens an encrypted database, creating it encrypted with
+// passphrase when the file is new. It returns -1 when the passphrase is wrong.
+//
+//export NanoInitWithKey
+func NanoInitWithKey(path *C.char, passphrase *C.char) C.longlong {
+	err := initInternal(C.GoString(path), &storage.Options{
+		Passphrase: C.GoString(passphrase),
+	})
 	if err != nil {
-		h = &storage.DBHeader{
-			Magic:     [4]byte{'A', 'A', 'M', 'N'},
-			Version:   1,
-			PageSize:  storage.PageSize,
-			PageCount: 1,
-		}
-		if err := pager.WriteHeader(h); err != nil {
-			panic(err)
-		}
-
-		catalogPage, err := pager.AllocatePage(h)
-		if err != nil {
-			panic(err)
-		}
-		rawCatalog := storage.GetBuff()
-		defer storage.ReleasePageBuffer(rawCatalog)
+		return -1
+	}
+	return 1
+}
 
-		storage.InitDataPage(rawCatalog)
-		if err := pager.WritePage(catalogPage, rawCatalog); err != nil {
-			panic(err)
-		}
+// NanoInitWithOptions takes a JSON object such as {"pageSize": 16384, "mmap": true}.
+// The page size only applies when the database file is created. With
+// "readOnly": true every call that writes fails, "passphrase" opens or
+// creates an encrypted database as NanoInitWithKey does. "sync" is one of
+// "off", "normal" (the default) or "full", see storage.SyncMode. With
+// "truncateOnClose": true the free pages at the end of the file are given
+// back when the database is closed, see NanoTruncate. With
+// "copyOnWriteIndex": true index nodes are copied rather than overwritten,
+// see btree.Btree.CopyOnWrite.
+//
+//export NanoInitWithOptions
+func NanoInitWithOptions(path *C.char, optionsJson *C.char) C.longlong {
+	var opts struct {
+		PageSize   int    `json:"pageSize"`
+		CachePages int    `json:"cachePages"`
+		Mmap       bool   `json:"mmap"`
+		ReadOnly   bool   `json:"readOnly"`
+		Passphrase string `json:"passphrase"`
+		Sync       string `json:"sync"`
+
+		TruncateOnClose  bool `json:"truncateOnClose"`
+		CopyOnWriteIndex bool `json:"copyOnWriteIndex"`
+	}
+	if err := json.Unmarshal([]byte(C.GoString(optionsJson)), &opts); err != nil {
+		return -1
 	}
 
-	header = h
+	if opts.PageSize != 0 && !storage.ValidPageSize(opts.PageSize) {
+		return -1
+	}
 
-	// Load Catalog "_catalog", 1, 0,
-	cat, err := collection.NewCollection(&record.CollectionEntry{
-		Name:      "_catalog",
-		RootPage:  1,
-		IndexRoot: 0,
-		PageId:    0,
-		Slot:      0,
-	}, pager, header) //collection insert bypasses the btree so this is fine
+	syncMode, err := storage.ParseSyncMode(opts.Sync)
 	if err != nil {
-		panic(err)
+		return -1
 	}
-	catalog = cat
-
-	loadExistingCollectionsInternal()
-}
 
-func loadExistingCollectionsInternal() {
-
-	collections, err := record.GetAllCollections(pager)
+	err = initInternal(C.GoString(path), &storage.Options{
+		PageSize:   opts.PageSize,
+		CachePages: opts.CachePages,
+		Mmap:       opts.Mmap,
+		ReadOnly:   opts.ReadOnly,
+		Passphrase: opts.Passphrase,
+		Sync:       syncMode,
 
+		TruncateOnClose:  opts.TruncateOnClose,
+		CopyOnWriteIndex: opts.CopyOnWriteIndex,
+	})
 	if err != nil {
-		panic(err)
+		return -1
 	}
+	return 1
+}
+
+func initInternal(goPath string, opts *storage.Options) error {
+	globalMu.Lock()
+	defer globalMu.Unlock()
 
-	for _, col := range collections {
-		loadedCol, err := collection.NewCollection(&col, pager, header)
+	if db == nil {
+		d, err := database.Open(goPath, opts)
 		if err != nil {
-			continue
+			return err
 		}
-		loadedCol.LoadVectorIndex()
-		openCollections[col.Name] = loadedCol
+		db = d
+		openCollections = db.Collections
 	}
+
+	activeUsers++
+	return nil
 }
 
 //export NanoCreateCollection
@@ -121,109 +136,11 @@ func NanoCreateCollection(colName *C.char) C.longlong {
 		return 0
 	}
 
-	newColPageNum, err := pager.AllocatePage(header)
-	if err != nil {
-		return -1
-	}
-
-	empty := storage.GetBuff()
-
-	storage.InitDataPage(empty)
-	if err := pager.WritePage(newColPageNum, empty); err != nil {
-		storage.ReleasePageBuffer(empty)
-		return -1
-	}
-
-	storage.ReleasePageBuffer(empty)
-
-	newIndexRootPage, err := pager.AllocatePage(header)
-	if err != nil {
-		return -1
-	}
-
-	newIndexData := storage.GetBuff()
-
-	node := btree.NewNode(newIndexData)
-
-	node.SetHeader(btree.NodeTypeLeaf, true)
-	node.SetNumCells(0)
-
-	if err := pager.WritePage(newIndexRootPage, newIndexData); err != nil {
-		storage.ReleasePageBuffer(newIndexData)
+	if _, err := db.CreateCollection(cName); err != nil {
 		return -1
 	}
 
-	storage.ReleasePageBuffer(newIndexData)
-
-	var currentPageNum uint32 = 1
-	for {
-		entry := record.EncodeCollectionEntry(cName, newColPageNum, newIndexRootPage)
-		page, err := pager.ReadPage(currentPageNum)
-		if err != nil {
-			return -1
-		}
-
-		success, err := record.InsertRecord(page, 0, entry)
-		if err != nil {
-			storage.ReleasePageBuffer(page)
-			return -1
-		}
-
-		// if success record inserted
-		if success {
-			if err := pager.WritePage(currentPageNum, page); err != nil {
-				storage.ReleasePageBuffer(page)
-				return -1
-			}
-			slotCount := binary.LittleEndian.Uint16(page[0:2])
-			newCol, _ := collection.NewCollection(&record.CollectionEntry{
-				Name:      cName,
-				RootPage:  newColPageNum,
-				IndexRoot: newIndexRootPage,
-				PageId:    currentPageNum,
-				Slot:      slotCount - 1,
-			}, pager, header)
-			openCollections[cName] = newCol
-			storage.ReleasePageBuffer(page)
-			return 1
-		}
-
-		//move to next page
-		nextPage := binary.LittleEndian.Uint32(page[4:8])
-
-		if nextPage != 0 {
-			currentPageNum = nextPage
-			storage.ReleasePageBuffer(page)
-			continue
-		}
-
-		// if no page then allocate new page for
-		newPageId, err := pager.AllocatePage(header)
-		if err != nil {
-			storage.ReleasePageBuffer(page)
-			return -1
-		}
-
-		emptyCatPage := storage.GetBuff()
-		storage.InitDataPage(emptyCatPage)
-
-		if err := pager.WritePage(newPageId, emptyCatPage); err != nil {
-			storage.ReleasePageBuffer(page)
-			storage.ReleasePageBuffer(emptyCatPage)
-			return -1
-		}
-
-		binary.LittleEndian.PutUint32(page[4:8], newPageId)
-
-		if err := pager.WritePage(currentPageNum, page); err != nil {
-			storage.ReleasePageBuffer(page)
-			storage.ReleasePageBuffer(emptyCatPage)
-			return -1
-		}
-		currentPageNum = newPageId
-		storage.ReleasePageBuffer(page)
-		storage.ReleasePageBuffer(emptyCatPage)
-	}
+	return 1
 }
 
 //export NanoGetCollections
@@ -246,8 +163,8 @@ func NanoInsert(colName *C.char, jsonStr *C.char) C.longlong {
 	cName := C.GoString(colName)
 
 	globalMu.RLock()
+	defer globalMu.RUnlock()
 	col, ok := openCollections[cName]
-	globalMu.RUnlock()
 
 	if !ok {
 		return -1
@@ -272,8 +189,8 @@ func NanoInsertMany(colName *C.char, jsonStr *C.char) *C.char {
 	cName := C.GoString(colName)
 
 	globalMu.RLock()
+	defer globalMu.RUnlock()
 	col, ok := openCollections[cName]
-	globalMu.RUnlock()
 
 	if !ok {
 		return nil
@@ -306,8 +223,8 @@ func NanoFind(colName *C.char, queryJson *C.char, limit C.longlong, skip C.longl
 	cName := C.GoString(colName)
 
 	globalMu.RLock()
+	defer globalMu.RUnlock()
 	col, ok := openCollections[cName]
-	globalMu.RUnlock()
 
 	if !ok {
 		return nil
@@ -342,8 +259,8 @@ func NanoFindOne(colName *C.char, queryJson *C.char) *C.char {
 	cName := C.GoString(colName)
 
 	globalMu.RLock()
+	defer globalMu.RUnlock()
 	col, ok := openCollections[cName]
-	globalMu.RUnlock()
 
 	if !ok {
 		return nil
@@ -368,8 +285,8 @@ func NanoVectorSearch(colName *C.char, queryJson *C.char, topK C.longlong) *C.ch
 	cName := C.GoString(colName)
 
 	globalMu.RLock()
+	defer globalMu.RUnlock()
 	col, ok := openCollections[cName]
-	globalMu.RUnlock()
 
 	if !ok {
 		return nil
@@ -398,8 +315,8 @@ func NanoFindById(colName *C.char, docId C.longlong) *C.char {
 	cName := C.GoString(colName)
 
 	globalMu.RLock()
+	defer globalMu.RUnlock()
 	col, ok := openCollections[cName]
-	globalMu.RUnlock()
 
 	if !ok {
 		return nil
@@ -419,8 +336,8 @@ func NanoUpdateById(colName *C.char, docId C.longlong, jsonStr *C.char) *C.char
 	cName := C.GoString(colName)
 
 	globalMu.RLock()
+	defer globalMu.RUnlock()
 	col, ok := openCollections[cName]
-	globalMu.RUnlock()
 
 	if !ok {
 		return nil
@@ -462,13 +379,59 @@ func NanoUpdateById(colName *C.char, docId C.longlong, jsonStr *C.char) *C.char
 	return C.CString(string(bytes))
 }
 
+// NanoUpdateIfVersion merges the fields of jsonStr into the document as
+// NanoUpdateById does, but only if its _version is still expectedVersion.
+// It returns the document's new version, 0 if another write changed the
+// document first, in which case the caller reads it again and retries, and
+// -1 on any other error.
+//
+//export NanoUpdateIfVersion
+func NanoUpdateIfVersion(colName *C.char, docId C.longlong, expectedVersion C.longlong, jsonStr *C.char) C.longlong {
+	cName := C.GoString(colName)
+
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	col, ok := openCollections[cName]
+
+	if !ok {
+		return -1
+	}
+
+	var jsonData map[string]any
+	if err := json.Unmarshal([]byte(C.GoString(jsonStr)), &jsonData); err != nil {
+		return -1
+	}
+
+	doc, err := col.FindById(uint64(docId))
+	if err != nil || doc == nil {
+		return -1
+	}
+
+	for key, val := range jsonData {
+		if key == "_id" {
+			continue
+		}
+		doc[key] = val
+	}
+
+	err = col.UpdateIfVersion(uint64(docId), uint64(expectedVersion), doc)
+	if errors.Is(err, collection.ErrVersionConflict) {
+		return 0
+	}
+	if err != nil {
+		return -1
+	}
+
+	return C.longlong(uint64(expectedVersion) + 1)
+}
+
 //export NanoUpdateMany
 func NanoUpdateMany(colName *C.char, queryJson *C.char, jsonStr *C.char) *C.char {
 
 	cName := C.GoString(colName)
 	globalMu.RLock()
+	defer globalMu.RUnlock()
 	col, ok := openCollections[cName]
-	globalMu.RUnlock()
 
 	if !ok {
 		return nil
@@ -513,8 +476,8 @@ func NanoDeleteById(colName *C.char, docId C.longlong) C.longlong {
 
 	cName := C.GoString(colName)
 	globalMu.RLock()
+	defer globalMu.RUnlock()
 	col, ok := openCollections[cName]
-	globalMu.RUnlock()
 
 	if !ok {
 		return -1
@@ -535,8 +498,8 @@ func NanoDeleteMany(colName *C.char, query *C.char) C.longlong {
 	cName := C.GoString(colName)
 
 	globalMu.RLock()
+	defer globalMu.RUnlock()
 	col, ok := openCollections[cName]
-	globalMu.RUnlock()
 
 	if !ok {
 		return -1
@@ -559,6 +522,308 @@ func NanoDeleteMany(colName *C.char, query *C.char) C.longlong {
 	return 1
 }
 
+// NanoSetCompression turns deflate compression of the collection's
+// documents on (enabled != 0) or off. Returns 1, or -1 on error.
+//
+//export NanoSetCompression
+func NanoSetCompression(colName *C.char, enabled C.int) C.longlong {
+
+	cName := C.GoString(colName)
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	col, ok := openCollections[cName]
+
+	if !ok {
+		return -1
+	}
+
+	if err := col.SetCompression(enabled != 0); err != nil {
+		return -1
+	}
+
+	return 1
+}
+
+// NanoVacuum compacts a collection and returns the number of bytes it
+// gave back to the free list, or -1 on error
+//
+//export NanoVacuum
+func NanoVacuum(colName *C.char) C.longlong {
+
+	cName := C.GoString(colName)
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	col, ok := openCollections[cName]
+
+	if !ok {
+		return -1
+	}
+
+	reclaimed, err := col.Vacuum()
+
+	if err != nil {
+		return -1
+	}
+
+	return C.longlong(reclaimed)
+}
+
+// NanoBegin starts a transaction and returns its handle for the NanoTx
+// calls, NanoCommit and NanoRollback, or -1 on error. Until it ends every
+// other write fails, a second NanoBegin included, and reads see none of
+// its changes. A handle must not be used from two threads at once.
+//
+//export NanoBegin
+func NanoBegin() C.longlong {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+
+	if db == nil {
+		return -1
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return -1
+	}
+
+	txMu.Lock()
+	defer txMu.Unlock()
+
+	lastTx++
+	transactions[lastTx] = tx
+	return C.longlong(lastTx)
+}
+
+// txCollection looks up a collection inside an open transaction, the
+// caller holds txMu
+func txCollection(handle C.longlong, colName *C.char) (*collection.TxCollection, bool) {
+	tx, ok := transactions[int64(handle)]
+	if !ok {
+		return nil, false
+	}
+	return tx.Collection(C.GoString(colName))
+}
+
+//export NanoTxInsert
+func NanoTxInsert(handle C.longlong, colName *C.char, jsonStr *C.char) C.longlong {
+	txMu.Lock()
+	defer txMu.Unlock()
+
+	col, ok := txCollection(handle, colName)
+	if !ok {
+		return -1
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(C.GoString(jsonStr)), &doc); err != nil {
+		return -1
+	}
+
+	docId, err := col.Insert(doc)
+	if err != nil {
+		return -1
+	}
+
+	return C.longlong(docId)
+}
+
+//export NanoTxFindById
+func NanoTxFindById(handle C.longlong, colName *C.char, docId C.longlong) *C.char {
+	txMu.Lock()
+	defer txMu.Unlock()
+
+	col, ok := txCollection(handle, colName)
+	if !ok {
+		return nil
+	}
+
+	doc, err := col.FindById(uint64(docId))
+	if err != nil || doc == nil {
+		return nil
+	}
+
+	bytes, _ := json.Marshal(doc)
+	return C.CString(string(bytes))
+}
+
+// NanoTxUpdateById merges the fields of jsonStr into the document as
+// NanoUpdateById does and returns the updated document, or NULL on error
+//
+//export NanoTxUpdateById
+func NanoTxUpdateById(handle C.longlong, colName *C.char, docId C.longlong, jsonStr *C.char) *C.char {
+	txMu.Lock()
+	defer txMu.Unlock()
+
+	col, ok := txCollection(handle, colName)
+	if !ok {
+		return nil
+	}
+
+	var jsonData map[string]any
+	if err := json.Unmarshal([]byte(C.GoString(jsonStr)), &jsonData); err != nil {
+		return nil
+	}
+
+	doc, err := col.FindById(uint64(docId))
+	if err != nil || doc == nil {
+		return nil
+	}
+
+	for key, val := range jsonData {
+		if key == "_id" {
+			continue
+		}
+		doc[key] = val
+	}
+
+	if err := col.UpdateById(uint64(docId), doc); err != nil {
+		return nil
+	}
+
+	bytes, _ := json.Marshal(doc)
+	return C.CString(string(bytes))
+}
+
+//export NanoTxDeleteById
+func NanoTxDeleteById(handle C.longlong, colName *C.char, docId C.longlong) C.longlong {
+	txMu.Lock()
+	defer txMu.Unlock()
+
+	col, ok := txCollection(handle, colName)
+	if !ok {
+		return -1
+	}
+
+	if err := col.DeleteById(uint64(docId)); err != nil {
+		return -1
+	}
+
+	return 1
+}
+
+// NanoCommit commits a transaction and releases its handle. It returns 1
+// on success and -1 on error, in which case the transaction was rolled back.
+//
+//export NanoCommit
+func NanoCommit(handle C.longlong) C.longlong {
+	txMu.Lock()
+	defer txMu.Unlock()
+
+	tx, ok := transactions[int64(handle)]
+	if !ok {
+		return -1
+	}
+	delete(transactions, int64(handle))
+
+	if err := tx.Commit(); err != nil {
+		return -1
+	}
+
+	return 1
+}
+
+//export NanoRollback
+func NanoRollback(handle C.longlong) C.longlong {
+	txMu.Lock()
+	defer txMu.Unlock()
+
+	tx, ok := transactions[int64(handle)]
+	if !ok {
+		return -1
+	}
+	delete(transactions, int64(handle))
+
+	if err := tx.Rollback(); err != nil {
+		return -1
+	}
+
+	return 1
+}
+
+// NanoVacuumDatabase rewrites the whole database into a fresh file and
+// swaps it into place. It returns the number of bytes the file shrank by,
+// or -1 on error.
+//
+//export NanoVacuumDatabase
+func NanoVacuumDatabase() C.longlong {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
+	if db == nil {
+		return -1
+	}
+
+	reclaimed, err := db.Vacuum()
+	openCollections = db.Collections
+
+	if err != nil {
+		return -1
+	}
+
+	return C.longlong(reclaimed)
+}
+
+// NanoTruncate shrinks the database file by the free pages at its end and
+// returns the number of bytes it shrank by, or -1 on error
+//
+//export NanoTruncate
+func NanoTruncate() C.longlong {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+
+	if db == nil {
+		return -1
+	}
+
+	reclaimed, err := db.Truncate()
+	if err != nil {
+		return -1
+	}
+
+	return C.longlong(reclaimed)
+}
+
+// NanoBackup writes a consistent copy of the open database to a new file
+// at path while other calls keep running. It returns 1 on success and -1
+// on error.
+//
+//export NanoBackup
+func NanoBackup(path *C.char) C.longlong {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+
+	if db == nil {
+		return -1
+	}
+
+	if err := db.Backup(C.GoString(path)); err != nil {
+		return -1
+	}
+
+	return 1
+}
+
+// NanoBackupIncremental writes the pages changed since the last backup to
+// a new file at path. It returns 1 on success and -1 on error, including
+// when no full backup has been taken yet.
+//
+//export NanoBackupIncremental
+func NanoBackupIncremental(path *C.char) C.longlong {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+
+	if db == nil {
+		return -1
+	}
+
+	if err := db.BackupIncremental(C.GoString(path)); err != nil {
+		return -1
+	}
+
+	return 1
+}
+
 //export NanoFree
 func NanoFree(ptr *C.char) {
 	C.free(unsafe.Pointer(ptr))
@@ -569,7 +834,7 @@ func NanoClose() C.longlong {
 	globalMu.Lock()
 	defer globalMu.Unlock()
 
-	if pager == nil {
+	if db == nil {
 		return 1
 	}
 
@@ -578,13 +843,20 @@ func NanoClose() C.longlong {
 	}
 
 	if activeUsers == 0 {
-		err := pager.Close()
+		// open transactions hold the write lock closing needs
+		txMu.Lock()
+		for handle, tx := range transactions {
+			tx.Rollback()
+			delete(transactions, handle)
+		}
+		txMu.Unlock()
+
+		err := db.Close()
 		if err != nil {
 			return -1
 		}
 
-		pager = nil
-		catalog = nil
+		db = nil
 		openCollections = make(map[string]*collection.Collection)
 	}
 	return 1
@@ -1,153 +1,168 @@
 package main
 
-// import (
-// 	"os"
-
-// 	"nanodb/internal/record"
-// 	"nanodb/internal/storage"
-// )
-
-// func main() {
-// 	dbFile := "test.db"
-
-// 	// 1. Check if DB exists
-// 	_, err := os.Stat(dbFile)
-// 	dbExists := !os.IsNotExist(err)
-
-// 	p, err := storage.OpenPager(dbFile)
-// 	if err != nil {
-// 		panic(err)
-// 	}
-// 	defer p.Close()
-
-// 	var h *storage.DBHeader
-// 	var userRootPage uint32
-
-// 	if !dbExists {
-// 		// --- BOOTSTRAP MODE (Run once) ---
-// 		//fmt.Println("Initializing new database...")
-
-// 		// A. Write Header
-// 		h = &storage.DBHeader{
-// 			Magic:     [4]byte{'A', 'A', 'M', 'N'},
-// 			Version:   1,
-// 			PageSize:  storage.PageSize,
-// 			PageCount: 1,
-// 		}
-// 		storage.WriteHeader(p, h)
-
-// 		// B. Allocate Catalog (Page 1)
-// 		catalogPage, _ := storage.AllocatePage(p, h)
-// 		rawCatalog := make([]byte, storage.PageSize)
-// 		storage.InitDataPage(rawCatalog) // Wipes page to be safe
-// 		p.WritePage(catalogPage, rawCatalog)
-
-// 		// C. Allocate Users Collection (Page 2)
-// 		userRootPage, _ = storage.AllocatePage(p, h)
-// 		rawUserPage := make([]byte, storage.PageSize)
-// 		storage.InitDataPage(rawUserPage) // Wipes page to be safe
-// 		p.WritePage(userRootPage, rawUserPage)
-
-// 		// D. Register "users" in Catalog
-// 		metaEntry := record.EncodeCollectionEntry("users", userRootPage)
-// 		record.InsertRecord(rawCatalog, 0, metaEntry)
-// 		p.WritePage(catalogPage, rawCatalog)
-
-// 	} else {
-// 		// --- LOAD MODE (Run on restart) ---
-// 		//fmt.Println("Loading existing database...")
-
-// 		// A. Read Header
-// 		h, err = storage.ReadHeader(p)
-// 		if err != nil {
-// 			panic(err)
-// 		}
-
-// 		// B. Read Catalog to find "users" root page
-// 		// (For now, we know it's Page 2 because we built it that way,
-// 		// but in the future you should search Page 1 for name="users")
-// 		userRootPage = 2
-// 	}
-
-// 	// 4. Create Collection Wrapper
-// 	// Now this will read the EXISTING pages instead of wiping them
-// 	//users, err := collection.NewCollection("users", userRootPage, p, h)
-// 	// if err != nil {
-// 	// 	panic(err)
-// 	// }
-
-// 	// 5. Query Test
-// 	// Try to find the document you inserted last time
-// 	//fmt.Println("Attempting to find existing record...")
-
-// 	// Replace with a known ID from your previous run
-// 	// doc, err := users.FindById(2095559075886514214)
-// 	// if err != nil {
-// 	// 	panic(err)
-// 	// }
-
-// 	// if doc == nil {
-// 	// 	fmt.Println("Document not found (Did you insert it?)")
-// 	// } else {
-// 	// 	fmt.Printf("Found document: %+v\n", doc)
-// 	// }
-
-// 	// Optional: Insert new data to prove we append, not overwrite
-// 	// for i := range 3 {
-// 	// 	newDoc := map[string]any{
-// 	// 		"name": fmt.Sprintf("User%d", i),
-// 	// 		"age":  20 + i,
-// 	// 	}
-// 	// 	newId, err := users.Insert(newDoc)
-// 	// 	if err != nil {
-// 	// 		panic(err)
-// 	// 	}
-// 	// 	fmt.Printf("Inserted new document with _id=%d\n", newId)
-// 	// }
-
-// 	// 2. Read it back
-// 	// oldDoc, _ := users.FindById(2095559075886514214)
-// 	// fmt.Printf("Before Update: %+v\n", oldDoc)
-
-// 	// // 3. Update it
-// 	// fmt.Println("Updating user 500...")
-// 	// users.Update(2095559075886514214, map[string]any{
-// 	// 	"name": "New Name",
-// 	// 	"role": "CEO",
-// 	// })
-
-// 	// // 4. Read it back AGAIN
-// 	// newDoc, _ := users.FindById(2095559075886514214)
-// 	// fmt.Printf("After Update: %+v\n", newDoc)
-
-// 	//open catalog collection
-// 	// cat, err := collection.NewCollection("_catalog", 1, p, h)
-// 	// if err != nil {
-// 	// 	panic(err)
-// 	// }
-
-// 	//record, _ := record.GetAllCollections(p)
-
-// 	//fmt.Println("--- STARTING CONCURRENCY TEST ---")
-
-// 	//var wg sync.WaitGroup // Waits for threads to finish
-
-// 	// Launch 100 concurrent writers
-// 	// for i := 0; i < 100; i++ {
-// 	// 	wg.Add(1)
-// 	// 	go func(id int) {
-// 	// 		defer wg.Done()
-
-// 	// 		// Each thread inserts a user
-// 	// 		doc := map[string]any{
-// 	// 			"name": fmt.Sprintf("Concurrent_User_%d", id),
-// 	// 		}
-// 	// 		users.Insert(doc)
-// 	// 		// fmt.Printf("Thread %d finished\n", id)
-// 	// 	}(i)
-// 	// }
-
-// 	// fmt.Println("Waiting for threads...")
-// 	// wg.Wait() // Blocks until all 100 threads are done
-// 	// fmt.Println("All threads finished safely!")
-// }
+import (
+	"fmt"
+	"os"
+
+	"nanodb/internal/database"
+	"nanodb/internal/storage"
+)
+
+// the passphrase of an encrypted database is read from the environment
+// rather than the command line, where other users could see it
+const passphraseEnv = "NANODB_PASSPHRASE"
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: nanodb <command> <file> [args]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  backup <file> <dest>         write a full backup of a database")
+	fmt.Fprintln(os.Stderr, "  incremental <file> <dest>    write the pages changed since the last backup")
+	fmt.Fprintln(os.Stderr, "  restore <file> <backup>...   rebuild a database from a full backup and")
+	fmt.Fprintln(os.Stderr, "                               the incremental backups taken after it")
+	fmt.Fprintln(os.Stderr, "  check <file>                 report inconsistencies in every structure of a database")
+	fmt.Fprintln(os.Stderr, "  upgrade <file>               rewrite a database from an older format in the current one")
+	fmt.Fprintln(os.Stderr, "  truncate <file>              give the free pages at the end of a database back to the file system")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintf(os.Stderr, "encrypted databases take their passphrase from $%s\n", passphraseEnv)
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+	}
+
+	opts := &storage.Options{Passphrase: os.Getenv(passphraseEnv)}
+	args := os.Args[2:]
+
+	var err error
+	switch {
+	case os.Args[1] == "backup" && len(args) == 2:
+		err = backup(args[0], args[1], false, opts)
+	case os.Args[1] == "incremental" && len(args) == 2:
+		err = backup(args[0], args[1], true, opts)
+	case os.Args[1] == "restore" && len(args) >= 2:
+		err = restore(args[0], args[1:])
+	case os.Args[1] == "check" && len(args) == 1:
+		err = check(args[0], opts)
+	case os.Args[1] == "upgrade" && len(args) == 1:
+		err = upgrade(args[0], opts)
+	case os.Args[1] == "truncate" && len(args) == 1:
+		err = truncate(args[0], opts)
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "nanodb:", err)
+		os.Exit(1)
+	}
+}
+
+func backup(path, dest string, incremental bool, opts *storage.Options) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	db, err := database.Open(path, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if incremental {
+		err = db.BackupIncremental(dest)
+	} else {
+		err = db.Backup(dest)
+	}
+	if err != nil {
+		return err
+	}
+
+	m, err := storage.ReadManifest(dest)
+	if err != nil {
+		return err
+	}
+
+	if m.Incremental() {
+		fmt.Printf("%s: %d changed pages since generation %d, now at generation %d\n", dest, len(m.Pages), m.Parent, m.Generation)
+	} else {
+		fmt.Printf("%s: %d pages, generation %d\n", dest, m.PageCount, m.Generation)
+	}
+	return nil
+}
+
+func restore(path string, backups []string) error {
+	if err := storage.Restore(path, backups); err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %s from %d backups\n", path, len(backups))
+	return nil
+}
+
+// check exits with status 1 when it finds problems
+func check(path string, opts *storage.Options) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	opts.ReadOnly = true
+	db, err := database.Open(path, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	problems := db.Check()
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %d problems found", path, len(problems))
+	}
+
+	fmt.Printf("%s: %d pages, no problems found\n", path, db.Header.PageCount)
+	return nil
+}
+
+func upgrade(path string, opts *storage.Options) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	from, err := database.Upgrade(path, opts)
+	if err != nil {
+		return err
+	}
+
+	if from == storage.FormatVersion {
+		fmt.Printf("%s is already at format version %d\n", path, from)
+		return nil
+	}
+
+	fmt.Printf("upgraded %s from format version %d to %d\n", path, from, storage.FormatVersion)
+	return nil
+}
+
+func truncate(path string, opts *storage.Options) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	db, err := database.Open(path, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	reclaimed, err := db.Truncate()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d bytes reclaimed, %d pages left\n", path, reclaimed, db.Header.PageCount)
+	return nil
+}
@@ -30,3 +30,15 @@ func (n *Node) InsertInternalCell(index uint16, id uint64, childPage uint32) {
 
 	n.SetNumCells(numCells + 1)
 }
+
+// setChild points the cell at index at childPage, or the right child for
+// -1 or NumCells, as searchInternalNode and handleUnderFlow number them
+func (n *Node) setChild(index int, childPage uint32) {
+	if index == -1 || index == int(n.NumCells()) {
+		n.SetRightChild(childPage)
+		return
+	}
+
+	offset := 12 + (index * INTERNAL_CELL_SIZE)
+	binary.LittleEndian.PutUint32(n.bytes[offset+8:offset+12], childPage)
+}
@@ -0,0 +1,85 @@
+package btree
+
+import "nanodb/internal/storage"
+
+// In copy-on-write mode a node the tree already had is never written over:
+// the changed node goes to a new page, its parent is changed to point there,
+// and so on up to a new root. The old tree stays intact next to the new one
+// until the write has put the new root in the catalog and calls Release,
+// which frees the pages only the old tree used as part of the same commit.
+// Nodes written since the last Release are in no committed tree yet and are
+// changed in place.
+
+// writeNode writes a node back and returns the page it is now on, which
+// the caller links into the parent in place of pageId
+func (t *Btree) writeNode(pageId uint32, data []byte) (uint32, error) {
+	if !t.CopyOnWrite || t.fresh[pageId] {
+		return pageId, t.Pager.WritePage(pageId, storage.PageTypeIndex, data)
+	}
+
+	newPageId, err := t.allocNode()
+	if err != nil {
+		return 0, err
+	}
+	if err := t.Pager.WritePage(newPageId, storage.PageTypeIndex, data); err != nil {
+		return 0, err
+	}
+
+	t.retire(pageId)
+	return newPageId, nil
+}
+
+// allocNode allocates the page of a new node
+func (t *Btree) allocNode() (uint32, error) {
+	pageId, err := t.Pager.AllocatePage(t.Header)
+	if err != nil {
+		return 0, err
+	}
+
+	if t.CopyOnWrite {
+		if t.fresh == nil {
+			t.fresh = make(map[uint32]bool)
+		}
+		t.fresh[pageId] = true
+	}
+	return pageId, nil
+}
+
+// retire takes a page out of the tree. It is freed by Release rather than
+// now, the root in the catalog may still use it.
+func (t *Btree) retire(pageId uint32) {
+	t.retired = append(t.retired, pageId)
+}
+
+// undo forgets the pages retired by an operation that failed part way, the
+// tree at RootPage still uses them
+func (t *Btree) undo(retired int, err error) error {
+	if err != nil {
+		t.retired = t.retired[:retired]
+	}
+	return err
+}
+
+// Release frees the pages taken out of the tree since the last Release.
+// Writes call it last, once RootPage is in the catalog, so that the catalog
+// never points at a tree with freed pages in it.
+func (t *Btree) Release() error {
+	for i, pageId := range t.retired {
+		if err := t.Pager.FreePage(t.Header, pageId); err != nil {
+			t.retired = t.retired[i:]
+			return err
+		}
+	}
+
+	t.retired = t.retired[:0]
+	clear(t.fresh)
+	return nil
+}
+
+// Discard forgets the pages retired and written since the last Release,
+// for a write that is rolled back. The old tree keeps its pages, and the
+// new ones go back with the rollback, so none of them are freed here.
+func (t *Btree) Discard() {
+	t.retired = t.retired[:0]
+	clear(t.fresh)
+}
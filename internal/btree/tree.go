@@ -7,9 +7,15 @@ import (
 )
 
 type Btree struct {
-	Pager    *storage.Pager
+	Pager    storage.PageStore
 	Header   *storage.DBHeader
 	RootPage uint32
+
+	// write changed nodes to new pages, see shadow.go
+	CopyOnWrite bool
+
+	retired []uint32        // pages out of the tree, freed by Release
+	fresh   map[uint32]bool // pages written since the last Release
 }
 
 type SearchResult struct {
@@ -18,17 +24,29 @@ type SearchResult struct {
 	Found   bool
 }
 
-const MAX_LEAF_CELLS = (storage.PageSize - 12) / LEAF_CELL_SIZE
-const MAX_INTERNAL_CELLS = (storage.PageSize - 12) / INTERNAL_CELL_SIZE
+// node capacity depends on the page size the database was created with
+
+func (t *Btree) maxLeafCells() uint16 {
+	return uint16((t.Pager.UsableSize() - 12) / LEAF_CELL_SIZE)
+}
 
-const MIN_LEAF_CELLS = MAX_LEAF_CELLS / 2
-const MIN_INTERNAL_CELLS = MAX_INTERNAL_CELLS / 2
+func (t *Btree) maxInternalCells() uint16 {
+	return uint16((t.Pager.UsableSize() - 12) / INTERNAL_CELL_SIZE)
+}
+
+func (t *Btree) minLeafCells() uint16 {
+	return t.maxLeafCells() / 2
+}
+
+func (t *Btree) minInternalCells() uint16 {
+	return t.maxInternalCells() / 2
+}
 
 func (t *Btree) SearchKey(key uint64) (SearchResult, error) {
 	currPageNum := t.RootPage
 
 	for {
-		page, err := t.Pager.ReadPage(currPageNum)
+		page, err := t.Pager.PinPage(currPageNum)
 
 		if err != nil {
 			return SearchResult{}, err
@@ -38,13 +56,13 @@ func (t *Btree) SearchKey(key uint64) (SearchResult, error) {
 
 		if node.IsLeaf() {
 			res, err := t.searchLeafNode(node, key)
-			storage.ReleasePageBuffer(page)
+			t.Pager.UnpinPage(currPageNum)
 			return res, err
 		}
 
 		nextPage, _ := t.searchInternalNode(node, key)
 
-		storage.ReleasePageBuffer(page)
+		t.Pager.UnpinPage(currPageNum)
 
 		currPageNum = nextPage
 	}
@@ -91,24 +109,30 @@ func (t *Btree) searchInternalNode(n *Node, key uint64) (uint32, int) {
 }
 
 func (t *Btree) Insert(key uint64, recPage uint32, recSlot uint16) error {
-	splitKey, splitPage, err := t.insertRecursive(t.RootPage, key, recPage, recSlot)
+	retired := len(t.retired)
+	return t.undo(retired, t.insert(key, recPage, recSlot))
+}
+
+func (t *Btree) insert(key uint64, recPage uint32, recSlot uint16) error {
+	rootPage, splitKey, splitPage, err := t.insertRecursive(t.RootPage, key, recPage, recSlot)
 	if err != nil {
 		return err
 	}
 
 	// no split occured
 	if splitPage == 0 {
+		t.RootPage = rootPage
 		return nil
 	}
 
 	// split occurred then create a brand new root
 
-	newPageId, err := t.Pager.AllocatePage(t.Header)
+	newPageId, err := t.allocNode()
 	if err != nil {
 		return err
 	}
 
-	newNodeData := storage.GetBuff()
+	newNodeData := t.Pager.GetBuff()
 	defer storage.ReleasePageBuffer(newNodeData)
 
 	newRoot := NewNode(newNodeData)
@@ -118,12 +142,12 @@ func (t *Btree) Insert(key uint64, recPage uint32, recSlot uint16) error {
 	newRoot.SetNumCells(0)
 
 	//old root becomes left child
-	newRoot.InsertInternalCell(0, splitKey, t.RootPage)
+	newRoot.InsertInternalCell(0, splitKey, rootPage)
 
 	//split page becomes right child
 	newRoot.SetRightChild(splitPage)
 
-	if err := t.Pager.WritePage(newPageId, newRoot.bytes); err != nil {
+	if err := t.Pager.WritePage(newPageId, storage.PageTypeIndex, newRoot.bytes); err != nil {
 		return err
 	}
 
@@ -131,10 +155,12 @@ func (t *Btree) Insert(key uint64, recPage uint32, recSlot uint16) error {
 	return nil
 }
 
-func (t *Btree) insertRecursive(pageId uint32, key uint64, recPage uint32, recSlot uint16) (uint64, uint32, error) {
+// insertRecursive returns the page the node is on after the insert, and
+// the separator and new right page if it split
+func (t *Btree) insertRecursive(pageId uint32, key uint64, recPage uint32, recSlot uint16) (uint32, uint64, uint32, error) {
 	page, err := t.Pager.ReadPage(pageId)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 	defer storage.ReleasePageBuffer(page)
 	node := NewNode(page)
@@ -144,35 +170,36 @@ func (t *Btree) insertRecursive(pageId uint32, key uint64, recPage uint32, recSl
 		return t.insertIntoLeaf(node, pageId, key, recPage, recSlot)
 	}
 
-	childPageId := node.RightChild()
+	childPageId, childIdx := t.searchInternalNode(node, key)
 
-	for i := range node.NumCells() {
-		k, child := node.GetInternalCell(i)
-		if key < k {
-			childPageId = child
-			break
-		}
+	newChildId, splitKey, splitPageId, err := t.insertRecursive(childPageId, key, recPage, recSlot)
+	if err != nil {
+		return 0, 0, 0, err
 	}
 
-	splitKey, splitPageId, err := t.insertRecursive(childPageId, key, recPage, recSlot)
-	if err != nil {
-		return 0, 0, err
+	// the child was copied, point at the copy
+	if newChildId != childPageId {
+		node.setChild(childIdx, newChildId)
 	}
 
 	//child didnt split do nothing
 	if splitPageId == 0 {
-		return 0, 0, nil
+		if newChildId == childPageId {
+			return pageId, 0, 0, nil
+		}
+		newPageId, err := t.writeNode(pageId, node.bytes)
+		return newPageId, 0, 0, err
 	}
 
 	//child had split insert seperator into this node
 	return t.insertIntoInternal(node, pageId, splitKey, splitPageId)
 }
 
-func (t *Btree) insertIntoLeaf(n *Node, pageId uint32, key uint64, recPage uint32, recSlot uint16) (uint64, uint32, error) {
+func (t *Btree) insertIntoLeaf(n *Node, pageId uint32, key uint64, recPage uint32, recSlot uint16) (uint32, uint64, uint32, error) {
 
 	// there is space in leaf
 
-	if n.NumCells() < MAX_LEAF_CELLS {
+	if n.NumCells() < t.maxLeafCells() {
 		// sorted postion
 		insertIdx := uint16(0)
 		for i := range n.NumCells() {
@@ -185,23 +212,20 @@ func (t *Btree) insertIntoLeaf(n *Node, pageId uint32, key uint64, recPage uint3
 
 		n.InsertLeafCell(insertIdx, key, recPage, recSlot)
 
-		if err := t.Pager.WritePage(pageId, n.bytes); err != nil {
-			return 0, 0, err
-		}
-
-		return 0, 0, nil
+		newPageId, err := t.writeNode(pageId, n.bytes)
+		return newPageId, 0, 0, err
 	}
 
 	// there is no space left
 
 	// allocate new page
-	newPageId, err := t.Pager.AllocatePage(t.Header)
+	newPageId, err := t.allocNode()
 
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 
-	newPageData := storage.GetBuff()
+	newPageData := t.Pager.GetBuff()
 	defer storage.ReleasePageBuffer(newPageData)
 	newNode := NewNode(newPageData)
 
@@ -253,27 +277,28 @@ func (t *Btree) insertIntoLeaf(n *Node, pageId uint32, key uint64, recPage uint3
 		newNode.InsertLeafCell(insertIdx, key, recPage, recSlot)
 	}
 
-	if err := t.Pager.WritePage(newPageId, newNode.bytes); err != nil {
-		return 0, 0, err
+	if err := t.Pager.WritePage(newPageId, storage.PageTypeIndex, newNode.bytes); err != nil {
+		return 0, 0, 0, err
 	}
 
 	n.SetRightChild(newPageId)
 
-	if err := t.Pager.WritePage(pageId, n.bytes); err != nil {
-		return 0, 0, err
+	leftPageId, err := t.writeNode(pageId, n.bytes)
+	if err != nil {
+		return 0, 0, 0, err
 	}
 
 	// first key of right node is the seperator key
 
 	splitKey, _, _ := newNode.GetLeafCell(0)
 
-	return splitKey, newPageId, nil
+	return leftPageId, splitKey, newPageId, nil
 }
 
-func (t *Btree) insertIntoInternal(n *Node, pageId uint32, key uint64, childPage uint32) (uint64, uint32, error) {
+func (t *Btree) insertIntoInternal(n *Node, pageId uint32, key uint64, childPage uint32) (uint32, uint64, uint32, error) {
 
 	// fits in node
-	if n.NumCells() < MAX_INTERNAL_CELLS {
+	if n.NumCells() < t.maxInternalCells() {
 		insertIdx := uint16(0)
 		for i := range n.NumCells() {
 			k, _ := n.GetInternalCell(i)
@@ -295,11 +320,8 @@ func (t *Btree) insertIntoInternal(n *Node, pageId uint32, key uint64, childPage
 			binary.LittleEndian.PutUint32(n.bytes[offset+8:offset+12], childPage)
 		}
 
-		if err := t.Pager.WritePage(pageId, n.bytes); err != nil {
-			return 0, 0, err
-		}
-
-		return 0, 0, nil
+		newPageId, err := t.writeNode(pageId, n.bytes)
+		return newPageId, 0, 0, err
 	}
 
 	//doesnt fit in node
@@ -340,13 +362,13 @@ func (t *Btree) insertIntoInternal(n *Node, pageId uint32, key uint64, childPage
 
 	cellLen++
 
-	newPageId, err := t.Pager.AllocatePage(t.Header)
+	newPageId, err := t.allocNode()
 
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 
-	newPageData := storage.GetBuff()
+	newPageData := t.Pager.GetBuff()
 	defer storage.ReleasePageBuffer(newPageData)
 
 	newNode := NewNode(newPageData)
@@ -372,18 +394,30 @@ func (t *Btree) insertIntoInternal(n *Node, pageId uint32, key uint64, childPage
 	}
 	newNode.SetRightChild(currentRightChild)
 
-	if err := t.Pager.WritePage(pageId, n.bytes); err != nil {
-		return 0, 0, err
+	leftPageId, err := t.writeNode(pageId, n.bytes)
+	if err != nil {
+		return 0, 0, 0, err
 	}
 
-	if err := t.Pager.WritePage(newPageId, newNode.bytes); err != nil {
-		return 0, 0, err
+	if err := t.Pager.WritePage(newPageId, storage.PageTypeIndex, newNode.bytes); err != nil {
+		return 0, 0, 0, err
 	}
 
-	return promotedKey, newPageId, nil
+	return leftPageId, promotedKey, newPageId, nil
 }
 
 func (t *Btree) Update(key uint64, recPage uint32, recSlot uint16) error {
+	retired := len(t.retired)
+	return t.undo(retired, t.update(key, recPage, recSlot))
+}
+
+func (t *Btree) update(key uint64, recPage uint32, recSlot uint16) error {
+	type step struct {
+		pageNum  uint32
+		childIdx int
+	}
+	var path []step
+
 	currPageNum := t.RootPage
 
 	for {
@@ -396,18 +430,44 @@ func (t *Btree) Update(key uint64, recPage uint32, recSlot uint16) error {
 		node := NewNode(page)
 
 		if node.IsLeaf() {
-			err := t.updateLeafNode(node, key, currPageNum, recPage, recSlot)
+			newPageNum, err := t.updateLeafNode(node, key, currPageNum, recPage, recSlot)
 
 			storage.ReleasePageBuffer(page)
-			return err
+			if err != nil {
+				return err
+			}
+
+			// link copies into their parents up to a new root
+			for i := len(path) - 1; i >= 0 && newPageNum != currPageNum; i-- {
+				parent, err := t.Pager.ReadPage(path[i].pageNum)
+				if err != nil {
+					return err
+				}
+				NewNode(parent).setChild(path[i].childIdx, newPageNum)
+
+				currPageNum = path[i].pageNum
+				newPageNum, err = t.writeNode(currPageNum, parent)
+				storage.ReleasePageBuffer(parent)
+				if err != nil {
+					return err
+				}
+			}
+
+			// only a copied root is still unlinked
+			if newPageNum != currPageNum {
+				t.RootPage = newPageNum
+			}
+			return nil
 		}
 
-		currPageNum, _ = t.searchInternalNode(node, key)
+		nextPageNum, childIdx := t.searchInternalNode(node, key)
+		path = append(path, step{pageNum: currPageNum, childIdx: childIdx})
+		currPageNum = nextPageNum
 		storage.ReleasePageBuffer(page)
 	}
 }
 
-func (t *Btree) updateLeafNode(n *Node, key uint64, pageId uint32, recPage uint32, recSlot uint16) error {
+func (t *Btree) updateLeafNode(n *Node, key uint64, pageId uint32, recPage uint32, recSlot uint16) (uint32, error) {
 	numCells := n.NumCells()
 
 	low := uint16(0)
@@ -423,7 +483,7 @@ func (t *Btree) updateLeafNode(n *Node, key uint64, pageId uint32, recPage uint3
 			binary.LittleEndian.PutUint32(n.bytes[offset+8:offset+12], recPage)
 			binary.LittleEndian.PutUint16(n.bytes[offset+12:offset+14], recSlot)
 
-			return t.Pager.WritePage(pageId, n.bytes)
+			return t.writeNode(pageId, n.bytes)
 		}
 
 		if key > cellKey {
@@ -433,14 +493,23 @@ func (t *Btree) updateLeafNode(n *Node, key uint64, pageId uint32, recPage uint3
 		}
 	}
 
-	return fmt.Errorf("key %d not found", key)
+	return 0, fmt.Errorf("key %d not found", key)
 }
 
+// Delete removes key from the tree. A root left without keys is replaced
+// by its only child but, like every page the tree stops using, freed only
+// by Release.
 func (t *Btree) Delete(key uint64) error {
-	_, err := t.deleteRecursive(t.RootPage, key)
+	retired := len(t.retired)
+	return t.undo(retired, t.delete(key))
+}
+
+func (t *Btree) delete(key uint64) error {
+	rootPageNum, _, err := t.deleteRecursive(t.RootPage, key)
 	if err != nil {
 		return err
 	}
+	t.RootPage = rootPageNum
 
 	// Check if Root needs to shrink
 	rootPage, err := t.Pager.ReadPage(t.RootPage)
@@ -450,78 +519,69 @@ func (t *Btree) Delete(key uint64) error {
 	rootNode := NewNode(rootPage)
 
 	if !rootNode.IsLeaf() && rootNode.NumCells() == 0 {
-		newRoot := rootNode.RightChild()
-
-		oldRootId := t.RootPage
-		if err := t.Pager.FreePage(t.Header, oldRootId); err != nil {
-			storage.ReleasePageBuffer(rootPage)
-			return err
-		}
-
-		t.RootPage = newRoot
+		t.retire(t.RootPage)
+		t.RootPage = rootNode.RightChild()
 	}
 	storage.ReleasePageBuffer(rootPage)
 
 	return nil
 }
 
-func (t *Btree) deleteRecursive(pageNum uint32, key uint64) (bool, error) {
+// deleteRecursive returns the page the node is on after the delete and
+// whether it is left with too few cells
+func (t *Btree) deleteRecursive(pageNum uint32, key uint64) (uint32, bool, error) {
 
 	page, err := t.Pager.ReadPage(pageNum)
 
 	if err != nil {
-		return false, err
+		return 0, false, err
 	}
+	defer storage.ReleasePageBuffer(page)
 
 	node := NewNode(page)
 
 	// if is a leaf
 	if node.IsLeaf() {
-		if err := t.deleteFromLeaf(node, pageNum, key); err != nil {
-			return false, err
+		newPageNum, err := t.deleteFromLeaf(node, pageNum, key)
+		if err != nil {
+			return 0, false, err
 		}
-		isUnderFlow := node.NumCells() < MIN_LEAF_CELLS && pageNum != t.RootPage
-		storage.ReleasePageBuffer(page)
-		return isUnderFlow, nil
+		isUnderFlow := node.NumCells() < t.minLeafCells() && pageNum != t.RootPage
+		return newPageNum, isUnderFlow, nil
 	}
 
 	//if internal node
 
 	childPage, childIdx := t.searchInternalNode(node, key)
 
-	storage.ReleasePageBuffer(page)
-
-	childUnderFlow, err := t.deleteRecursive(childPage, key)
+	newChildPage, childUnderFlow, err := t.deleteRecursive(childPage, key)
 
 	if err != nil {
-		return false, err
+		return 0, false, err
 	}
 
-	if childUnderFlow {
-		page, err := t.Pager.ReadPage(pageNum)
-
-		if err != nil {
-			return false, err
-		}
-		node := NewNode(page)
+	if newChildPage == childPage && !childUnderFlow {
+		return pageNum, false, nil
+	}
 
-		err = t.handleUnderFlow(node, pageNum, childIdx)
+	node.setChild(childIdx, newChildPage)
 
-		if err != nil {
-			storage.ReleasePageBuffer(page)
-			return false, err
+	if childUnderFlow {
+		if err := t.handleUnderFlow(node, childIdx); err != nil {
+			return 0, false, err
 		}
+	}
 
-		isUnderFlow := node.NumCells() < MIN_INTERNAL_CELLS && pageNum != t.RootPage
-		storage.ReleasePageBuffer(page)
-
-		return isUnderFlow, nil
+	newPageNum, err := t.writeNode(pageNum, node.bytes)
+	if err != nil {
+		return 0, false, err
 	}
 
-	return false, nil
+	isUnderFlow := node.NumCells() < t.minInternalCells() && pageNum != t.RootPage
+	return newPageNum, isUnderFlow, nil
 }
 
-func (t *Btree) deleteFromLeaf(n *Node, pageId uint32, key uint64) error {
+func (t *Btree) deleteFromLeaf(n *Node, pageId uint32, key uint64) (uint32, error) {
 	numCells := n.NumCells()
 
 	foundIdx := -1
@@ -546,7 +606,7 @@ func (t *Btree) deleteFromLeaf(n *Node, pageId uint32, key uint64) error {
 	}
 
 	if foundIdx == -1 {
-		return fmt.Errorf("key %d not found", key)
+		return 0, fmt.Errorf("key %d not found", key)
 	}
 
 	offsetStart := 12 + (foundIdx * LEAF_CELL_SIZE)
@@ -557,11 +617,7 @@ func (t *Btree) deleteFromLeaf(n *Node, pageId uint32, key uint64) error {
 
 	n.SetNumCells(numCells - 1)
 
-	if err := t.Pager.WritePage(pageId, n.bytes); err != nil {
-		return err
-	}
-
-	return nil
+	return t.writeNode(pageId, n.bytes)
 }
 
 func (t *Btree) deleteChildPointer(n *Node, idx int) {
@@ -587,29 +643,36 @@ func (t *Btree) deleteChildPointer(n *Node, idx int) {
 	n.SetNumCells(numCells - 1)
 }
 
-func (t *Btree) handleUnderFlow(parent *Node, parentPageId uint32, childIdx int) error {
+// handleUnderFlow refills the child at childIdx from a sibling or merges
+// it into one. It changes parent, which the caller writes back.
+func (t *Btree) handleUnderFlow(parent *Node, childIdx int) error {
+	// searchInternalNode reports the right child as -1
+	if childIdx == -1 {
+		childIdx = int(parent.NumCells())
+	}
+
 	if childIdx > 0 {
-		if t.tryBorrowLeft(parent, childIdx) {
-			return t.Pager.WritePage(parentPageId, parent.bytes)
+		if ok, err := t.tryBorrowLeft(parent, childIdx); ok || err != nil {
+			return err
 		}
 	}
 
 	if childIdx < int(parent.NumCells()) {
-		if t.tryBorrowRight(parent, childIdx) {
-			return t.Pager.WritePage(parentPageId, parent.bytes)
+		if ok, err := t.tryBorrowRight(parent, childIdx); ok || err != nil {
+			return err
 		}
 	}
 
 	if childIdx > 0 {
-		return t.merge(parent, parentPageId, childIdx-1, childIdx)
+		return t.merge(parent, childIdx-1, childIdx)
 	}
 
-	return t.merge(parent, parentPageId, childIdx, childIdx+1)
+	return t.merge(parent, childIdx, childIdx+1)
 }
 
-func (t *Btree) tryBorrowLeft(parent *Node, childIdx int) bool {
+func (t *Btree) tryBorrowLeft(parent *Node, childIdx int) (bool, error) {
 	if childIdx == 0 {
-		return false
+		return false, nil
 	}
 
 	var leftPageId uint32
@@ -627,26 +690,26 @@ func (t *Btree) tryBorrowLeft(parent *Node, childIdx int) bool {
 
 	leftPage, err := t.Pager.ReadPage(leftPageId)
 	if err != nil {
-		return false
+		return false, err
 	}
 	defer storage.ReleasePageBuffer(leftPage)
 
 	childPage, err := t.Pager.ReadPage(childPageId)
 	if err != nil {
-		return false
+		return false, err
 	}
 	defer storage.ReleasePageBuffer(childPage)
 
 	leftNode := NewNode(leftPage)
 	childNode := NewNode(childPage)
 
-	minCells := MIN_LEAF_CELLS
+	minCells := t.minLeafCells()
 	if !leftNode.IsLeaf() {
-		minCells = MIN_INTERNAL_CELLS
+		minCells = t.minInternalCells()
 	}
 
-	if leftNode.NumCells() <= uint16(minCells) {
-		return false
+	if leftNode.NumCells() <= minCells {
+		return false, nil
 	}
 
 	if childNode.IsLeaf() {
@@ -676,19 +739,23 @@ func (t *Btree) tryBorrowLeft(parent *Node, childIdx int) bool {
 		leftNode.SetNumCells(lastIdx)
 	}
 
-	if err := t.Pager.WritePage(leftPageId, leftNode.bytes); err != nil {
-		return false
+	newLeftPageId, err := t.writeNode(leftPageId, leftNode.bytes)
+	if err != nil {
+		return false, err
 	}
-	if err := t.Pager.WritePage(childPageId, childNode.bytes); err != nil {
-		return false
+	newChildPageId, err := t.writeNode(childPageId, childNode.bytes)
+	if err != nil {
+		return false, err
 	}
 
-	return true
+	parent.setChild(seperatorIdx, newLeftPageId)
+	parent.setChild(childIdx, newChildPageId)
+	return true, nil
 }
 
-func (t *Btree) tryBorrowRight(parent *Node, childIdx int) bool {
+func (t *Btree) tryBorrowRight(parent *Node, childIdx int) (bool, error) {
 	if childIdx == -1 || childIdx >= int(parent.NumCells()) {
-		return false
+		return false, nil
 	}
 
 	seperatorIdx := uint16(childIdx)
@@ -704,26 +771,26 @@ func (t *Btree) tryBorrowRight(parent *Node, childIdx int) bool {
 
 	childPage, err := t.Pager.ReadPage(childPageId)
 	if err != nil {
-		return false
+		return false, err
 	}
 	defer storage.ReleasePageBuffer(childPage)
 
 	rightPage, err := t.Pager.ReadPage(rightPageId)
 	if err != nil {
-		return false
+		return false, err
 	}
 	defer storage.ReleasePageBuffer(rightPage)
 
 	childNode := NewNode(childPage)
 	rightNode := NewNode(rightPage)
 
-	minCells := MIN_LEAF_CELLS
+	minCells := t.minLeafCells()
 	if !rightNode.IsLeaf() {
-		minCells = MIN_INTERNAL_CELLS
+		minCells = t.minInternalCells()
 	}
 
-	if rightNode.NumCells() <= uint16(minCells) {
-		return false
+	if rightNode.NumCells() <= minCells {
+		return false, nil
 	}
 
 	if childNode.IsLeaf() {
@@ -758,17 +825,22 @@ func (t *Btree) tryBorrowRight(parent *Node, childIdx int) bool {
 		t.deleteChildPointer(rightNode, 0)
 	}
 
-	if err := t.Pager.WritePage(childPageId, childNode.bytes); err != nil {
-		return false
+	newChildPageId, err := t.writeNode(childPageId, childNode.bytes)
+	if err != nil {
+		return false, err
 	}
-	if err := t.Pager.WritePage(rightPageId, rightNode.bytes); err != nil {
-		return false
+	newRightPageId, err := t.writeNode(rightPageId, rightNode.bytes)
+	if err != nil {
+		return false, err
 	}
 
-	return true
+	parent.setChild(childIdx, newChildPageId)
+	parent.setChild(childIdx+1, newRightPageId)
+	return true, nil
 }
 
-func (t *Btree) merge(parent *Node, parentPageId uint32, leftIdx int, rightIdx int) error {
+// merge moves the right child into the left one and takes it out of parent
+func (t *Btree) merge(parent *Node, leftIdx int, rightIdx int) error {
 	var leftPageId uint32
 	var rightPageId uint32
 	var separatorIdx = leftIdx
@@ -821,30 +893,50 @@ func (t *Btree) merge(parent *Node, parentPageId uint32, leftIdx int, rightIdx i
 		leftNode.SetRightChild(rightNode.RightChild())
 	}
 
-	if err := t.Pager.WritePage(leftPageId, leftNode.bytes); err != nil {
+	newLeftPageId, err := t.writeNode(leftPageId, leftNode.bytes)
+	if err != nil {
 		storage.ReleasePageBuffer(leftPage)
 		storage.ReleasePageBuffer(rightPage)
 		return err
 	}
 
-	// 4. Free Right Node
-	if err := t.Pager.FreePage(t.Header, rightPageId); err != nil {
-		storage.ReleasePageBuffer(leftPage)
-		storage.ReleasePageBuffer(rightPage)
-		return err
-	}
+	// 4. Retire Right Node
+	t.retire(rightPageId)
 
 	storage.ReleasePageBuffer(leftPage)
 	storage.ReleasePageBuffer(rightPage)
 
 	t.deleteChildPointer(parent, leftIdx)
+	parent.setChild(leftIdx, newLeftPageId)
 
-	if leftIdx == int(parent.NumCells()) {
-		parent.SetRightChild(leftPageId)
-	} else {
-		offset := 12 + (leftIdx * INTERNAL_CELL_SIZE)
-		binary.LittleEndian.PutUint32(parent.bytes[offset+8:offset+12], leftPageId)
+	return nil
+}
+
+// Pages returns every page that belongs to the tree, root first
+func (t *Btree) Pages() ([]uint32, error) {
+	pages := []uint32{}
+	stack := []uint32{t.RootPage}
+
+	for len(stack) > 0 {
+		pageNum := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		pages = append(pages, pageNum)
+
+		page, err := t.Pager.PinPage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+
+		node := NewNode(page)
+		if !node.IsLeaf() {
+			for i := range node.NumCells() {
+				_, child := node.GetInternalCell(i)
+				stack = append(stack, child)
+			}
+			stack = append(stack, node.RightChild())
+		}
+		t.Pager.UnpinPage(pageNum)
 	}
 
-	return t.Pager.WritePage(parentPageId, parent.bytes)
+	return pages, nil
 }
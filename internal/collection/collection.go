@@ -3,6 +3,7 @@ package collection
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"nanodb/internal/btree"
 	"nanodb/internal/record"
@@ -10,6 +11,10 @@ import (
 	"sync"
 )
 
+// ErrVersionConflict is returned by UpdateIfVersion when the document has
+// been updated since the version the caller read
+var ErrVersionConflict = errors.New("document version conflict")
+
 type Bucket struct {
 	Centroid []float32
 	RootPage uint32
@@ -24,12 +29,22 @@ type Collection struct {
 	Name     string
 	RootPage uint32
 	LastPage uint32
+	FsmRoot  uint32
+	Compress bool // deflate documents as they are written
 	MetaData CollectionLoc
 	Buckets  []Bucket
-	Pager    *storage.Pager
+	Pager    storage.PageStore
 	Header   *storage.DBHeader
 	BTree    *btree.Btree
+	fsm      *freeSpaceMap
+	catalog  bool   // the collection of collections, with no entry of its own
+	version  uint16 // format of the database, which decides the catalog layout
 	mu       sync.RWMutex
+
+	// the catalog entry the last read found, as of the snapshot at viewLSN
+	viewMu    sync.Mutex
+	viewLSN   uint64
+	viewEntry *record.CollectionEntry
 }
 
 type FindOptions struct {
@@ -37,7 +52,7 @@ type FindOptions struct {
 	Skip  uint
 }
 
-func NewCollection(colEnt *record.CollectionEntry, pager *storage.Pager, header *storage.DBHeader) (*Collection, error) {
+func NewCollection(colEnt *record.CollectionEntry, pager storage.PageStore, header *storage.DBHeader) (*Collection, error) {
 
 	b := &btree.Btree{
 		Pager:    pager,
@@ -45,14 +60,36 @@ func NewCollection(colEnt *record.CollectionEntry, pager *storage.Pager, header
 		RootPage: colEnt.IndexRoot,
 	}
 
-	lastPage := colEnt.RootPage
+	lastPage, err := lastPageOf(pager, colEnt.RootPage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Collection{
+		Name:     colEnt.Name,
+		RootPage: colEnt.RootPage,
+		MetaData: CollectionLoc{PageId: colEnt.PageId, Slot: colEnt.Slot},
+		Pager:    pager,
+		Header:   header,
+		BTree:    b,
+		LastPage: lastPage,
+		FsmRoot:  colEnt.FsmRoot,
+		Compress: colEnt.Flags&record.CollectionCompressed != 0,
+		catalog:  colEnt.PageId == 0,
+		version:  header.Version,
+	}, nil
+}
+
+// lastPageOf follows the data page chain starting at root to its end
+func lastPageOf(pager storage.PageStore, root uint32) (uint32, error) {
+	lastPage := root
 	curr := lastPage
 
 	for curr != 0 {
 		page, err := pager.ReadPage(curr)
 
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 
 		nextPage := binary.LittleEndian.Uint32(page[4:8])
@@ -65,15 +102,7 @@ func NewCollection(colEnt *record.CollectionEntry, pager *storage.Pager, header
 		storage.ReleasePageBuffer(page)
 	}
 
-	return &Collection{
-		Name:     colEnt.Name,
-		RootPage: colEnt.RootPage,
-		MetaData: CollectionLoc{PageId: colEnt.PageId, Slot: colEnt.Slot},
-		Pager:    pager,
-		Header:   header,
-		BTree:    b,
-		LastPage: lastPage,
-	}, nil
+	return lastPage, nil
 }
 
 func GenerateRandomId(n int) uint64 {
@@ -93,6 +122,7 @@ func (c *Collection) Insert(doc map[string]any) (uint64, error) {
 	docId := GenerateRandomId(6)
 
 	doc["_id"] = docId
+	doc["_version"] = uint64(1)
 
 	data, err := record.EncodeDoc(doc)
 
@@ -100,21 +130,12 @@ func (c *Collection) Insert(doc map[string]any) (uint64, error) {
 		return 0, err
 	}
 
-	var embedding []float32
-	if val, ok := doc["_embeddings"]; ok {
-		if vecInterface, ok := val.([]any); ok {
-			embedding = make([]float32, len(vecInterface))
-			for i, v := range vecInterface {
-				embedding[i] = float32(convertToFloat(v))
-			}
-		}
-
-		delete(doc, "_embeddings")
-	}
+	embedding := takeEmbedding(doc)
 
-	c.mu.Lock()
-	err, _, _ = c.insertDocInternal(docId, data)
-	c.mu.Unlock()
+	err = c.writeTx(func() error {
+		err, _, _ := c.insertDocInternal(docId, data)
+		return err
+	})
 
 	if err != nil {
 		return 0, err
@@ -129,6 +150,22 @@ func (c *Collection) Insert(doc map[string]any) (uint64, error) {
 	return docId, nil
 }
 
+// takeEmbedding removes _embeddings from doc and returns it as a vector
+func takeEmbedding(doc map[string]any) []float32 {
+	var embedding []float32
+	if val, ok := doc["_embeddings"]; ok {
+		if vecInterface, ok := val.([]any); ok {
+			embedding = make([]float32, len(vecInterface))
+			for i, v := range vecInterface {
+				embedding[i] = float32(convertToFloat(v))
+			}
+		}
+
+		delete(doc, "_embeddings")
+	}
+	return embedding
+}
+
 func (c *Collection) InsertMany(docs []map[string]any) (*[]uint64, error) {
 	var docIds []uint64
 
@@ -142,6 +179,7 @@ func (c *Collection) InsertMany(docs []map[string]any) (*[]uint64, error) {
 	for _, doc := range docs {
 		id := GenerateRandomId(6)
 		doc["_id"] = id
+		doc["_version"] = uint64(1)
 		docIds = append(docIds, id)
 
 		if val, ok := doc["_embeddings"]; ok {
@@ -157,134 +195,14 @@ func (c *Collection) InsertMany(docs []map[string]any) (*[]uint64, error) {
 		}
 	}
 
-	c.mu.Lock()
+	err := c.writeTx(func() error {
+		return c.insertManyInternal(docs, docIds)
+	})
 
-	docLen := len(docs)
-
-	currentPageId := c.LastPage
-	oldTreeRoot := c.BTree.RootPage
-	i := 0
-
-	for i < docLen {
-		page, err := c.Pager.ReadPage(currentPageId)
-		if err != nil {
-			c.mu.Unlock()
-			return &[]uint64{}, err
-		}
-
-		isDirty := false
-
-		type PendingIndexUpdate struct {
-			docId uint64
-			slot  uint16
-		}
-		var batchUpdates []PendingIndexUpdate
-
-		for i < docLen {
-			doc := docs[i]
-			docId := docIds[i]
-
-			data, err := record.EncodeDoc(doc)
-
-			if err != nil {
-				storage.ReleasePageBuffer(page)
-				c.mu.Unlock()
-				return &[]uint64{}, err
-			}
-
-			success, err := record.InsertRecord(page, docId, data)
-
-			if err != nil {
-				storage.ReleasePageBuffer(page)
-				c.mu.Unlock()
-				return &[]uint64{}, err
-			}
-
-			if !success {
-				break
-			}
-
-			isDirty = true
-
-			slotCount := binary.LittleEndian.Uint16(page[0:2])
-			batchUpdates = append(batchUpdates, PendingIndexUpdate{docId: docId, slot: slotCount - 1})
-
-			i++
-		}
-		nextPage := binary.LittleEndian.Uint32(page[4:8])
-
-		if isDirty {
-			if err := c.Pager.WritePage(currentPageId, page); err != nil {
-				storage.ReleasePageBuffer(page)
-				c.mu.Unlock()
-				return &[]uint64{}, err
-			}
-		}
-
-		for _, update := range batchUpdates {
-			if err := c.BTree.Insert(update.docId, currentPageId, update.slot); err != nil {
-				storage.ReleasePageBuffer(page)
-				c.mu.Unlock()
-				return &[]uint64{}, err
-			}
-		}
-
-		if c.BTree.RootPage != oldTreeRoot {
-			if err := c.SyncCatalog(); err != nil {
-				storage.ReleasePageBuffer(page)
-				c.mu.Unlock()
-				return &[]uint64{}, err
-			}
-			oldTreeRoot = c.BTree.RootPage
-		}
-
-		if i >= docLen {
-			storage.ReleasePageBuffer(page)
-			break
-		}
-
-		if nextPage != 0 {
-			currentPageId = nextPage
-			storage.ReleasePageBuffer(page)
-			continue
-		}
-
-		newPageId, err := c.Pager.AllocatePage(c.Header)
-
-		if err != nil {
-			storage.ReleasePageBuffer(page)
-			c.mu.Unlock()
-			return &[]uint64{}, err
-		}
-
-		newPageData := storage.GetBuff()
-		storage.InitDataPage(newPageData)
-
-		if err := c.Pager.WritePage(newPageId, newPageData); err != nil {
-			storage.ReleasePageBuffer(newPageData)
-			storage.ReleasePageBuffer(page)
-			c.mu.Unlock()
-			return &[]uint64{}, err
-		}
-
-		storage.ReleasePageBuffer(newPageData)
-
-		binary.LittleEndian.PutUint32(page[4:8], newPageId)
-
-		if err := c.Pager.WritePage(currentPageId, page); err != nil {
-			storage.ReleasePageBuffer(page)
-			c.mu.Unlock()
-			return &[]uint64{}, err
-		}
-
-		storage.ReleasePageBuffer(page)
-
-		c.LastPage = newPageId
-		currentPageId = newPageId
+	if err != nil {
+		return &[]uint64{}, err
 	}
 
-	c.mu.Unlock()
-
 	for _, req := range vectorsToInsert {
 		c.InsertVector(req.id, req.vec)
 	}
@@ -292,17 +210,53 @@ func (c *Collection) InsertMany(docs []map[string]any) (*[]uint64, error) {
 	return &docIds, nil
 }
 
+// FindById, like every read of a collection, sees the collection as of the
+// last commit and does not wait for a write in progress
 func (c *Collection) FindById(docId uint64) (map[string]any, error) {
-	c.mu.RLock()         // lock for reading
-	defer c.mu.RUnlock() // unlock after function ends
+	v, snap, err := c.view()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
 
-	return c.findByIdInternal(docId)
+	return v.findByIdInternal(docId)
 }
 
 func (c *Collection) UpdateById(id uint64, newData map[string]any) error {
-	c.mu.Lock()         // lock for writing
-	defer c.mu.Unlock() // unlock after function ends
+	return c.writeTx(func() error {
+		return c.updateByIdInternal(id, newData)
+	})
+}
+
+// UpdateIfVersion replaces the document like UpdateById, but only if its
+// _version is still expectedVersion, and fails with ErrVersionConflict
+// otherwise. A document written before versions existed is at version 0.
+func (c *Collection) UpdateIfVersion(id uint64, expectedVersion uint64, newData map[string]any) error {
+	return c.writeTx(func() error {
+		return c.updateIfVersionInternal(id, expectedVersion, newData)
+	})
+}
+
+func (c *Collection) updateIfVersionInternal(id uint64, expectedVersion uint64, newData map[string]any) error {
+	doc, err := c.findByIdInternal(id)
+	if err != nil {
+		return err
+	}
+
+	if doc == nil {
+		return fmt.Errorf("document with ID %d does not exist", id)
+	}
+
+	if version := docVersion(doc); version != expectedVersion {
+		return fmt.Errorf("document %d is at version %d, not %d: %w", id, version, expectedVersion, ErrVersionConflict)
+	}
+
+	return c.updateByIdInternal(id, newData)
+}
 
+// updateByIdInternal stores newData in place of the document and sets its
+// _version to one past the stored one, whatever newData says
+func (c *Collection) updateByIdInternal(id uint64, newData map[string]any) error {
 	res, err := c.BTree.SearchKey(id)
 
 	if err != nil {
@@ -313,7 +267,13 @@ func (c *Collection) UpdateById(id uint64, newData map[string]any) error {
 		return fmt.Errorf("document with ID %d does not exist", id)
 	}
 
+	version, err := c.versionAt(res.PageNum, res.SlotNum)
+	if err != nil {
+		return err
+	}
+
 	newData["_id"] = id
+	newData["_version"] = version + 1
 
 	//serialize new data
 	data, err := record.EncodeDoc(newData)
@@ -321,7 +281,15 @@ func (c *Collection) UpdateById(id uint64, newData map[string]any) error {
 		return err
 	}
 
-	currPageId := c.LastPage
+	rec, err := c.spill(data)
+	if err != nil {
+		return err
+	}
+
+	currPageId, err := c.pageFor(rec.data)
+	if err != nil {
+		return err
+	}
 
 	for {
 		pageData, err := c.Pager.ReadPage(currPageId)
@@ -329,7 +297,7 @@ func (c *Collection) UpdateById(id uint64, newData map[string]any) error {
 			return err
 		}
 
-		success, err := record.InsertRecord(pageData, id, data)
+		slot, success, err := insertStored(pageData, id, rec)
 		if err != nil {
 			storage.ReleasePageBuffer(pageData)
 			return err
@@ -337,29 +305,47 @@ func (c *Collection) UpdateById(id uint64, newData map[string]any) error {
 		//if update successful, write back and update index
 		if success {
 
-			if err := c.Pager.WritePage(currPageId, pageData); err != nil {
+			if err := c.Pager.WritePage(currPageId, storage.PageTypeData, pageData); err != nil {
 				storage.ReleasePageBuffer(pageData)
 				return err
 			}
 
-			slotCount := binary.LittleEndian.Uint16(pageData[0:2])
-
-			if err := c.BTree.Update(id, currPageId, slotCount-1); err != nil {
+			oldTreeRoot := c.BTree.RootPage
+			if err := c.BTree.Update(id, currPageId, slot); err != nil {
 				storage.ReleasePageBuffer(pageData)
 				return err
 			}
+			// a copy-on-write index has a new root after every change
+			if c.BTree.RootPage != oldTreeRoot {
+				if err := c.SyncCatalog(); err != nil {
+					storage.ReleasePageBuffer(pageData)
+					return err
+				}
+			}
 
 			if currPageId == res.PageNum {
-				record.MarkSlotDeleted(pageData, res.SlotNum)
-				c.Pager.WritePage(currPageId, pageData)
+				if err := c.freeSlot(pageData, res.SlotNum); err != nil {
+					storage.ReleasePageBuffer(pageData)
+					return err
+				}
+				c.Pager.WritePage(currPageId, storage.PageTypeData, pageData)
 			} else {
 				oldPageData, err := c.Pager.ReadPage(res.PageNum)
 				if err != nil {
 					storage.ReleasePageBuffer(pageData)
 					return err
 				}
-				record.MarkSlotDeleted(oldPageData, res.SlotNum)
-				if err := c.Pager.WritePage(res.PageNum, oldPageData); err != nil {
+				if err := c.freeSlot(oldPageData, res.SlotNum); err != nil {
+					storage.ReleasePageBuffer(oldPageData)
+					storage.ReleasePageBuffer(pageData)
+					return err
+				}
+				if err := c.Pager.WritePage(res.PageNum, storage.PageTypeData, oldPageData); err != nil {
+					storage.ReleasePageBuffer(oldPageData)
+					storage.ReleasePageBuffer(pageData)
+					return err
+				}
+				if err := c.noteFreeSpace(res.PageNum, oldPageData); err != nil {
 					storage.ReleasePageBuffer(oldPageData)
 					storage.ReleasePageBuffer(pageData)
 					return err
@@ -368,11 +354,21 @@ func (c *Collection) UpdateById(id uint64, newData map[string]any) error {
 				storage.ReleasePageBuffer(oldPageData)
 			}
 
-			c.LastPage = currPageId
-
+			err := c.noteFreeSpace(currPageId, pageData)
 			storage.ReleasePageBuffer(pageData)
 
-			return nil
+			return err
+		}
+
+		// the map was stale, correct it and fall back to the tail
+		if currPageId != c.LastPage {
+			err := c.noteFreeSpace(currPageId, pageData)
+			storage.ReleasePageBuffer(pageData)
+			if err != nil {
+				return err
+			}
+			currPageId = c.LastPage
+			continue
 		}
 
 		// move to next page if update failed
@@ -391,9 +387,9 @@ func (c *Collection) UpdateById(id uint64, newData map[string]any) error {
 			return err
 		}
 
-		newPageData := storage.GetBuff()
+		newPageData := c.Pager.GetBuff()
 		storage.InitDataPage(newPageData)
-		if err := c.Pager.WritePage(newPageId, newPageData); err != nil {
+		if err := c.Pager.WritePage(newPageId, storage.PageTypeData, newPageData); err != nil {
 			storage.ReleasePageBuffer(newPageData)
 			storage.ReleasePageBuffer(pageData)
 			return err
@@ -401,11 +397,12 @@ func (c *Collection) UpdateById(id uint64, newData map[string]any) error {
 
 		// link old page to new page
 		binary.LittleEndian.PutUint32(pageData[4:8], newPageId)
-		if err := c.Pager.WritePage(currPageId, pageData); err != nil {
+		if err := c.Pager.WritePage(currPageId, storage.PageTypeData, pageData); err != nil {
 			storage.ReleasePageBuffer(pageData)
 			storage.ReleasePageBuffer(newPageData)
 			return err
 		}
+		c.LastPage = newPageId
 		currPageId = newPageId
 		storage.ReleasePageBuffer(pageData)
 		storage.ReleasePageBuffer(newPageData)
@@ -413,17 +410,22 @@ func (c *Collection) UpdateById(id uint64, newData map[string]any) error {
 }
 
 func (c *Collection) DeleteById(id uint64) error {
-
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	return c.deleteDocInternal(id)
+	return c.writeTx(func() error {
+		return c.deleteDocInternal(id)
+	})
 }
 
 func (c *Collection) FindAndDelete(query map[string]any) (bool, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	var found bool
+	err := c.writeTx(func() error {
+		var err error
+		found, err = c.findAndDeleteInternal(query)
+		return err
+	})
+	return found, err
+}
 
+func (c *Collection) findAndDeleteInternal(query map[string]any) (bool, error) {
 	currentPageId := c.RootPage
 	oldTreeRoot := c.BTree.RootPage
 	for currentPageId != 0 {
@@ -438,7 +440,11 @@ func (c *Collection) FindAndDelete(query map[string]any) (bool, error) {
 		isDirty := false
 		for slot := range slotCount {
 
-			docId, data, deleted := record.ReadRecord(pageData, slot)
+			docId, data, deleted, err := record.LoadRecord(c.Pager, pageData, slot)
+			if err != nil {
+				storage.ReleasePageBuffer(pageData)
+				return false, err
+			}
 
 			if deleted {
 				continue
@@ -451,7 +457,10 @@ func (c *Collection) FindAndDelete(query map[string]any) (bool, error) {
 			}
 			if match(doc, query) {
 				isDirty = true
-				record.MarkSlotDeleted(pageData, slot)
+				if err := c.freeSlot(pageData, slot); err != nil {
+					storage.ReleasePageBuffer(pageData)
+					return false, err
+				}
 				err = c.BTree.Delete(docId)
 				if err != nil {
 					storage.ReleasePageBuffer(pageData)
@@ -467,7 +476,11 @@ func (c *Collection) FindAndDelete(query map[string]any) (bool, error) {
 			}
 		}
 		if isDirty {
-			if err := c.Pager.WritePage(currentPageId, pageData); err != nil {
+			if err := c.Pager.WritePage(currentPageId, storage.PageTypeData, pageData); err != nil {
+				storage.ReleasePageBuffer(pageData)
+				return false, err
+			}
+			if err := c.noteFreeSpace(currentPageId, pageData); err != nil {
 				storage.ReleasePageBuffer(pageData)
 				return false, err
 			}
@@ -479,6 +492,16 @@ func (c *Collection) FindAndDelete(query map[string]any) (bool, error) {
 }
 
 func (c *Collection) Find(query map[string]any, opts *FindOptions) ([]map[string]any, []uint64, error) {
+	v, snap, err := c.view()
+	if err != nil {
+		return nil, []uint64{0}, err
+	}
+	defer snap.Close()
+
+	return v.findInternal(query, opts)
+}
+
+func (c *Collection) findInternal(query map[string]any, opts *FindOptions) ([]map[string]any, []uint64, error) {
 	var results []map[string]any = make([]map[string]any, 0)
 	var docIds []uint64
 
@@ -498,7 +521,7 @@ func (c *Collection) Find(query map[string]any, opts *FindOptions) ([]map[string
 
 	currentPageId := c.RootPage
 	for currentPageId != 0 {
-		pageData, err := c.Pager.ReadPage(currentPageId)
+		pageData, err := c.Pager.PinPage(currentPageId)
 
 		if err != nil {
 			return nil, []uint64{0}, err
@@ -508,7 +531,11 @@ func (c *Collection) Find(query map[string]any, opts *FindOptions) ([]map[string
 
 		for slot := range slotCount {
 
-			docId, data, deleted := record.ReadRecord(pageData, slot)
+			docId, data, deleted, err := record.LoadRecord(c.Pager, pageData, slot)
+			if err != nil {
+				c.Pager.UnpinPage(currentPageId)
+				return nil, []uint64{0}, err
+			}
 
 			if deleted {
 				continue
@@ -516,7 +543,7 @@ func (c *Collection) Find(query map[string]any, opts *FindOptions) ([]map[string
 
 			doc, err := record.DecodeDoc(data)
 			if err != nil {
-				storage.ReleasePageBuffer(pageData)
+				c.Pager.UnpinPage(currentPageId)
 				return nil, []uint64{0}, err
 			}
 			if match(doc, query) {
@@ -531,25 +558,36 @@ func (c *Collection) Find(query map[string]any, opts *FindOptions) ([]map[string
 				if isThereLimit {
 					limit--
 					if limit == 0 {
-						storage.ReleasePageBuffer(pageData)
+						c.Pager.UnpinPage(currentPageId)
 						return results, docIds, nil
 					}
 				}
 			}
 		}
-		currentPageId = binary.LittleEndian.Uint32(pageData[4:8])
-		storage.ReleasePageBuffer(pageData)
+		nextPageId := binary.LittleEndian.Uint32(pageData[4:8])
+		c.Pager.UnpinPage(currentPageId)
+		currentPageId = nextPageId
 	}
 
 	return results, docIds, nil
 }
 
 func (c *Collection) FindAllDocIds(query map[string]any) ([]uint64, error) {
+	v, snap, err := c.view()
+	if err != nil {
+		return []uint64{0}, err
+	}
+	defer snap.Close()
+
+	return v.findAllDocIdsInternal(query)
+}
+
+func (c *Collection) findAllDocIdsInternal(query map[string]any) ([]uint64, error) {
 	var results []uint64
 
 	currentPageId := c.RootPage
 	for currentPageId != 0 {
-		pageData, err := c.Pager.ReadPage(currentPageId)
+		pageData, err := c.Pager.PinPage(currentPageId)
 
 		if err != nil {
 			return []uint64{0}, err
@@ -559,7 +597,11 @@ func (c *Collection) FindAllDocIds(query map[string]any) ([]uint64, error) {
 
 		for slot := range slotCount {
 
-			docId, data, deleted := record.ReadRecord(pageData, slot)
+			docId, data, deleted, err := record.LoadRecord(c.Pager, pageData, slot)
+			if err != nil {
+				c.Pager.UnpinPage(currentPageId)
+				return []uint64{0}, err
+			}
 
 			if deleted {
 				continue
@@ -567,25 +609,35 @@ func (c *Collection) FindAllDocIds(query map[string]any) ([]uint64, error) {
 
 			doc, err := record.DecodeDoc(data)
 			if err != nil {
-				storage.ReleasePageBuffer(pageData)
+				c.Pager.UnpinPage(currentPageId)
 				return []uint64{0}, err
 			}
 			if match(doc, query) {
 				results = append(results, docId)
 			}
 		}
-		currentPageId = binary.LittleEndian.Uint32(pageData[4:8])
-		storage.ReleasePageBuffer(pageData)
+		nextPageId := binary.LittleEndian.Uint32(pageData[4:8])
+		c.Pager.UnpinPage(currentPageId)
+		currentPageId = nextPageId
 	}
 
 	return results, nil
 }
 
 func (c *Collection) FindOne(query map[string]any) (map[string]any, error) {
+	v, snap, err := c.view()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+
+	return v.findOneInternal(query)
+}
 
+func (c *Collection) findOneInternal(query map[string]any) (map[string]any, error) {
 	currentPageId := c.RootPage
 	for currentPageId != 0 {
-		pageData, err := c.Pager.ReadPage(currentPageId)
+		pageData, err := c.Pager.PinPage(currentPageId)
 
 		if err != nil {
 			return nil, err
@@ -595,7 +647,11 @@ func (c *Collection) FindOne(query map[string]any) (map[string]any, error) {
 
 		for slot := range slotCount {
 
-			_, data, deleted := record.ReadRecord(pageData, slot)
+			_, data, deleted, err := record.LoadRecord(c.Pager, pageData, slot)
+			if err != nil {
+				c.Pager.UnpinPage(currentPageId)
+				return nil, err
+			}
 
 			if deleted {
 				continue
@@ -603,21 +659,43 @@ func (c *Collection) FindOne(query map[string]any) (map[string]any, error) {
 
 			doc, err := record.DecodeDoc(data)
 			if err != nil {
-				storage.ReleasePageBuffer(pageData)
+				c.Pager.UnpinPage(currentPageId)
 				return nil, err
 			}
 			if match(doc, query) {
-				storage.ReleasePageBuffer(pageData)
+				c.Pager.UnpinPage(currentPageId)
 				return doc, nil
 			}
 		}
-		currentPageId = binary.LittleEndian.Uint32(pageData[4:8])
-		storage.ReleasePageBuffer(pageData)
+		nextPageId := binary.LittleEndian.Uint32(pageData[4:8])
+		c.Pager.UnpinPage(currentPageId)
+		currentPageId = nextPageId
 	}
 
 	return nil, nil
 }
 
+// SetCompression turns compression of newly written documents on or off
+// and records the setting in the catalog. Documents already stored keep
+// the form they were written in.
+func (c *Collection) SetCompression(on bool) error {
+	c.mu.RLock()
+	same := c.Compress == on
+	c.mu.RUnlock()
+
+	if same {
+		return nil
+	}
+
+	return c.writeTx(func() error {
+		if c.Compress == on {
+			return nil
+		}
+		c.Compress = on
+		return c.SyncCatalog()
+	})
+}
+
 func (c *Collection) SyncCatalog() error {
 	metaData := c.MetaData
 
@@ -630,9 +708,20 @@ func (c *Collection) SyncCatalog() error {
 	offset := 8 + metaData.Slot*4 // [offset 2] [length 2]
 
 	recordOffset := binary.LittleEndian.Uint16(page[offset : offset+2])
+	recordLen := binary.LittleEndian.Uint16(page[offset+2 : offset+4])
 
-	entry := record.EncodeCollectionEntry(c.Name, c.RootPage, c.BTree.RootPage)
-	copy(page[recordOffset+12:], entry)
+	var flags uint8
+	if c.Compress {
+		flags |= record.CollectionCompressed
+	}
+
+	entry := record.EncodeCollectionEntry(c.Name, c.RootPage, c.BTree.RootPage, c.FsmRoot, flags)
 
-	return c.Pager.WritePage(metaData.PageId, page)
+	// the name never changes, so neither does the length of the entry
+	if int(recordLen) != 12+len(entry) {
+		return fmt.Errorf("catalog entry of %s is %d bytes, want %d", c.Name, recordLen, 12+len(entry))
+	}
+
+	copy(page[recordOffset+12:], entry)
+	return c.Pager.WritePage(metaData.PageId, storage.PageTypeCatalog, page)
 }
@@ -0,0 +1,200 @@
+package collection_test
+
+import (
+	"errors"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/storage"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFailedWriteRollsBack(t *testing.T) {
+	cases := map[string]*storage.Options{
+		"file":          {CachePages: 8},
+		"copy-on-write": {CachePages: 8, CopyOnWriteIndex: true},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "t.db")
+			db := dbtest.Open(t, path, opts)
+			c, err := db.CreateCollection("c")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.InsertMany(dbtest.PaddedDocs(20, 100)); err != nil {
+				t.Fatal(err)
+			}
+			pageCount := db.Header.PageCount
+
+			// enough to split the index, grow the chain and spill overflow
+			// pages, more than the cache holds
+			docs := append(dbtest.PaddedDocs(400, 200), dbtest.PaddedDocs(3, 3*storage.DefaultPageSize)...)
+			if err := c.InsertThenFail(docs); err == nil {
+				t.Fatal("write did not fail")
+			}
+
+			if n := dbtest.Count(t, c); n != 20 {
+				t.Fatalf("%d documents after the failed write, want 20", n)
+			}
+			if db.Header.PageCount != pageCount {
+				t.Fatalf("header counts %d pages, want %d", db.Header.PageCount, pageCount)
+			}
+			dbtest.Check(t, db)
+
+			// the collection carries on from the last commit
+			if _, err := c.InsertMany(dbtest.PaddedDocs(50, 300)); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db = dbtest.Open(t, path, opts)
+			defer db.Close()
+			c, _ = db.Collection("c")
+			if n := dbtest.Count(t, c); n != 70 {
+				t.Fatalf("%d documents after reopening, want 70", n)
+			}
+			dbtest.Check(t, db)
+		})
+	}
+}
+
+// a failed copy-on-write leaves the committed index whole, none of its
+// pages are freed for the next write to hand out
+func TestFailedCopyOnWriteKeepsTheIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	opts := &storage.Options{CachePages: 8, CopyOnWriteIndex: true}
+	db := dbtest.Open(t, path, opts)
+	c, _ := db.CreateCollection("c")
+	docIds, err := c.InsertMany(dbtest.PaddedDocs(300, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeList := db.Header.FreeList
+
+	if err := c.InsertThenFail(dbtest.PaddedDocs(300, 100)); err == nil {
+		t.Fatal("write did not fail")
+	}
+	if db.Header.FreeList != freeList {
+		t.Fatalf("free list starts at page %d after the failed write, want %d", db.Header.FreeList, freeList)
+	}
+
+	// the next writes copy the committed nodes rather than reuse them
+	for range 3 {
+		if _, err := c.InsertMany(dbtest.PaddedDocs(100, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = dbtest.Open(t, path, opts)
+	defer db.Close()
+	c, _ = db.Collection("c")
+	for _, id := range *docIds {
+		if doc, err := c.FindById(id); err != nil || doc == nil {
+			t.Fatalf("document %d lost from the index: %v", id, err)
+		}
+	}
+	if n := dbtest.Count(t, c); n != 600 {
+		t.Fatalf("%d documents, want 600", n)
+	}
+	dbtest.Check(t, db)
+}
+
+type failingFree struct {
+	storage.PageStore
+}
+
+func (f failingFree) FreePage(h *storage.DBHeader, pageNum uint32) error {
+	return errors.New("free list damaged")
+}
+
+// a write whose old index pages cannot be freed fails, and the pages it
+// meant to free are not freed by the next write while the tree uses them
+func TestFailedReleaseKeepsTheIndex(t *testing.T) {
+	db := dbtest.Open(t, filepath.Join(t.TempDir(), "t.db"), &storage.Options{CopyOnWriteIndex: true})
+	defer db.Close()
+	c, _ := db.CreateCollection("c")
+	docIds, _ := c.InsertMany(dbtest.PaddedDocs(300, 100))
+
+	pager := c.BTree.Pager
+	c.BTree.Pager = failingFree{pager}
+	if _, err := c.Insert(map[string]any{"lost": true}); err == nil {
+		t.Fatal("write did not fail")
+	}
+	c.BTree.Pager = pager
+
+	if _, err := c.InsertMany(dbtest.PaddedDocs(100, 100)); err != nil {
+		t.Fatal(err)
+	}
+	dbtest.Check(t, db)
+	for _, id := range *docIds {
+		if doc, err := c.FindById(id); err != nil || doc == nil {
+			t.Fatalf("document %d lost from the index: %v", id, err)
+		}
+	}
+}
+
+func TestFailedWriteRollsBackInMemory(t *testing.T) {
+	db := dbtest.Open(t, storage.MemoryPath, nil)
+	defer db.Close()
+
+	c, _ := db.CreateCollection("c")
+	c.InsertMany(dbtest.PaddedDocs(10, 100))
+
+	err := c.InsertThenFail(dbtest.PaddedDocs(300, 200))
+	if err == nil || errors.Is(err, storage.ErrAfterCommit) {
+		t.Fatalf("write did not fail: %v", err)
+	}
+	if n := dbtest.Count(t, c); n != 10 {
+		t.Fatalf("%d documents after the failed write, want 10", n)
+	}
+	dbtest.Check(t, db)
+}
+
+func TestLargeDocuments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	db := dbtest.Open(t, path, nil)
+	c, _ := db.CreateCollection("c")
+
+	big := strings.Repeat("b", 5*storage.DefaultPageSize)
+	id, err := c.Insert(map[string]any{"body": big})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageCount := db.Header.PageCount
+
+	// shrinking frees the chain, growing again reuses it
+	if err := c.UpdateById(id, map[string]any{"body": "small"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateById(id, map[string]any{"body": big}); err != nil {
+		t.Fatal(err)
+	}
+	if db.Header.PageCount != pageCount {
+		t.Fatalf("file grew to %d pages rewriting the document, want %d", db.Header.PageCount, pageCount)
+	}
+	dbtest.Check(t, db)
+	db.Close()
+
+	db = dbtest.Open(t, path, nil)
+	defer db.Close()
+	c, _ = db.Collection("c")
+
+	doc, err := c.FindById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["body"] != big {
+		t.Fatal("large document does not read back")
+	}
+
+	if err := c.DeleteById(id); err != nil {
+		t.Fatal(err)
+	}
+	dbtest.Check(t, db)
+}
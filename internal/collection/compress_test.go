@@ -0,0 +1,76 @@
+package collection_test
+
+import (
+	"nanodb/internal/dbtest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressedCollection(t *testing.T) {
+	dir := t.TempDir()
+	pages := map[bool]uint32{}
+
+	for _, compress := range []bool{false, true} {
+		path := filepath.Join(dir, map[bool]string{false: "plain.db", true: "packed.db"}[compress])
+		db := dbtest.Open(t, path, nil)
+		c, _ := db.CreateCollection("c")
+		if err := c.SetCompression(compress); err != nil {
+			t.Fatal(err)
+		}
+
+		text := strings.Repeat("the quick brown fox ", 20)
+		big := strings.Repeat("lorem ipsum dolor ", 2000)
+		for i := range 500 {
+			if _, err := c.Insert(map[string]any{"i": i, "text": text}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bigId, err := c.Insert(map[string]any{"text": big})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages[compress] = db.Header.PageCount
+		db.Close()
+
+		// the setting is kept, and documents read back whole
+		db = dbtest.Open(t, path, nil)
+		c, _ = db.Collection("c")
+		if c.Compress != compress {
+			t.Fatalf("compression %v after reopening, want %v", c.Compress, compress)
+		}
+		doc, err := c.FindById(bigId)
+		if err != nil || doc["text"] != big {
+			t.Fatalf("large document does not read back: %v", err)
+		}
+		if n := dbtest.Count(t, c); n != 501 {
+			t.Fatalf("%d documents, want 501", n)
+		}
+		dbtest.Check(t, db)
+		db.Close()
+	}
+
+	if pages[true]*2 > pages[false] {
+		t.Fatalf("compressed collection takes %d pages, plain %d", pages[true], pages[false])
+	}
+}
+
+func TestCompressionCanBeTurnedOff(t *testing.T) {
+	db := dbtest.Open(t, filepath.Join(t.TempDir(), "c.db"), nil)
+	defer db.Close()
+	c, _ := db.CreateCollection("c")
+
+	c.SetCompression(true)
+	packedId, _ := c.Insert(map[string]any{"text": strings.Repeat("abc ", 100)})
+	c.SetCompression(false)
+	plainId, _ := c.Insert(map[string]any{"text": strings.Repeat("xyz ", 100)})
+
+	// pages mix the two, each record says which it is
+	for id, want := range map[uint64]string{packedId: "abc ", plainId: "xyz "} {
+		doc, err := c.FindById(id)
+		if err != nil || doc["text"] != strings.Repeat(want, 100) {
+			t.Fatalf("document %d does not read back: %v", id, err)
+		}
+	}
+	dbtest.Check(t, db)
+}
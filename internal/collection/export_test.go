@@ -0,0 +1,32 @@
+package collection
+
+import (
+	"errors"
+	"nanodb/internal/record"
+)
+
+var errInjected = errors.New("injected failure")
+
+// InsertThenFail inserts docs in a write that then fails, leaving the
+// collection to roll back a write with every kind of page in it
+func (c *Collection) InsertThenFail(docs []map[string]any) error {
+	docIds := make([]uint64, len(docs))
+	for i := range docs {
+		docIds[i] = GenerateRandomId(6)
+	}
+
+	return c.writeTx(func() error {
+		if err := c.insertManyInternal(docs, docIds); err != nil {
+			return err
+		}
+		return errInjected
+	})
+}
+
+// CachedEntry returns the catalog entry the last read found and the LSN of
+// the snapshot it found it in
+func (c *Collection) CachedEntry() (*record.CollectionEntry, uint64) {
+	c.viewMu.Lock()
+	defer c.viewMu.Unlock()
+	return c.viewEntry, c.viewLSN
+}
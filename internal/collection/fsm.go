@@ -0,0 +1,247 @@
+package collection
+
+import (
+	"encoding/binary"
+	"nanodb/internal/record"
+	"nanodb/internal/storage"
+)
+
+// the free-space map is a page chain listing every data page of the
+// collection with a one byte estimate of the room left on it.
+// page layout: [next 4][count 2] then count entries of [pageNum 4][category 1]
+
+const fsmHeaderSize = 6
+const fsmEntrySize = 5
+
+type fsmLoc struct {
+	page     uint32 // map page holding the entry
+	idx      uint16
+	category uint8
+}
+
+type freeSpaceMap struct {
+	last    uint32 // tail of the map's page chain
+	unit    int    // bytes per category step
+	entries map[uint32]fsmLoc
+	buckets [256]map[uint32]struct{}
+}
+
+func newFreeSpaceMap(usableSize int) *freeSpaceMap {
+	m := &freeSpaceMap{
+		unit:    usableSize / 256,
+		entries: make(map[uint32]fsmLoc),
+	}
+	for i := range m.buckets {
+		m.buckets[i] = make(map[uint32]struct{})
+	}
+	return m
+}
+
+// category rounds down, so a page is never promised more room than it has
+func (m *freeSpaceMap) category(free int) uint8 {
+	return uint8(min(255, free/m.unit))
+}
+
+func (m *freeSpaceMap) track(pageNum uint32, loc fsmLoc) {
+	if old, ok := m.entries[pageNum]; ok {
+		delete(m.buckets[old.category], pageNum)
+	}
+	m.entries[pageNum] = loc
+	m.buckets[loc.category][pageNum] = struct{}{}
+}
+
+// find returns a data page with at least need bytes free
+func (m *freeSpaceMap) find(need int) (uint32, bool) {
+	for cat := (need + m.unit - 1) / m.unit; cat < 256; cat++ {
+		for pageNum := range m.buckets[cat] {
+			return pageNum, true
+		}
+	}
+	return 0, false
+}
+
+// pageFor picks the page an insert of data should try first
+func (c *Collection) pageFor(data []byte) (uint32, error) {
+	m, err := c.freeSpaceMap()
+	if err != nil {
+		return 0, err
+	}
+
+	if pageNum, ok := m.find(12 + len(data) + 4); ok {
+		return pageNum, nil
+	}
+	return c.LastPage, nil
+}
+
+// freeSpaceMap loads the collection's map, building it from the page chain
+// the first time a collection that has none is written to
+func (c *Collection) freeSpaceMap() (*freeSpaceMap, error) {
+	if c.fsm != nil {
+		return c.fsm, nil
+	}
+
+	if c.FsmRoot == 0 {
+		return c.buildFreeSpaceMap()
+	}
+
+	m := newFreeSpaceMap(c.Pager.UsableSize())
+
+	for curr := c.FsmRoot; curr != 0; {
+		page, err := c.Pager.PinPage(curr)
+		if err != nil {
+			return nil, err
+		}
+
+		count := binary.LittleEndian.Uint16(page[4:6])
+		for idx := range count {
+			offset := fsmHeaderSize + int(idx)*fsmEntrySize
+			pageNum := binary.LittleEndian.Uint32(page[offset:])
+			m.track(pageNum, fsmLoc{page: curr, idx: idx, category: page[offset+4]})
+		}
+
+		m.last = curr
+		next := binary.LittleEndian.Uint32(page[0:4])
+		c.Pager.UnpinPage(curr)
+		curr = next
+	}
+
+	c.fsm = m
+	return m, nil
+}
+
+func (c *Collection) buildFreeSpaceMap() (*freeSpaceMap, error) {
+	root, err := c.allocateFsmPage()
+	if err != nil {
+		return nil, err
+	}
+
+	m := newFreeSpaceMap(c.Pager.UsableSize())
+	m.last = root
+
+	for curr := c.RootPage; curr != 0; {
+		page, err := c.Pager.PinPage(curr)
+		if err != nil {
+			return nil, err
+		}
+
+		category := m.category(record.FreeSpace(page) + record.DeadSpace(page))
+		next := binary.LittleEndian.Uint32(page[4:8])
+		c.Pager.UnpinPage(curr)
+
+		if err := c.appendFsmEntry(m, curr, category); err != nil {
+			return nil, err
+		}
+		curr = next
+	}
+
+	c.FsmRoot = root
+	c.fsm = m
+
+	return m, c.SyncCatalog()
+}
+
+func (c *Collection) allocateFsmPage() (uint32, error) {
+	pageNum, err := c.Pager.AllocatePage(c.Header)
+	if err != nil {
+		return 0, err
+	}
+
+	buff := c.Pager.GetBuff()
+	defer storage.ReleasePageBuffer(buff)
+
+	binary.LittleEndian.PutUint32(buff[0:4], 0)
+	binary.LittleEndian.PutUint16(buff[4:6], 0)
+
+	return pageNum, c.Pager.WritePage(pageNum, storage.PageTypeFreeSpaceMap, buff)
+}
+
+func (c *Collection) appendFsmEntry(m *freeSpaceMap, pageNum uint32, category uint8) error {
+	page, err := c.Pager.ReadPage(m.last)
+	if err != nil {
+		return err
+	}
+	defer storage.ReleasePageBuffer(page)
+
+	count := binary.LittleEndian.Uint16(page[4:6])
+
+	if fsmHeaderSize+(int(count)+1)*fsmEntrySize > len(page) {
+		newPage, err := c.allocateFsmPage()
+		if err != nil {
+			return err
+		}
+
+		binary.LittleEndian.PutUint32(page[0:4], newPage)
+		if err := c.Pager.WritePage(m.last, storage.PageTypeFreeSpaceMap, page); err != nil {
+			return err
+		}
+
+		m.last = newPage
+		return c.appendFsmEntry(m, pageNum, category)
+	}
+
+	offset := fsmHeaderSize + int(count)*fsmEntrySize
+	binary.LittleEndian.PutUint32(page[offset:], pageNum)
+	page[offset+4] = category
+	binary.LittleEndian.PutUint16(page[4:6], count+1)
+
+	if err := c.Pager.WritePage(m.last, storage.PageTypeFreeSpaceMap, page); err != nil {
+		return err
+	}
+
+	m.track(pageNum, fsmLoc{page: m.last, idx: count, category: category})
+	return nil
+}
+
+// noteFreeSpace records how much room a data page has after it was written
+func (c *Collection) noteFreeSpace(pageNum uint32, page []byte) error {
+	m, err := c.freeSpaceMap()
+	if err != nil {
+		return err
+	}
+
+	category := m.category(record.FreeSpace(page) + record.DeadSpace(page))
+
+	loc, ok := m.entries[pageNum]
+	if !ok {
+		return c.appendFsmEntry(m, pageNum, category)
+	}
+	if loc.category == category {
+		return nil
+	}
+
+	fsmPage, err := c.Pager.ReadPage(loc.page)
+	if err != nil {
+		return err
+	}
+	defer storage.ReleasePageBuffer(fsmPage)
+
+	fsmPage[fsmHeaderSize+int(loc.idx)*fsmEntrySize+4] = category
+	if err := c.Pager.WritePage(loc.page, storage.PageTypeFreeSpaceMap, fsmPage); err != nil {
+		return err
+	}
+
+	loc.category = category
+	m.track(pageNum, loc)
+	return nil
+}
+
+// dropFreeSpaceMap frees the map's pages; the next write rebuilds it
+func (c *Collection) dropFreeSpaceMap() error {
+	for curr := c.FsmRoot; curr != 0; {
+		page, err := c.Pager.PinPage(curr)
+		if err != nil {
+			return err
+		}
+		next := binary.LittleEndian.Uint32(page[0:4])
+		c.Pager.UnpinPage(curr)
+
+		if err := c.Pager.FreePage(c.Header, curr); err != nil {
+			return err
+		}
+		curr = next
+	}
+
+	c.FsmRoot = 0
+	c.fsm = nil
+	return nil
+}
@@ -0,0 +1,93 @@
+package collection_test
+
+import (
+	"nanodb/internal/dbtest"
+	"path/filepath"
+	"testing"
+)
+
+func TestFreeSpaceIsReused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f.db")
+	db := dbtest.Open(t, path, nil)
+	c, _ := db.CreateCollection("c")
+
+	docIds, err := c.InsertMany(dbtest.PaddedDocs(300, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range (*docIds)[:100] {
+		if err := c.DeleteById(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.FsmRoot == 0 {
+		t.Fatal("no free-space map was written")
+	}
+
+	// the room the deletes left is found before the chain grows
+	pageCount, lastPage := db.Header.PageCount, c.LastPage
+	if _, err := c.InsertMany(dbtest.PaddedDocs(50, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if db.Header.PageCount != pageCount || c.LastPage != lastPage {
+		t.Fatalf("inserts grew the file to %d pages with room left", db.Header.PageCount)
+	}
+	db.Close()
+
+	// and the map is read back rather than rebuilt
+	db = dbtest.Open(t, path, nil)
+	defer db.Close()
+	c, _ = db.Collection("c")
+
+	if _, err := c.InsertMany(dbtest.PaddedDocs(40, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if db.Header.PageCount != pageCount {
+		t.Fatalf("reopened database grew to %d pages with room left", db.Header.PageCount)
+	}
+	if n := dbtest.Count(t, c); n != 290 {
+		t.Fatalf("%d documents, want 290", n)
+	}
+	dbtest.Check(t, db)
+}
+
+func TestFailedWriteForgetsFreeSpace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f.db")
+	db := dbtest.Open(t, path, nil)
+	c, _ := db.CreateCollection("c")
+
+	docIds, _ := c.InsertMany(dbtest.PaddedDocs(200, 200))
+	for _, id := range (*docIds)[:50] {
+		c.DeleteById(id)
+	}
+	pageCount, lastPage := db.Header.PageCount, c.LastPage
+
+	// the failed write fills the free room and appends pages to the chain
+	if err := c.InsertThenFail(dbtest.PaddedDocs(300, 200)); err == nil {
+		t.Fatal("write did not fail")
+	}
+	if c.LastPage != lastPage {
+		t.Fatalf("chain ends at page %d after the rollback, want %d", c.LastPage, lastPage)
+	}
+
+	// so the room is still there and the pages it appended are not
+	if _, err := c.InsertMany(dbtest.PaddedDocs(30, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if db.Header.PageCount != pageCount {
+		t.Fatalf("file grew to %d pages with room left", db.Header.PageCount)
+	}
+	if _, err := c.InsertMany(dbtest.PaddedDocs(300, 200)); err != nil {
+		t.Fatal(err)
+	}
+	dbtest.Check(t, db)
+	db.Close()
+
+	db = dbtest.Open(t, path, nil)
+	defer db.Close()
+	c, _ = db.Collection("c")
+	if n := dbtest.Count(t, c); n != 480 {
+		t.Fatalf("%d documents, want 480", n)
+	}
+	dbtest.Check(t, db)
+}
@@ -3,12 +3,241 @@ package collection
 import (
 	"encoding/binary"
 	"fmt"
+	"nanodb/internal/btree"
 	"nanodb/internal/record"
 	"nanodb/internal/storage"
 )
 
+// writeTx runs fn as one committed write to the pager, holding the
+// collection's write lock. The pager's write lock is always taken first,
+// as Tx.Commit does, so the two cannot deadlock. When fn or the commit
+// fails the write is rolled back, a half split or a record without its
+// index entry never reaches the log.
+func (c *Collection) writeTx(fn func() error) error {
+	if c.Pager.ReadOnly() {
+		return storage.ErrReadOnly
+	}
+	if TxOpen(c.Pager) {
+		return ErrTxOpen
+	}
+
+	c.Pager.Begin()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	saved := c.save()
+
+	err := fn()
+
+	// the index roots are in the catalog by now, and the pages the old
+	// trees used are not handed out again before the commit. A failed
+	// write keeps the old tree, its pages are not freed.
+	if err == nil {
+		err = c.BTree.Release()
+	}
+
+	return storage.Finish(c.Pager, err, func() {
+		c.restore(saved)
+	})
+}
+
+// committedState is what a write changes of a collection besides its
+// pages, kept from the start of the write to put back if it fails
+type committedState struct {
+	rootPage  uint32
+	lastPage  uint32
+	fsmRoot   uint32
+	indexRoot uint32
+	compress  bool
+	metaData  CollectionLoc
+	buckets   []Bucket
+	header    storage.DBHeader
+}
+
+func (c *Collection) save() committedState {
+	s := committedState{
+		rootPage:  c.RootPage,
+		lastPage:  c.LastPage,
+		fsmRoot:   c.FsmRoot,
+		indexRoot: c.BTree.RootPage,
+		compress:  c.Compress,
+		metaData:  c.MetaData,
+		buckets:   c.Buckets,
+	}
+	if c.Header != nil {
+		s.header = *c.Header
+	}
+	return s
+}
+
+// restore puts back the state of the last commit after a failed write,
+// before the pager's write lock is given up
+func (c *Collection) restore(s committedState) {
+	c.RootPage = s.rootPage
+	c.LastPage = s.lastPage
+	c.FsmRoot = s.fsmRoot
+	c.BTree.RootPage = s.indexRoot
+	c.BTree.Discard()
+	c.Compress = s.compress
+	c.MetaData = s.metaData
+	c.Buckets = s.buckets
+	// the cached free-space map was changed in place, it is read again
+	c.fsm = nil
+	if c.Header != nil {
+		*c.Header = s.header
+	}
+	c.reloadLastPage()
+}
+
+// reloadLastPage finds the end of the data page chain as the last commit
+// left it, from the root the catalog has. Stores without snapshots keep
+// the last page saved when the write began.
+func (c *Collection) reloadLastPage() {
+	s, ok := c.Pager.(storage.Snapshotter)
+	if !ok {
+		return
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		return
+	}
+	defer snap.Close()
+
+	if lastPage, err := lastPageOf(snap, c.RootPage); err == nil {
+		c.LastPage = lastPage
+	}
+}
+
+// view returns the collection as of the last commit, for reading without
+// waiting for writers or seeing their half-done work. Its pages come from
+// a snapshot the caller closes once done.
+func (c *Collection) view() (*Collection, *storage.Snapshot, error) {
+	s, ok := c.Pager.(storage.Snapshotter)
+	if !ok {
+		return nil, nil, fmt.Errorf("collection %s cannot be read as of a snapshot", c.Name)
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the catalog is not in itself
+	if c.catalog {
+		return &Collection{Name: c.Name, RootPage: c.RootPage, Pager: snap}, snap, nil
+	}
+
+	entry, err := c.entryAt(snap)
+	if err != nil {
+		snap.Close()
+		return nil, nil, err
+	}
+
+	return &Collection{
+		Name:     entry.Name,
+		RootPage: entry.RootPage,
+		FsmRoot:  entry.FsmRoot,
+		Compress: entry.Flags&record.CollectionCompressed != 0,
+		MetaData: CollectionLoc{PageId: entry.PageId, Slot: entry.Slot},
+		Pager:    snap,
+		BTree:    &btree.Btree{Pager: snap, RootPage: entry.IndexRoot},
+	}, snap, nil
+}
+
+// entryAt returns the catalog entry of the collection as snap sees it. The
+// catalog is only decoded again once a commit has come in since the last
+// read, until then the entry that read found still holds.
+func (c *Collection) entryAt(snap *storage.Snapshot) (*record.CollectionEntry, error) {
+	c.viewMu.Lock()
+	defer c.viewMu.Unlock()
+
+	if c.viewEntry != nil && c.viewLSN == snap.LSN() {
+		return c.viewEntry, nil
+	}
+
+	entries, err := record.GetCollectionsOfVersion(snap, c.version)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		if entries[i].Name == c.Name {
+			c.viewEntry = &entries[i]
+			c.viewLSN = snap.LSN()
+			return c.viewEntry, nil
+		}
+	}
+
+	return nil, fmt.Errorf("collection %s is not in the catalog yet", c.Name)
+}
+
+// storedRecord is what a document occupies in its slot: the encoded
+// document itself, or a stub when it had to go to overflow pages
+type storedRecord struct {
+	data       []byte
+	overflow   bool
+	compressed bool // data, or the overflow chain, is deflated
+}
+
+// spill compresses documents of a collection with compression on and
+// moves those that cannot fit on a data page into an overflow chain
+func (c *Collection) spill(data []byte) (storedRecord, error) {
+	if len(data) > record.MaxDocSize {
+		return storedRecord{}, fmt.Errorf("document of %d bytes is larger than %d", len(data), record.MaxDocSize)
+	}
+
+	var rec storedRecord
+	if c.Compress {
+		data, rec.compressed = record.Compress(data)
+	}
+
+	if len(data) <= record.MaxInlineSize(c.Pager.UsableSize()) {
+		rec.data = data
+		return rec, nil
+	}
+
+	first, err := record.WriteOverflow(c.Pager, c.Header, data)
+	if err != nil {
+		return storedRecord{}, err
+	}
+
+	rec.data = record.EncodeOverflowStub(uint32(len(data)), first)
+	rec.overflow = true
+	return rec, nil
+}
+
+func insertStored(page []byte, docId uint64, rec storedRecord) (uint16, bool, error) {
+	var flags uint32
+	if rec.overflow {
+		flags |= record.OverflowFlag
+	}
+	if rec.compressed {
+		flags |= record.CompressedFlag
+	}
+	return record.InsertRecordFlags(page, docId, rec.data, flags)
+}
+
+// freeSlot tombstones a slot and returns its overflow pages, if any, to the free list
+func (c *Collection) freeSlot(page []byte, slot uint16) error {
+	overflowRoot := record.OverflowRoot(page, slot)
+
+	record.MarkSlotDeleted(page, slot)
+
+	if overflowRoot != 0 {
+		return record.FreeOverflow(c.Pager, c.Header, overflowRoot)
+	}
+	return nil
+}
+
 func (c *Collection) insertDocInternal(docId uint64, data []byte) (error, uint32, uint16) {
-	currentPageId := c.LastPage
+	rec, err := c.spill(data)
+	if err != nil {
+		return err, 0, 0
+	}
+
+	currentPageId, err := c.pageFor(rec.data)
+	if err != nil {
+		return err, 0, 0
+	}
 
 	oldTreeRoot := c.BTree.RootPage
 
@@ -20,7 +249,7 @@ func (c *Collection) insertDocInternal(docId uint64, data []byte) (error, uint32
 		}
 
 		//try to insert the record
-		success, err := record.InsertRecord(pageData, docId, data)
+		slot, success, err := insertStored(pageData, docId, rec)
 		if err != nil {
 			storage.ReleasePageBuffer(pageData)
 			return err, 0, 0
@@ -28,9 +257,7 @@ func (c *Collection) insertDocInternal(docId uint64, data []byte) (error, uint32
 
 		if success {
 			//update index
-			slotCount := binary.LittleEndian.Uint16(pageData[0:2])
-
-			err := c.BTree.Insert(docId, currentPageId, slotCount-1)
+			err := c.BTree.Insert(docId, currentPageId, slot)
 			if err != nil {
 				storage.ReleasePageBuffer(pageData)
 				return err, 0, 0
@@ -44,9 +271,23 @@ func (c *Collection) insertDocInternal(docId uint64, data []byte) (error, uint32
 			}
 
 			// write back the page if insertion successful
-			err = c.Pager.WritePage(currentPageId, pageData)
+			err = c.Pager.WritePage(currentPageId, storage.PageTypeData, pageData)
+			if err == nil {
+				err = c.noteFreeSpace(currentPageId, pageData)
+			}
 			storage.ReleasePageBuffer(pageData)
-			return err, currentPageId, slotCount - 1
+			return err, currentPageId, slot
+		}
+
+		// the map was stale, correct it and fall back to the tail
+		if currentPageId != c.LastPage {
+			err := c.noteFreeSpace(currentPageId, pageData)
+			storage.ReleasePageBuffer(pageData)
+			if err != nil {
+				return err, 0, 0
+			}
+			currentPageId = c.LastPage
+			continue
 		}
 
 		//move to next page if insertion failed
@@ -64,10 +305,10 @@ func (c *Collection) insertDocInternal(docId uint64, data []byte) (error, uint32
 			return err, 0, 0
 		}
 
-		newPageData := storage.GetBuff()
+		newPageData := c.Pager.GetBuff()
 		storage.InitDataPage(newPageData)
 
-		if err := c.Pager.WritePage(newPageId, newPageData); err != nil {
+		if err := c.Pager.WritePage(newPageId, storage.PageTypeData, newPageData); err != nil {
 			storage.ReleasePageBuffer(newPageData)
 			storage.ReleasePageBuffer(pageData)
 			return err, 0, 0
@@ -75,7 +316,7 @@ func (c *Collection) insertDocInternal(docId uint64, data []byte) (error, uint32
 
 		//link old page to new page
 		binary.LittleEndian.PutUint32(pageData[4:8], newPageId)
-		if err := c.Pager.WritePage(currentPageId, pageData); err != nil {
+		if err := c.Pager.WritePage(currentPageId, storage.PageTypeData, pageData); err != nil {
 			storage.ReleasePageBuffer(pageData)
 			storage.ReleasePageBuffer(newPageData)
 			return err, 0, 0
@@ -89,6 +330,156 @@ func (c *Collection) insertDocInternal(docId uint64, data []byte) (error, uint32
 	}
 }
 
+func (c *Collection) insertManyInternal(docs []map[string]any, docIds []uint64) error {
+	docLen := len(docs)
+	if docLen == 0 {
+		return nil
+	}
+
+	recs := make([]storedRecord, docLen)
+	for i, doc := range docs {
+		data, err := record.EncodeDoc(doc)
+		if err != nil {
+			return err
+		}
+
+		recs[i], err = c.spill(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	oldTreeRoot := c.BTree.RootPage
+	i := 0
+
+	currentPageId, err := c.pageFor(recs[0].data)
+	if err != nil {
+		return err
+	}
+
+	for i < docLen {
+		page, err := c.Pager.ReadPage(currentPageId)
+		if err != nil {
+			return err
+		}
+
+		isDirty := false
+
+		type PendingIndexUpdate struct {
+			docId uint64
+			slot  uint16
+		}
+		var batchUpdates []PendingIndexUpdate
+
+		for i < docLen {
+			docId := docIds[i]
+
+			slot, success, err := insertStored(page, docId, recs[i])
+
+			if err != nil {
+				storage.ReleasePageBuffer(page)
+				return err
+			}
+
+			if !success {
+				break
+			}
+
+			isDirty = true
+
+			batchUpdates = append(batchUpdates, PendingIndexUpdate{docId: docId, slot: slot})
+
+			i++
+		}
+		nextPage := binary.LittleEndian.Uint32(page[4:8])
+
+		if isDirty {
+			if err := c.Pager.WritePage(currentPageId, storage.PageTypeData, page); err != nil {
+				storage.ReleasePageBuffer(page)
+				return err
+			}
+		}
+
+		if err := c.noteFreeSpace(currentPageId, page); err != nil {
+			storage.ReleasePageBuffer(page)
+			return err
+		}
+
+		for _, update := range batchUpdates {
+			if err := c.BTree.Insert(update.docId, currentPageId, update.slot); err != nil {
+				storage.ReleasePageBuffer(page)
+				return err
+			}
+		}
+
+		if c.BTree.RootPage != oldTreeRoot {
+			if err := c.SyncCatalog(); err != nil {
+				storage.ReleasePageBuffer(page)
+				return err
+			}
+			oldTreeRoot = c.BTree.RootPage
+		}
+
+		if i >= docLen {
+			storage.ReleasePageBuffer(page)
+			break
+		}
+
+		// try the page the map suggests for the next document before the tail
+		nextTry, err := c.pageFor(recs[i].data)
+		if err != nil {
+			storage.ReleasePageBuffer(page)
+			return err
+		}
+		if nextTry == currentPageId {
+			nextTry = c.LastPage
+		}
+		if nextTry != currentPageId {
+			currentPageId = nextTry
+			storage.ReleasePageBuffer(page)
+			continue
+		}
+
+		if nextPage != 0 {
+			currentPageId = nextPage
+			storage.ReleasePageBuffer(page)
+			continue
+		}
+
+		newPageId, err := c.Pager.AllocatePage(c.Header)
+
+		if err != nil {
+			storage.ReleasePageBuffer(page)
+			return err
+		}
+
+		newPageData := c.Pager.GetBuff()
+		storage.InitDataPage(newPageData)
+
+		if err := c.Pager.WritePage(newPageId, storage.PageTypeData, newPageData); err != nil {
+			storage.ReleasePageBuffer(newPageData)
+			storage.ReleasePageBuffer(page)
+			return err
+		}
+
+		storage.ReleasePageBuffer(newPageData)
+
+		binary.LittleEndian.PutUint32(page[4:8], newPageId)
+
+		if err := c.Pager.WritePage(currentPageId, storage.PageTypeData, page); err != nil {
+			storage.ReleasePageBuffer(page)
+			return err
+		}
+
+		storage.ReleasePageBuffer(page)
+
+		c.LastPage = newPageId
+		currentPageId = newPageId
+	}
+
+	return nil
+}
+
 func (c *Collection) deleteDocInternal(id uint64) error {
 	res, err := c.BTree.SearchKey(id)
 
@@ -109,9 +500,15 @@ func (c *Collection) deleteDocInternal(id uint64) error {
 
 	defer storage.ReleasePageBuffer(page)
 
-	record.MarkSlotDeleted(page, res.SlotNum)
+	if err := c.freeSlot(page, res.SlotNum); err != nil {
+		return err
+	}
+
+	if err := c.Pager.WritePage(res.PageNum, storage.PageTypeData, page); err != nil {
+		return err
+	}
 
-	if err := c.Pager.WritePage(res.PageNum, page); err != nil {
+	if err := c.noteFreeSpace(res.PageNum, page); err != nil {
 		return err
 	}
 
@@ -139,14 +536,17 @@ func (c *Collection) findByIdInternal(docId uint64) (map[string]any, error) {
 		return nil, nil
 	}
 
-	pageData, err := c.Pager.ReadPage(res.PageNum)
+	pageData, err := c.Pager.PinPage(res.PageNum)
 	if err != nil {
 		return nil, err
 	}
 
-	defer storage.ReleasePageBuffer(pageData)
+	defer c.Pager.UnpinPage(res.PageNum)
 
-	_, data, deleted := record.ReadRecord(pageData, res.SlotNum)
+	_, data, deleted, err := record.LoadRecord(c.Pager, pageData, res.SlotNum)
+	if err != nil {
+		return nil, err
+	}
 
 	if deleted {
 		return nil, nil
@@ -159,3 +559,56 @@ func (c *Collection) findByIdInternal(docId uint64) (map[string]any, error) {
 
 	return doc, nil
 }
+
+// versionAt returns the _version of the document in a slot
+func (c *Collection) versionAt(pageNum uint32, slot uint16) (uint64, error) {
+	pageData, err := c.Pager.PinPage(pageNum)
+	if err != nil {
+		return 0, err
+	}
+
+	defer c.Pager.UnpinPage(pageNum)
+
+	_, data, _, err := record.LoadRecord(c.Pager, pageData, slot)
+	if err != nil {
+		return 0, err
+	}
+
+	doc, err := record.DecodeDoc(data)
+	if err != nil {
+		return 0, err
+	}
+
+	return docVersion(doc), nil
+}
+
+// docVersion reads _version in whatever integer type msgpack or JSON
+// decoded it as, 0 when there is none
+func docVersion(doc map[string]any) uint64 {
+	switch v := doc["_version"].(type) {
+	case int8:
+		return uint64(v)
+	case int16:
+		return uint64(v)
+	case int32:
+		return uint64(v)
+	case int64:
+		return uint64(v)
+	case int:
+		return uint64(v)
+	case uint8:
+		return uint64(v)
+	case uint16:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	case uint64:
+		return v
+	case uint:
+		return uint64(v)
+	case float64:
+		return uint64(v)
+	default:
+		return 0
+	}
+}
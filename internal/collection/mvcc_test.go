@@ -0,0 +1,310 @@
+package collection_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"nanodb/internal/collection"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/storage"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// intOf reads back a number, which decodes as the smallest type it fits
+func intOf(v any) int {
+	switch n := v.(type) {
+	case int8:
+		return int(n)
+	case int16:
+		return int(n)
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case uint8:
+		return int(n)
+	case uint16:
+		return int(n)
+	case uint32:
+		return int(n)
+	case uint64:
+		return int(n)
+	case int:
+		return n
+	}
+	panic(fmt.Sprintf("not a number: %T", v))
+}
+
+// transfers between accounts keep the total, so a reader that sees part
+// of one sees the wrong total
+func TestReadersSeeWholeCommits(t *testing.T) {
+	cases := map[string]*storage.Options{
+		"file":          {CachePages: 16},
+		"mmap":          {CachePages: 16, Mmap: true},
+		"encrypted":     {CachePages: 16, Passphrase: "pw"},
+		"copy-on-write": {CachePages: 16, CopyOnWriteIndex: true},
+		"memory":        nil,
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			if opts != nil && opts.Mmap && !slices.Contains([]string{"linux", "darwin", "freebsd"}, runtime.GOOS) {
+				t.Skip("no memory-mapped files on", runtime.GOOS)
+			}
+			path := filepath.Join(t.TempDir(), "m.db")
+			if opts == nil {
+				path = storage.MemoryPath
+			}
+			db := dbtest.Open(t, path, opts)
+			defer db.Close()
+
+			accounts, _ := db.CreateCollection("accounts")
+			other, _ := db.CreateCollection("other")
+
+			const n = 40
+			var ids []uint64
+			for range n {
+				id, err := accounts.Insert(map[string]any{"balance": 100, "pad": strings.Repeat("p", 200)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, id)
+			}
+
+			stop := make(chan struct{})
+			errs := make(chan error, 8)
+			var wg sync.WaitGroup
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(1))
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					from, to := ids[r.Intn(n)], ids[r.Intn(n)]
+					if from == to {
+						continue
+					}
+					tx, err := db.Begin()
+					if err != nil {
+						errs <- err
+						return
+					}
+					txAccounts, _ := tx.Collection("accounts")
+					a, _ := txAccounts.FindById(from)
+					b, _ := txAccounts.FindById(to)
+					amount := r.Intn(50)
+					// the sizes vary so that records move between pages
+					txAccounts.UpdateById(from, map[string]any{"balance": intOf(a["balance"]) - amount, "pad": strings.Repeat("q", r.Intn(3000))})
+					txAccounts.UpdateById(to, map[string]any{"balance": intOf(b["balance"]) + amount, "pad": b["pad"]})
+
+					if r.Intn(5) == 0 {
+						err = tx.Rollback()
+					} else {
+						err = tx.Commit()
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+
+			// plain writes that split the index and grow the chains
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					_, err := other.InsertMany(dbtest.PaddedDocs(20, 100+i%10*300))
+					if errors.Is(err, collection.ErrTxOpen) {
+						// refused while a transfer is open
+						continue
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+
+			reads := make([]int, 4)
+			for r := range reads {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+
+						docs, docIds, err := accounts.Find(map[string]any{}, nil)
+						if err != nil {
+							errs <- err
+							return
+						}
+						if len(docs) != n {
+							errs <- fmt.Errorf("read %d accounts, want %d", len(docs), n)
+							return
+						}
+						sum := 0
+						for _, doc := range docs {
+							sum += intOf(doc["balance"])
+						}
+						if sum != n*100 {
+							errs <- fmt.Errorf("read a total of %d, want %d", sum, n*100)
+							return
+						}
+						slices.Sort(docIds)
+						if len(slices.Compact(docIds)) != n {
+							errs <- fmt.Errorf("read an account twice")
+							return
+						}
+						reads[r]++
+					}
+				}()
+			}
+
+			time.Sleep(500 * time.Millisecond)
+			close(stop)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+			for r, n := range reads {
+				if n == 0 {
+					t.Fatalf("reader %d read nothing while writers ran", r)
+				}
+			}
+			dbtest.Check(t, db)
+		})
+	}
+}
+
+// a snapshot keeps its pages through commits, checkpoints, page reuse and
+// truncation of the file
+func TestLongSnapshot(t *testing.T) {
+	for _, path := range []string{filepath.Join(t.TempDir(), "l.db"), storage.MemoryPath} {
+		db := dbtest.Open(t, path, &storage.Options{CachePages: 8})
+		c, _ := db.CreateCollection("c")
+		docIds, _ := c.InsertMany(dbtest.PaddedDocs(50, 500))
+
+		snap, err := db.Pager.(storage.Snapshotter).Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, _ := snap.ReadHeader()
+		pageCount := h.PageCount
+		images := make(map[uint32][]byte)
+		for pageNum := range pageCount {
+			page, err := snap.ReadPage(pageNum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			images[pageNum] = page
+		}
+
+		for round := range 20 {
+			for _, id := range *docIds {
+				if err := c.UpdateById(id, map[string]any{"round": round, "pad": strings.Repeat("y", round*50)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if round%5 == 0 {
+				db.Pager.Checkpoint()
+			}
+		}
+		for _, id := range *docIds {
+			c.DeleteById(id)
+		}
+		c.Vacuum()
+		if _, err := db.Truncate(); err != nil {
+			t.Fatal(err)
+		}
+
+		if h, _ := snap.ReadHeader(); h.PageCount != pageCount {
+			t.Fatalf("snapshot header counts %d pages, had %d", h.PageCount, pageCount)
+		}
+		for pageNum, image := range images {
+			page, err := snap.ReadPage(pageNum)
+			if err != nil {
+				t.Fatalf("page %d: %v", pageNum, err)
+			}
+			if !slices.Equal(page, image) {
+				t.Fatalf("page %d changed under the snapshot", pageNum)
+			}
+			storage.ReleasePageBuffer(page)
+			storage.ReleasePageBuffer(image)
+		}
+		snap.Close()
+
+		if n := dbtest.Count(t, c); n != 0 {
+			t.Fatalf("%d documents left", n)
+		}
+		dbtest.Check(t, db)
+		db.Close()
+	}
+}
+
+// reads decode the catalog once per commit, not once per read
+func TestReadsReuseTheCatalogEntry(t *testing.T) {
+	for _, path := range []string{filepath.Join(t.TempDir(), "e.db"), storage.MemoryPath} {
+		db := dbtest.Open(t, path, &storage.Options{CopyOnWriteIndex: true})
+		c, _ := db.CreateCollection("c")
+		other, _ := db.CreateCollection("other")
+		id, _ := c.Insert(map[string]any{"n": 1})
+
+		if _, err := c.FindById(id); err != nil {
+			t.Fatal(err)
+		}
+		entry, lsn := c.CachedEntry()
+		if entry == nil {
+			t.Fatal("no catalog entry kept after a read")
+		}
+		for range 3 {
+			if _, _, err := c.Find(map[string]any{}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if again, _ := c.CachedEntry(); again != entry {
+			t.Fatal("catalog decoded again without a commit in between")
+		}
+
+		// any commit makes the next read look again, and it finds the
+		// root the copy-on-write index moved to
+		other.Insert(map[string]any{"n": 1})
+		if _, err := c.FindById(id); err != nil {
+			t.Fatal(err)
+		}
+		if again, newLSN := c.CachedEntry(); again == entry || newLSN == lsn || *again != *entry {
+			t.Fatalf("after a commit elsewhere the entry is %+v at %x, was %+v at %x", again, newLSN, entry, lsn)
+		}
+
+		second, _ := c.Insert(map[string]any{"n": 2})
+		if doc, err := c.FindById(second); err != nil || intOf(doc["n"]) != 2 {
+			t.Fatalf("read %v, %v after an insert", doc, err)
+		}
+		if again, _ := c.CachedEntry(); again.IndexRoot == entry.IndexRoot {
+			t.Fatal("read the index root from before the insert")
+		}
+		dbtest.Check(t, db)
+		db.Close()
+	}
+}
@@ -0,0 +1,255 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"nanodb/internal/btree"
+	"nanodb/internal/record"
+	"nanodb/internal/storage"
+	"slices"
+	"sync"
+)
+
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// ErrTxOpen is returned by writes made outside the transaction that is
+// open on the database. They would wait for it to end, and never return
+// when made by the goroutine that holds it.
+var ErrTxOpen = errors.New("a transaction is open, write through it")
+
+// openTxs holds the stores that have a transaction open on them
+var openTxs sync.Map
+
+// TxOpen reports whether a transaction is open on the database behind pager
+func TxOpen(pager storage.PageStore) bool {
+	_, ok := openTxs.Load(pager)
+	return ok
+}
+
+// Tx is a write transaction across the collections of one database. It
+// holds the pager's write lock from Begin to Commit or Rollback, and other
+// writes fail with ErrTxOpen meanwhile, but reads go on: the transaction
+// works on its own copies of the collections it uses, whose pages go to
+// an overlay until Commit hands them all to the pager as one commit. A
+// crash before that commit is on disk leaves none of the changes behind.
+//
+// Once an operation fails the transaction can only be rolled back, Commit
+// does so and returns the error. A Tx must not be used from two goroutines
+// at once.
+type Tx struct {
+	pager  storage.PageStore
+	pages  *storage.Overlay
+	base   *storage.DBHeader
+	header storage.DBHeader // the transaction's copy of base
+	copies map[*Collection]*Collection
+	err    error // of the first operation that failed
+	done   bool
+}
+
+// TxCollection is a collection as a transaction sees it, with the
+// transaction's own changes
+type TxCollection struct {
+	tx *Tx
+	c  *Collection
+}
+
+// Begin starts a transaction on the database behind pager and header
+func Begin(pager storage.PageStore, header *storage.DBHeader) (*Tx, error) {
+	if pager.ReadOnly() {
+		return nil, storage.ErrReadOnly
+	}
+	if TxOpen(pager) {
+		return nil, ErrTxOpen
+	}
+
+	pager.Begin()
+	openTxs.Store(pager, struct{}{})
+
+	return &Tx{
+		pager:  pager,
+		pages:  storage.NewOverlay(pager),
+		base:   header,
+		header: *header,
+		copies: make(map[*Collection]*Collection),
+	}, nil
+}
+
+// Use returns c as seen from inside the transaction
+func (tx *Tx) Use(c *Collection) *TxCollection {
+	cp, ok := tx.copies[c]
+	if !ok {
+		c.mu.RLock()
+		cp = &Collection{
+			Name:     c.Name,
+			RootPage: c.RootPage,
+			LastPage: c.LastPage,
+			FsmRoot:  c.FsmRoot,
+			Compress: c.Compress,
+			MetaData: c.MetaData,
+			Buckets:  slices.Clone(c.Buckets),
+			Pager:    tx.pages,
+			Header:   &tx.header,
+			BTree: &btree.Btree{
+				Pager:       tx.pages,
+				Header:      &tx.header,
+				RootPage:    c.BTree.RootPage,
+				CopyOnWrite: c.BTree.CopyOnWrite,
+			},
+			version: c.version,
+		}
+		c.mu.RUnlock()
+
+		tx.copies[c] = cp
+	}
+
+	return &TxCollection{tx: tx, c: cp}
+}
+
+func (tx *Tx) check() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.err != nil {
+		return fmt.Errorf("transaction failed earlier: %w", tx.err)
+	}
+	return nil
+}
+
+// fail records the first error of an operation that may have written pages
+func (tx *Tx) fail(err error) error {
+	if err != nil && tx.err == nil {
+		tx.err = err
+	}
+	return err
+}
+
+// Commit writes the transaction's pages to the pager as a single commit
+// and makes its changes visible. If the commit fails the transaction is
+// rolled back and the collections are left as they were.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	if tx.err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		return fmt.Errorf("transaction rolled back: %w", tx.err)
+	}
+	tx.done = true
+
+	// still inside the write, no other transaction can be open yet
+	openTxs.Delete(tx.pager)
+
+	// the pages the old index trees used go back in the same commit
+	for _, cp := range tx.copies {
+		if err := cp.BTree.Release(); err != nil {
+			tx.pages.Rollback()
+			return storage.Finish(tx.pager, err, nil)
+		}
+	}
+
+	// nobody else changes the collections while they take over the state
+	for c := range tx.copies {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+	}
+
+	if err := tx.pages.Apply(); err != nil {
+		tx.pages.Rollback()
+		return storage.Finish(tx.pager, err, nil)
+	}
+
+	// the state is taken over inside the write, where the next writer
+	// cannot see it half done, and given back if the commit fails
+	saved := make(map[*Collection]committedState, len(tx.copies))
+	for c, cp := range tx.copies {
+		saved[c] = c.save()
+		c.adopt(cp)
+	}
+	header := *tx.base
+	*tx.base = tx.header
+
+	return storage.Finish(tx.pager, nil, func() {
+		for c, s := range saved {
+			c.restore(s)
+		}
+		*tx.base = header
+	})
+}
+
+// Rollback throws the transaction's changes away
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	openTxs.Delete(tx.pager)
+
+	tx.pages.Rollback()
+	return tx.pager.Rollback()
+}
+
+// adopt takes over the state of a transaction's copy once its pages are in
+func (c *Collection) adopt(cp *Collection) {
+	c.RootPage = cp.RootPage
+	c.LastPage = cp.LastPage
+	c.FsmRoot = cp.FsmRoot
+	c.Compress = cp.Compress
+	c.MetaData = cp.MetaData
+	c.Buckets = cp.Buckets
+	c.BTree.RootPage = cp.BTree.RootPage
+	c.fsm = cp.fsm
+}
+
+func (tc *TxCollection) Insert(doc map[string]any) (uint64, error) {
+	if err := tc.tx.check(); err != nil {
+		return 0, err
+	}
+
+	docId := GenerateRandomId(6)
+	doc["_id"] = docId
+	doc["_version"] = uint64(1)
+
+	data, err := record.EncodeDoc(doc)
+	if err != nil {
+		return 0, err
+	}
+
+	embedding := takeEmbedding(doc)
+
+	err, _, _ = tc.c.insertDocInternal(docId, data)
+	if err == nil && embedding != nil {
+		err = tc.c.insertVectorInternal(docId, embedding)
+	}
+	if err != nil {
+		return 0, tc.tx.fail(err)
+	}
+
+	return docId, nil
+}
+
+func (tc *TxCollection) FindById(docId uint64) (map[string]any, error) {
+	if err := tc.tx.check(); err != nil {
+		return nil, err
+	}
+
+	return tc.c.findByIdInternal(docId)
+}
+
+func (tc *TxCollection) UpdateById(id uint64, newData map[string]any) error {
+	if err := tc.tx.check(); err != nil {
+		return err
+	}
+
+	return tc.tx.fail(tc.c.updateByIdInternal(id, newData))
+}
+
+func (tc *TxCollection) DeleteById(id uint64) error {
+	if err := tc.tx.check(); err != nil {
+		return err
+	}
+
+	return tc.tx.fail(tc.c.deleteDocInternal(id))
+}
@@ -0,0 +1,263 @@
+package collection_test
+
+import (
+	"errors"
+	"fmt"
+	"nanodb/internal/collection"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/storage"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTxRollback(t *testing.T) {
+	for _, path := range []string{filepath.Join(t.TempDir(), "t.db"), storage.MemoryPath} {
+		db := dbtest.Open(t, path, &storage.Options{CachePages: 8})
+		orders, _ := db.CreateCollection("orders")
+		items, _ := db.CreateCollection("items")
+		keep, _ := orders.Insert(map[string]any{"n": "keep"})
+		pageCount := db.Header.PageCount
+
+		// big enough for its pages to be evicted from the cache mid-way
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		txOrders, _ := tx.Collection("orders")
+		txItems, _ := tx.Collection("items")
+		for i := range 300 {
+			if _, err := txItems.Insert(map[string]any{"i": i, "pad": strings.Repeat("y", 300)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		big, _ := txOrders.Insert(map[string]any{"big": strings.Repeat("b", 30000)})
+		if err := txOrders.DeleteById(keep); err != nil {
+			t.Fatal(err)
+		}
+
+		if doc, _ := txOrders.FindById(big); doc == nil {
+			t.Fatal("transaction does not see its own insert")
+		}
+		if doc, _ := orders.FindById(keep); doc == nil {
+			t.Fatal("delete visible before the commit")
+		}
+		if n := dbtest.Count(t, items); n != 0 {
+			t.Fatalf("%d inserts visible before the commit", n)
+		}
+
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); !errors.Is(err, collection.ErrTxDone) {
+			t.Fatalf("commit after the rollback: %v", err)
+		}
+
+		if db.Header.PageCount != pageCount {
+			t.Fatalf("header counts %d pages after the rollback, want %d", db.Header.PageCount, pageCount)
+		}
+		if doc, _ := orders.FindById(keep); doc == nil {
+			t.Fatal("rollback lost a document")
+		}
+		if n := dbtest.Count(t, items); n != 0 {
+			t.Fatalf("%d rolled back inserts visible", n)
+		}
+		dbtest.Check(t, db)
+
+		if _, err := items.Insert(map[string]any{"after": true}); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+}
+
+func TestTxCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	db := dbtest.Open(t, path, &storage.Options{CachePages: 8})
+	orders, _ := db.CreateCollection("orders")
+	items, _ := db.CreateCollection("items")
+	keep, _ := orders.Insert(map[string]any{"n": "keep"})
+
+	// move a document from one collection to the other
+	tx, _ := db.Begin()
+	txOrders, _ := tx.Collection("orders")
+	txItems, _ := tx.Collection("items")
+	doc, _ := txOrders.FindById(keep)
+	delete(doc, "_id")
+	moved, err := txItems.Insert(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txOrders.DeleteById(keep)
+	for i := range 300 {
+		txItems.Insert(map[string]any{"i": i, "pad": strings.Repeat("z", 300)})
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc, _ := orders.FindById(keep); doc != nil {
+		t.Fatal("document still in its old collection")
+	}
+	if doc, _ := items.FindById(moved); doc == nil || doc["n"] != "keep" {
+		t.Fatalf("document not moved: %v", doc)
+	}
+	dbtest.Check(t, db)
+	db.Close()
+
+	db = dbtest.Open(t, path, nil)
+	defer db.Close()
+	items, _ = db.Collection("items")
+	if n := dbtest.Count(t, items); n != 301 {
+		t.Fatalf("%d documents after reopening, want 301", n)
+	}
+	dbtest.Check(t, db)
+}
+
+func TestTxFailedOperation(t *testing.T) {
+	db := dbtest.Open(t, storage.MemoryPath, nil)
+	defer db.Close()
+	items, _ := db.CreateCollection("items")
+
+	tx, _ := db.Begin()
+	txItems, _ := tx.Collection("items")
+	txItems.Insert(map[string]any{"x": 1})
+	if err := txItems.DeleteById(12345); err == nil {
+		t.Fatal("deleted a document that does not exist")
+	}
+
+	// nothing more goes in once an operation failed
+	if _, err := txItems.Insert(map[string]any{"x": 2}); err == nil {
+		t.Fatal("insert after a failed operation")
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatal("committed after a failed operation")
+	}
+	if n := dbtest.Count(t, items); n != 0 {
+		t.Fatalf("%d documents from a failed transaction", n)
+	}
+	dbtest.Check(t, db)
+}
+
+// failingCommit is a store whose commits fail before the commit marker,
+// leaving the write open as a failed Commit does
+type failingCommit struct {
+	storage.PageStore
+}
+
+func (f failingCommit) Commit() error {
+	return errors.New("log full")
+}
+
+func TestTxFailedCommitLeavesCollections(t *testing.T) {
+	db := dbtest.Open(t, storage.MemoryPath, nil)
+	defer db.Close()
+	c, _ := db.CreateCollection("c")
+	c.InsertMany(dbtest.PaddedDocs(20, 100))
+
+	header := *db.Header
+	rootPage, lastPage, indexRoot := c.RootPage, c.LastPage, c.BTree.RootPage
+
+	tx, err := collection.Begin(failingCommit{db.Pager}, db.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txc := tx.Use(c)
+	for _, doc := range dbtest.PaddedDocs(400, 200) {
+		if _, err := txc.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatal("commit did not fail")
+	}
+
+	if *db.Header != header {
+		t.Fatalf("header %+v after the failed commit, want %+v", *db.Header, header)
+	}
+	if c.RootPage != rootPage || c.LastPage != lastPage || c.BTree.RootPage != indexRoot {
+		t.Fatal("collection took over the state of a failed commit")
+	}
+	if n := dbtest.Count(t, c); n != 20 {
+		t.Fatalf("%d documents after the failed commit, want 20", n)
+	}
+	dbtest.Check(t, db)
+
+	if _, err := c.InsertMany(dbtest.PaddedDocs(50, 100)); err != nil {
+		t.Fatal(err)
+	}
+	dbtest.Check(t, db)
+}
+
+func TestTxRefusesOtherWriters(t *testing.T) {
+	dir := t.TempDir()
+	db := dbtest.Open(t, filepath.Join(dir, "t.db"), nil)
+	defer db.Close()
+	c, _ := db.CreateCollection("c")
+	first, _ := c.Insert(map[string]any{"n": 1})
+
+	tx, _ := db.Begin()
+	txc, _ := tx.Collection("c")
+	txc.UpdateById(first, map[string]any{"n": 2})
+
+	// made by the goroutine that holds the transaction, these used to wait
+	// for it forever
+	writes := map[string]func() error{
+		"insert": func() error {
+			_, err := c.Insert(map[string]any{"n": 3})
+			return err
+		},
+		"update": func() error { return c.UpdateById(first, map[string]any{"n": 3}) },
+		"create": func() error {
+			_, err := db.CreateCollection("d")
+			return err
+		},
+		"begin": func() error {
+			_, err := db.Begin()
+			return err
+		},
+		"truncate": func() error {
+			_, err := db.Truncate()
+			return err
+		},
+		"vacuum": func() error {
+			_, err := db.Vacuum()
+			return err
+		},
+		"vacuum into": func() error { return db.VacuumInto(filepath.Join(dir, "copy.db")) },
+		"backup":      func() error { return db.Backup(filepath.Join(dir, "backup.db")) },
+		"close":       db.Close,
+	}
+	for name, write := range writes {
+		done := make(chan error, 1)
+		go func() { done <- write() }()
+		select {
+		case err := <-done:
+			if !errors.Is(err, collection.ErrTxOpen) {
+				t.Errorf("%s: %v, want ErrTxOpen", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s waits for the transaction", name)
+		}
+	}
+
+	// readers go on meanwhile
+	if doc, err := c.FindById(first); err != nil || fmt.Sprint(doc["n"]) != "1" {
+		t.Fatalf("reader saw %v, %v", doc, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Insert(map[string]any{"n": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if n := dbtest.Count(t, c); n != 2 {
+		t.Fatalf("%d documents, want 2", n)
+	}
+	if _, ok := db.Collection("d"); ok {
+		t.Fatal("collection created during the transaction")
+	}
+	dbtest.Check(t, db)
+}
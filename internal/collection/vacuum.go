@@ -0,0 +1,349 @@
+package collection
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"nanodb/internal/btree"
+	"nanodb/internal/record"
+	"nanodb/internal/storage"
+	"nanodb/internal/vector"
+	"slices"
+)
+
+type indexEntry struct {
+	docId uint64
+	page  uint32
+	slot  uint16
+}
+
+// Vacuum rewrites the collection's page chain densely, returns the pages it
+// no longer needs to the free list and rebuilds the _id index over the new
+// record locations. It reports how many bytes were given back.
+func (c *Collection) Vacuum() (int64, error) {
+	var reclaimed int64
+	err := c.writeTx(func() error {
+		var err error
+		reclaimed, err = c.vacuumInternal()
+		return err
+	})
+
+	return reclaimed, err
+}
+
+func (c *Collection) vacuumInternal() (int64, error) {
+	var chain []uint32 // pages read so far, in chain order
+	var entries []indexEntry
+
+	out := c.Pager.GetBuff()
+	defer storage.ReleasePageBuffer(out)
+	storage.InitDataPage(out)
+	outIdx := 0
+
+	// packing records in chain order never needs more pages than it has
+	// read, so the page being overwritten has always been read already
+	flushOut := func(next uint32) error {
+		binary.LittleEndian.PutUint32(out[4:8], next)
+		if err := c.Pager.WritePage(chain[outIdx], storage.PageTypeData, out); err != nil {
+			return err
+		}
+		storage.InitDataPage(out)
+		outIdx++
+		return nil
+	}
+
+	curr := c.RootPage
+	for curr != 0 {
+		page, err := c.Pager.ReadPage(curr)
+		if err != nil {
+			return 0, err
+		}
+		chain = append(chain, curr)
+
+		slotCount := binary.LittleEndian.Uint16(page[0:2])
+		for slot := range slotCount {
+			docId, data, deleted := record.ReadRecord(page, slot)
+			if deleted {
+				continue
+			}
+
+			// records move as they are, compressed or not; overflow chains stay put
+			rec := storedRecord{
+				data:       data,
+				overflow:   record.OverflowRoot(page, slot) != 0,
+				compressed: record.IsCompressed(page, slot),
+			}
+
+			newSlot, ok, err := insertStored(out, docId, rec)
+			if err == nil && !ok && outIdx+1 < len(chain) {
+				if err = flushOut(chain[outIdx+1]); err == nil {
+					newSlot, ok, err = insertStored(out, docId, rec)
+				}
+			}
+			if err == nil && !ok {
+				err = fmt.Errorf("vacuum of %s: record %d does not fit", c.Name, docId)
+			}
+			if err != nil {
+				storage.ReleasePageBuffer(page)
+				return 0, err
+			}
+
+			entries = append(entries, indexEntry{docId: docId, page: chain[outIdx], slot: newSlot})
+		}
+
+		curr = binary.LittleEndian.Uint32(page[4:8])
+		storage.ReleasePageBuffer(page)
+	}
+
+	if err := flushOut(0); err != nil {
+		return 0, err
+	}
+	c.LastPage = chain[outIdx-1]
+
+	for _, pageNum := range chain[outIdx:] {
+		if err := c.Pager.FreePage(c.Header, pageNum); err != nil {
+			return 0, err
+		}
+	}
+
+	oldIndexPages, newIndexPages, err := c.rebuildIndex(entries)
+	if err != nil {
+		return 0, err
+	}
+
+	// the map still lists the freed pages, build a fresh one
+	if err := c.dropFreeSpaceMap(); err != nil {
+		return 0, err
+	}
+	if _, err := c.freeSpaceMap(); err != nil {
+		return 0, err
+	}
+
+	freed := len(chain) - outIdx + oldIndexPages - newIndexPages
+	if freed < 0 {
+		// a rebuilt index can come out a page or two larger than the old one
+		freed = 0
+	}
+	return int64(freed) * int64(c.Pager.PageSize()), nil
+}
+
+// rebuildIndex builds a new _id index from entries, records it in the
+// catalog and only then frees every page of the old one. It returns the
+// page counts of the old and the new tree.
+func (c *Collection) rebuildIndex(entries []indexEntry) (int, int, error) {
+	oldPages, err := c.BTree.Pages()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rootPage, err := c.Pager.AllocatePage(c.Header)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	buff := c.Pager.GetBuff()
+	root := btree.NewNode(buff)
+	root.SetHeader(btree.NodeTypeLeaf, true)
+	root.SetNumCells(0)
+	root.SetRightChild(0)
+	err = c.Pager.WritePage(rootPage, storage.PageTypeIndex, buff)
+	storage.ReleasePageBuffer(buff)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	slices.SortFunc(entries, func(a, b indexEntry) int {
+		return cmp.Compare(a.docId, b.docId)
+	})
+
+	// nothing sees the new tree before it is in the catalog, so it is
+	// built in place even in copy-on-write mode
+	tree := &btree.Btree{Pager: c.Pager, Header: c.Header, RootPage: rootPage}
+	for _, e := range entries {
+		if err := tree.Insert(e.docId, e.page, e.slot); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	c.BTree.RootPage = tree.RootPage
+	if err := c.SyncCatalog(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, pageNum := range oldPages {
+		if err := c.Pager.FreePage(c.Header, pageNum); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	newPages, err := c.BTree.Pages()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(oldPages), len(newPages), nil
+}
+
+// CopyTo streams every live document and vector bucket of c into dst, an
+// empty collection that normally lives in another database file with the
+// same page size. Documents keep their ids.
+func (c *Collection) CopyTo(dst *Collection) error {
+	v, snap, err := c.view()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	if err := v.loadBuckets(); err != nil {
+		return err
+	}
+
+	return v.copyToInternal(dst)
+}
+
+func (c *Collection) copyToInternal(dst *Collection) error {
+	// the bucket config names pages of this file, it is rewritten below
+	hasBuckets := len(c.Buckets) > 0
+
+	currentPageId := c.RootPage
+	for currentPageId != 0 {
+		pageData, err := c.Pager.PinPage(currentPageId)
+		if err != nil {
+			return err
+		}
+
+		err = dst.writeTx(func() error {
+			slotCount := binary.LittleEndian.Uint16(pageData[0:2])
+			for slot := range slotCount {
+				docId, data, deleted, err := record.LoadRecord(c.Pager, pageData, slot)
+				if err != nil {
+					return err
+				}
+				if deleted || (hasBuckets && docId == 1) {
+					continue
+				}
+
+				if err, _, _ := dst.insertDocInternal(docId, data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		nextPageId := binary.LittleEndian.Uint32(pageData[4:8])
+		c.Pager.UnpinPage(currentPageId)
+		if err != nil {
+			return err
+		}
+		currentPageId = nextPageId
+	}
+
+	if !hasBuckets {
+		return nil
+	}
+
+	// pages can only be copied as they are between equal page bodies
+	samePages := c.Pager.UsableSize() == dst.Pager.UsableSize()
+
+	return dst.writeTx(func() error {
+		for _, b := range c.Buckets {
+			var root uint32
+			var err error
+			if samePages {
+				root, err = c.copyVectorChain(dst, b.RootPage)
+			} else {
+				root, err = c.copyVectorItems(dst, b)
+			}
+			if err != nil {
+				return err
+			}
+			dst.Buckets = append(dst.Buckets, Bucket{Centroid: b.Centroid, RootPage: root})
+		}
+		return dst.saveBuckets()
+	})
+}
+
+// copyVectorChain copies a bucket's vector pages into dst as they are and
+// returns the first page of the copy
+func (c *Collection) copyVectorChain(dst *Collection, rootPage uint32) (uint32, error) {
+	var first, prev uint32
+
+	buff := dst.Pager.GetBuff()
+	defer storage.ReleasePageBuffer(buff)
+
+	for curr := rootPage; curr != 0; {
+		pageNum, err := dst.Pager.AllocatePage(dst.Header)
+		if err != nil {
+			return 0, err
+		}
+
+		if prev == 0 {
+			first = pageNum
+		} else {
+			binary.LittleEndian.PutUint32(buff[0:4], pageNum)
+			if err := dst.Pager.WritePage(prev, storage.PageTypeVector, buff); err != nil {
+				return 0, err
+			}
+		}
+
+		page, err := c.Pager.PinPage(curr)
+		if err != nil {
+			return 0, err
+		}
+		copy(buff, page)
+		next := binary.LittleEndian.Uint32(page[0:4])
+		c.Pager.UnpinPage(curr)
+
+		prev = pageNum
+		curr = next
+	}
+
+	binary.LittleEndian.PutUint32(buff[0:4], 0)
+	return first, dst.Pager.WritePage(prev, storage.PageTypeVector, buff)
+}
+
+// copyVectorItems copies a bucket's vectors one by one into a new chain
+// in dst, for a dst whose pages hold a different number of them
+func (c *Collection) copyVectorItems(dst *Collection, b Bucket) (uint32, error) {
+	first, err := dst.Pager.AllocatePage(dst.Header)
+	if err != nil {
+		return 0, err
+	}
+
+	buff := dst.Pager.GetBuff()
+	vector.InitVectorPage(buff)
+	err = dst.Pager.WritePage(first, storage.PageTypeVector, buff)
+	storage.ReleasePageBuffer(buff)
+	if err != nil {
+		return 0, err
+	}
+
+	itemSize := 8 + 4*len(b.Centroid)
+
+	for curr := b.RootPage; curr != 0; {
+		page, err := c.Pager.PinPage(curr)
+		if err != nil {
+			return 0, err
+		}
+
+		count := int(binary.LittleEndian.Uint16(page[4:6]))
+		for i := range count {
+			offset := HEADER_SIZE + i*itemSize
+			docId := binary.LittleEndian.Uint64(page[offset:])
+			v := vector.VectorFromBytes(page[offset+8 : offset+itemSize])
+
+			if err = dst.writeVectorToPageChain(first, docId, v); err != nil {
+				break
+			}
+		}
+
+		next := binary.LittleEndian.Uint32(page[0:4])
+		c.Pager.UnpinPage(curr)
+		if err != nil {
+			return 0, err
+		}
+		curr = next
+	}
+
+	return first, nil
+}
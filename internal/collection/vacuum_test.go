@@ -0,0 +1,93 @@
+package collection_test
+
+import (
+	"nanodb/internal/dbtest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVacuumReclaimsPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.db")
+	db := dbtest.Open(t, path, nil)
+	c, _ := db.CreateCollection("c")
+
+	docIds, err := c.InsertMany(dbtest.PaddedDocs(400, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bigId, err := c.Insert(map[string]any{"big": strings.Repeat("o", 20000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := map[uint64]bool{bigId: true}
+	for i, id := range *docIds {
+		if i%10 == 0 {
+			kept[id] = true
+			continue
+		}
+		if err := c.DeleteById(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reclaimed, err := c.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed <= 0 {
+		t.Fatalf("vacuum reclaimed %d bytes", reclaimed)
+	}
+	if db.Header.FreeList == 0 {
+		t.Fatal("no pages went to the free list")
+	}
+	dbtest.Check(t, db)
+
+	// the free pages are used before the file grows
+	pageCount := db.Header.PageCount
+	if _, err := c.InsertMany(dbtest.PaddedDocs(100, 300)); err != nil {
+		t.Fatal(err)
+	}
+	if db.Header.PageCount != pageCount {
+		t.Fatalf("file grew from %d to %d pages with free pages left", pageCount, db.Header.PageCount)
+	}
+	db.Close()
+
+	db = dbtest.Open(t, path, nil)
+	defer db.Close()
+	c, _ = db.Collection("c")
+
+	for id := range kept {
+		doc, err := c.FindById(id)
+		if err != nil || doc == nil {
+			t.Fatalf("document %d lost by vacuum: %v", id, err)
+		}
+	}
+	if n := dbtest.Count(t, c); n != len(kept)+100 {
+		t.Fatalf("%d documents, want %d", n, len(kept)+100)
+	}
+	dbtest.Check(t, db)
+}
+
+func TestVacuumEmptyCollection(t *testing.T) {
+	db := dbtest.Open(t, filepath.Join(t.TempDir(), "v.db"), nil)
+	defer db.Close()
+	c, _ := db.CreateCollection("c")
+
+	docIds, _ := c.InsertMany(dbtest.PaddedDocs(50, 500))
+	for _, id := range *docIds {
+		c.DeleteById(id)
+	}
+
+	if _, err := c.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	if n := dbtest.Count(t, c); n != 0 {
+		t.Fatalf("%d documents left", n)
+	}
+	if _, err := c.Insert(map[string]any{"after": true}); err != nil {
+		t.Fatal(err)
+	}
+	dbtest.Check(t, db)
+}
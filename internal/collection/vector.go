@@ -37,9 +37,12 @@ func (h *ResultHeap) Pop() any {
 }
 
 func (c *Collection) InsertVector(docId uint64, v []float32) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	return c.writeTx(func() error {
+		return c.insertVectorInternal(docId, v)
+	})
+}
 
+func (c *Collection) insertVectorInternal(docId uint64, v []float32) error {
 	var targetPageNum uint32
 
 	bucketLen := len(c.Buckets)
@@ -49,7 +52,7 @@ func (c *Collection) InsertVector(docId uint64, v []float32) error {
 		if err != nil {
 			return err
 		}
-		buff := storage.GetBuff()
+		buff := c.Pager.GetBuff()
 
 		vector.InitVectorPage(buff)
 
@@ -59,7 +62,7 @@ func (c *Collection) InsertVector(docId uint64, v []float32) error {
 		}
 		c.Buckets = append(c.Buckets, newBucket)
 
-		err = c.Pager.WritePage(newPageId, buff)
+		err = c.Pager.WritePage(newPageId, storage.PageTypeVector, buff)
 
 		storage.ReleasePageBuffer(buff)
 		targetPageNum = newPageId
@@ -112,7 +115,7 @@ func (c *Collection) writeVectorToPageChain(rootPage uint32, docID uint64, v []f
 
 		offset := HEADER_SIZE + (itemSize * int(count))
 
-		if offset+itemSize > storage.PageSize {
+		if offset+itemSize > c.Pager.UsableSize() {
 			//cant fit in this page
 			nextPage := binary.LittleEndian.Uint32(page[0:4])
 
@@ -136,7 +139,7 @@ func (c *Collection) writeVectorToPageChain(rootPage uint32, docID uint64, v []f
 
 			binary.LittleEndian.PutUint32(page[0:4], newPageId)
 
-			err = c.Pager.WritePage(currPage, page)
+			err = c.Pager.WritePage(currPage, storage.PageTypeVector, page)
 
 			storage.ReleasePageBuffer(page)
 
@@ -157,7 +160,7 @@ func (c *Collection) writeVectorToPageChain(rootPage uint32, docID uint64, v []f
 
 		binary.LittleEndian.PutUint16(page[4:6], count+1)
 
-		err = c.Pager.WritePage(currPage, page)
+		err = c.Pager.WritePage(currPage, storage.PageTypeVector, page)
 
 		storage.ReleasePageBuffer(page)
 
@@ -200,9 +203,20 @@ func (c *Collection) saveBuckets() error {
 }
 
 func (c *Collection) SearchVector(query []float32, topK int) ([]uint64, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	v, snap, err := c.view()
+	if err != nil {
+		return []uint64{}, err
+	}
+	defer snap.Close()
 
+	if err := v.loadBuckets(); err != nil {
+		return []uint64{}, err
+	}
+
+	return v.searchVectorInternal(query, topK)
+}
+
+func (c *Collection) searchVectorInternal(query []float32, topK int) ([]uint64, error) {
 	if len(c.Buckets) == 0 {
 		return []uint64{}, nil
 	}
@@ -228,7 +242,7 @@ func (c *Collection) SearchVector(query []float32, topK int) ([]uint64, error) {
 	itemSize := 8 + vecSize
 
 	for currPageId != 0 {
-		pageData, err := c.Pager.ReadPage(currPageId)
+		pageData, err := c.Pager.PinPage(currPageId)
 
 		if err != nil {
 			return []uint64{}, err
@@ -260,8 +274,9 @@ func (c *Collection) SearchVector(query []float32, topK int) ([]uint64, error) {
 			}
 		}
 
-		currPageId = binary.LittleEndian.Uint32(pageData[0:4])
-		storage.ReleasePageBuffer(pageData)
+		nextPageId := binary.LittleEndian.Uint32(pageData[0:4])
+		c.Pager.UnpinPage(currPageId)
+		currPageId = nextPageId
 	}
 
 	finalIds := make([]uint64, results.Len())
@@ -277,6 +292,11 @@ func (c *Collection) LoadVectorIndex() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	return c.loadBuckets()
+}
+
+// loadBuckets reads the bucket config the vector index keeps in document 1
+func (c *Collection) loadBuckets() error {
 	doc, err := c.findByIdInternal(1)
 	if err != nil {
 		return err
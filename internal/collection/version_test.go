@@ -0,0 +1,140 @@
+package collection_test
+
+import (
+	"errors"
+	"nanodb/internal/collection"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/storage"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func version(t *testing.T, c *collection.Collection, id uint64) int {
+	t.Helper()
+	doc, err := c.FindById(id)
+	if err != nil || doc == nil {
+		t.Fatalf("document %d not found: %v", id, err)
+	}
+	return intOf(doc["_version"])
+}
+
+func TestVersionCounts(t *testing.T) {
+	db := dbtest.Open(t, filepath.Join(t.TempDir(), "v.db"), nil)
+	defer db.Close()
+	c, _ := db.CreateCollection("c")
+
+	id, _ := c.Insert(map[string]any{"n": 0})
+	docIds, _ := c.InsertMany([]map[string]any{{"n": 1}})
+	if v := version(t, c, id); v != 1 {
+		t.Fatalf("inserted document at version %d", v)
+	}
+	if v := version(t, c, (*docIds)[0]); v != 1 {
+		t.Fatalf("document inserted in a batch at version %d", v)
+	}
+
+	// the version the caller passes in is not stored
+	if err := c.UpdateById(id, map[string]any{"n": 0, "_version": 77}); err != nil {
+		t.Fatal(err)
+	}
+	if v := version(t, c, id); v != 2 {
+		t.Fatalf("updated document at version %d, want 2", v)
+	}
+
+	// a transaction's writes and a vacuum keep the count
+	tx, _ := db.Begin()
+	txc, _ := tx.Collection("c")
+	txId, _ := txc.Insert(map[string]any{"t": 1})
+	txc.UpdateById(txId, map[string]any{"t": 2})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	if v := version(t, c, txId); v != 2 {
+		t.Fatalf("document written in a transaction at version %d, want 2", v)
+	}
+	dbtest.Check(t, db)
+}
+
+func TestUpdateIfVersion(t *testing.T) {
+	db := dbtest.Open(t, filepath.Join(t.TempDir(), "v.db"), nil)
+	defer db.Close()
+	c, _ := db.CreateCollection("c")
+	id, _ := c.Insert(map[string]any{"n": 0})
+
+	if err := c.UpdateIfVersion(id, 1, map[string]any{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	err := c.UpdateIfVersion(id, 1, map[string]any{"n": 2})
+	if !errors.Is(err, collection.ErrVersionConflict) {
+		t.Fatalf("update of a stale version: %v", err)
+	}
+	if doc, _ := c.FindById(id); intOf(doc["n"]) != 1 || intOf(doc["_version"]) != 2 {
+		t.Fatalf("conflicting update changed the document to %v", doc)
+	}
+
+	// a missing document is not a conflict
+	err = c.UpdateIfVersion(12345, 1, map[string]any{})
+	if err == nil || errors.Is(err, collection.ErrVersionConflict) {
+		t.Fatalf("update of a missing document: %v", err)
+	}
+}
+
+// writers that read, change and write back with UpdateIfVersion never lose
+// each other's changes
+func TestUpdateIfVersionConcurrently(t *testing.T) {
+	cases := map[string]*storage.Options{
+		"file":          {CachePages: 16},
+		"copy-on-write": {CachePages: 16, CopyOnWriteIndex: true},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			db := dbtest.Open(t, filepath.Join(t.TempDir(), "v.db"), opts)
+			defer db.Close()
+			c, _ := db.CreateCollection("c")
+			id, _ := c.Insert(map[string]any{"n": 0})
+
+			const workers, per = 8, 50
+			errs := make(chan error, workers)
+			var wg sync.WaitGroup
+			for range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for done := 0; done < per; {
+						doc, err := c.FindById(id)
+						if err != nil {
+							errs <- err
+							return
+						}
+						v := uint64(intOf(doc["_version"]))
+						doc["n"] = intOf(doc["n"]) + 1
+
+						err = c.UpdateIfVersion(id, v, doc)
+						if errors.Is(err, collection.ErrVersionConflict) {
+							continue
+						}
+						if err != nil {
+							errs <- err
+							return
+						}
+						done++
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			doc, _ := c.FindById(id)
+			if intOf(doc["n"]) != workers*per || intOf(doc["_version"]) != 1+workers*per {
+				t.Fatalf("document is %v after %d updates", doc, workers*per)
+			}
+			dbtest.Check(t, db)
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"fmt"
+	"nanodb/internal/collection"
+	"nanodb/internal/storage"
+	"os"
+)
+
+// Backup writes a consistent point-in-time copy of the database to a new
+// file at path, with its manifest beside it. Writers are only held up
+// while a batch of pages is copied, not for the whole copy. Unlike
+// VacuumInto the copy is page for page, so it keeps the free list and the
+// file size of the original.
+func (db *DB) Backup(path string) error {
+	b, err := db.backuper(path)
+	if err != nil {
+		return err
+	}
+	return b.Backup(path)
+}
+
+// BackupIncremental writes the pages changed since the last backup, full
+// or incremental, to a new file at path. storage.Restore rebuilds the
+// database from a full backup and the incremental ones that followed it.
+func (db *DB) BackupIncremental(path string) error {
+	b, err := db.backuper(path)
+	if err != nil {
+		return err
+	}
+	return b.BackupIncremental(path)
+}
+
+// backuper returns the store to back up to path, once path is checked
+func (db *DB) backuper(path string) (storage.Backuper, error) {
+	if err := checkBackupPath(path); err != nil {
+		return nil, err
+	}
+	if collection.TxOpen(db.Pager) {
+		return nil, ErrTxOpen
+	}
+
+	b, ok := db.Pager.(storage.Backuper)
+	if !ok {
+		return nil, fmt.Errorf("%s cannot be backed up", db.path)
+	}
+	return b, nil
+}
+
+func checkBackupPath(path string) error {
+	if path == storage.MemoryPath {
+		return fmt.Errorf("cannot back up into an in-memory database")
+	}
+
+	for _, name := range []string{path, path + storage.ManifestSuffix} {
+		if _, err := os.Stat(name); err == nil {
+			return fmt.Errorf("backup to %s: %s already exists", path, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package database_test
+
+import (
+	"errors"
+	"nanodb/internal/database"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/storage"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func docIdSet(t *testing.T, db *database.DB, name string) map[uint64]bool {
+	t.Helper()
+	c, ok := db.Collection(name)
+	if !ok {
+		t.Fatalf("collection %s missing", name)
+	}
+	docIds, err := c.FindAllDocIds(map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := make(map[uint64]bool, len(docIds))
+	for _, id := range docIds {
+		set[id] = true
+	}
+	return set
+}
+
+func TestBackupWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	db := dbtest.Open(t, filepath.Join(dir, "a.db"), &storage.Options{CachePages: 32})
+	defer db.Close()
+
+	dbtest.Fill(t, db, "log", 1000, 200)
+	log, _ := db.Collection("log")
+
+	// inserts run one after another, so a consistent copy holds the first
+	// few of them and none after
+	var inserted []uint64
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for !stop.Load() {
+			id, err := log.Insert(map[string]any{"pad": strings.Repeat("y", 300)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			inserted = append(inserted, id)
+		}
+	}()
+
+	var backups []string
+	for _, name := range []string{"b1.db", "b2.db", "b3.db"} {
+		path := filepath.Join(dir, name)
+		if err := db.Backup(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Backup(path); err == nil {
+			t.Fatal("backed up over an existing backup")
+		}
+		backups = append(backups, path)
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	for _, path := range backups {
+		b := dbtest.Open(t, path, &storage.Options{ReadOnly: true})
+		dbtest.Check(t, b)
+
+		got := docIdSet(t, b, "log")
+		n := len(got) - 1000
+		for i, id := range inserted {
+			if got[id] != (i < n) {
+				t.Fatalf("%s holds %d of the later inserts, but not the first %d in order", filepath.Base(path), n, n)
+			}
+		}
+		b.Close()
+	}
+}
+
+func TestBackupKeepsEncryption(t *testing.T) {
+	dir := t.TempDir()
+	db := dbtest.Open(t, filepath.Join(dir, "e.db"), &storage.Options{Passphrase: "secret"})
+	docIds := dbtest.Fill(t, db, "c", 100, 100)
+
+	path := filepath.Join(dir, "b.db")
+	if err := db.Backup(path); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := database.Open(path, nil); !errors.Is(err, storage.ErrKeyRequired) {
+		t.Fatalf("opening the backup without the passphrase: %v", err)
+	}
+	b := dbtest.Open(t, path, &storage.Options{Passphrase: "secret"})
+	defer b.Close()
+	if got := docIdSet(t, b, "c"); len(got) != len(docIds) {
+		t.Fatalf("backup holds %d documents, want %d", len(got), len(docIds))
+	}
+	dbtest.Check(t, b)
+}
+
+func TestBackupMemoryDatabase(t *testing.T) {
+	db := dbtest.Open(t, storage.MemoryPath, nil)
+	defer db.Close()
+	docIds := dbtest.Fill(t, db, "m", 300, 50)
+
+	if err := db.Backup(storage.MemoryPath); err == nil {
+		t.Fatal("backed up into memory")
+	}
+
+	path := filepath.Join(t.TempDir(), "m.db")
+	if err := db.Backup(path); err != nil {
+		t.Fatal(err)
+	}
+	b := dbtest.Open(t, path, nil)
+	defer b.Close()
+	if got := docIdSet(t, b, "m"); len(got) != len(docIds) {
+		t.Fatalf("backup holds %d documents, want %d", len(got), len(docIds))
+	}
+	dbtest.Check(t, b)
+}
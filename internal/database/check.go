@@ -0,0 +1,362 @@
+package database
+
+import (
+	"encoding/binary"
+	"fmt"
+	"nanodb/internal/btree"
+	"nanodb/internal/collection"
+	"nanodb/internal/record"
+	"nanodb/internal/storage"
+)
+
+// Problem is one inconsistency found by Check
+type Problem struct {
+	Page    uint32 // page it was found on, 0 when it concerns no single page
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Page == 0 {
+		return p.Message
+	}
+	return fmt.Sprintf("page %d: %s", p.Page, p.Message)
+}
+
+// Check walks every structure in the database and reports what is wrong
+// with it: the free list, the catalog, and each collection's page chain,
+// overflow chains, _id index, free-space map and vector buckets. Every page
+// must be used by exactly one of them, and be labelled in its prologue
+// with the type of page that uses it. Nothing may write to the database
+// while it runs.
+func (db *DB) Check() []Problem {
+	ck := &checker{
+		p:      db.Pager,
+		count:  db.Header.PageCount,
+		owners: map[uint32]string{0: "header"},
+	}
+	ck.checkType(0, "header", storage.PageTypeHeader)
+
+	var entries []record.CollectionEntry
+	ck.walkChain(1, "catalog", storage.PageTypeCatalog, 4, func(pageNum uint32, page []byte) {
+		for _, rec := range ck.dataPage(pageNum, page, "catalog") {
+			entry := record.DecodeCollectionEntry(rec.data)
+			entry.PageId, entry.Slot = pageNum, rec.slot
+			entries = append(entries, entry)
+		}
+	})
+
+	for _, entry := range entries {
+		col, ok := db.Collections[entry.Name]
+		if !ok {
+			ck.report(entry.PageId, "collection %s could not be loaded", entry.Name)
+		}
+		ck.collection(entry, col)
+	}
+
+	// last, so that a live page that was also freed is reported once,
+	// as cross-linked, rather than as missing from its owner
+	ck.walkChain(db.Header.FreeList, "free list", storage.PageTypeFree, 0, nil)
+
+	for pageNum := uint32(1); pageNum < ck.count; pageNum++ {
+		if _, ok := ck.owners[pageNum]; !ok {
+			kind := "unreadable"
+			if pr, err := ck.p.Prologue(pageNum); err == nil {
+				kind = pr.Type.String()
+			}
+			ck.report(pageNum, "orphaned %s page: not used by anything and not on the free list", kind)
+		}
+	}
+
+	return ck.problems
+}
+
+type checker struct {
+	p        storage.PageStore
+	count    uint32 // pages in the file according to the header
+	owners   map[uint32]string
+	problems []Problem
+}
+
+func (ck *checker) report(pageNum uint32, format string, args ...any) {
+	ck.problems = append(ck.problems, Problem{Page: pageNum, Message: fmt.Sprintf(format, args...)})
+}
+
+// claim records owner as the user of pageNum, which it uses as a page of
+// type kind. Pages outside the file or already used, by another structure
+// or earlier in the same one, are reported and must not be followed.
+func (ck *checker) claim(pageNum uint32, owner string, kind storage.PageType) bool {
+	if pageNum == 0 || pageNum >= ck.count {
+		ck.report(0, "%s points at page %d, outside the file", owner, pageNum)
+		return false
+	}
+
+	if prev, ok := ck.owners[pageNum]; ok {
+		if prev == owner {
+			ck.report(pageNum, "reached twice in %s, the chain loops", owner)
+		} else {
+			ck.report(pageNum, "cross-linked: used by %s and %s", prev, owner)
+		}
+		return false
+	}
+
+	ck.owners[pageNum] = owner
+	ck.checkType(pageNum, owner, kind)
+	return true
+}
+
+// checkType reports a page whose prologue does not say it is of type kind.
+// A prologue that cannot be read is reported by whoever reads the page.
+func (ck *checker) checkType(pageNum uint32, owner string, kind storage.PageType) {
+	pr, err := ck.p.Prologue(pageNum)
+	if err == nil && pr.Type != kind {
+		ck.report(pageNum, "labelled as a %s page but used as a %s page by %s", pr.Type, kind, owner)
+	}
+}
+
+// walkChain claims every page of a chain of pages of type kind, which keep
+// the next page number at nextOffset, and hands each page to visit, if not nil
+func (ck *checker) walkChain(first uint32, owner string, kind storage.PageType, nextOffset int, visit func(pageNum uint32, page []byte)) {
+	for curr := first; curr != 0; {
+		if !ck.claim(curr, owner, kind) {
+			return
+		}
+
+		page, err := ck.p.PinPage(curr)
+		if err != nil {
+			ck.report(curr, "%s: %v", owner, err)
+			return
+		}
+
+		if visit != nil {
+			visit(curr, page)
+		}
+		next := binary.LittleEndian.Uint32(page[nextOffset:])
+		ck.p.UnpinPage(curr)
+
+		curr = next
+	}
+}
+
+type liveRecord struct {
+	slot  uint16
+	docId uint64
+	data  []byte
+}
+
+// dataPage checks the slot directory of a data page and returns its live records
+func (ck *checker) dataPage(pageNum uint32, page []byte, owner string) []liveRecord {
+	slotCount := int(binary.LittleEndian.Uint16(page[0:2]))
+	freeStart := int(binary.LittleEndian.Uint16(page[2:4]))
+
+	if 8+slotCount*4 > freeStart || freeStart > len(page) {
+		ck.report(pageNum, "%s page has %d slots and free space starting at %d", owner, slotCount, freeStart)
+		return nil
+	}
+
+	var live []liveRecord
+	for slot := range uint16(slotCount) {
+		offset := int(binary.LittleEndian.Uint16(page[8+slot*4:]))
+		recordLen := binary.LittleEndian.Uint16(page[10+slot*4:])
+		if recordLen&record.DeletedFlag != 0 {
+			continue
+		}
+
+		if offset < freeStart || offset+int(recordLen) > len(page) || recordLen < 12 {
+			ck.report(pageNum, "slot %d: record of %d bytes at offset %d lies outside the record area", slot, recordLen, offset)
+			continue
+		}
+
+		lenField := binary.LittleEndian.Uint32(page[offset+8:])
+		if int(lenField&^(record.OverflowFlag|record.CompressedFlag))+12 != int(recordLen) {
+			ck.report(pageNum, "slot %d: record length %d does not match its slot length %d", slot, lenField&^(record.OverflowFlag|record.CompressedFlag), recordLen)
+			continue
+		}
+
+		docId, data, _ := record.ReadRecord(page, slot)
+		live = append(live, liveRecord{slot: slot, docId: docId, data: data})
+	}
+
+	return live
+}
+
+type recordLoc struct {
+	page    uint32
+	slot    uint16
+	indexed bool
+}
+
+func (ck *checker) collection(entry record.CollectionEntry, col *collection.Collection) {
+	name := entry.Name
+	owner := "collection " + name
+
+	records := make(map[uint64]*recordLoc)
+	chain := make(map[uint32]bool)
+
+	ck.walkChain(entry.RootPage, owner, storage.PageTypeData, 4, func(pageNum uint32, page []byte) {
+		chain[pageNum] = true
+
+		for _, rec := range ck.dataPage(pageNum, page, owner) {
+			if prev, ok := records[rec.docId]; ok {
+				ck.report(pageNum, "slot %d: document %d is also stored on page %d slot %d", rec.slot, rec.docId, prev.page, prev.slot)
+				continue
+			}
+			records[rec.docId] = &recordLoc{page: pageNum, slot: rec.slot}
+
+			if record.OverflowRoot(page, rec.slot) != 0 {
+				ck.overflow(name, rec)
+			}
+		}
+	})
+
+	ck.index(name, entry.IndexRoot, records)
+
+	for docId, loc := range records {
+		if !loc.indexed {
+			ck.report(loc.page, "slot %d: document %d of %s is missing from the index", loc.slot, docId, name)
+		}
+	}
+
+	ck.walkChain(entry.FsmRoot, owner+" free-space map", storage.PageTypeFreeSpaceMap, 0, func(pageNum uint32, page []byte) {
+		count := int(binary.LittleEndian.Uint16(page[4:6]))
+		if 6+count*5 > len(page) {
+			ck.report(pageNum, "free-space map page holds %d entries, more than fit", count)
+			return
+		}
+
+		for i := range count {
+			dataPage := binary.LittleEndian.Uint32(page[6+i*5:])
+			if !chain[dataPage] {
+				ck.report(pageNum, "free-space map entry %d names page %d, which is not in %s", i, dataPage, owner)
+			}
+		}
+	})
+
+	if col == nil {
+		return
+	}
+
+	for i, b := range col.Buckets {
+		itemSize := 8 + 4*len(b.Centroid)
+		ck.walkChain(b.RootPage, fmt.Sprintf("%s vector bucket %d", owner, i), storage.PageTypeVector, 0, func(pageNum uint32, page []byte) {
+			count := int(binary.LittleEndian.Uint16(page[4:6]))
+			if collection.HEADER_SIZE+count*itemSize > len(page) {
+				ck.report(pageNum, "vector page holds %d vectors of %d bytes, more than fit", count, itemSize)
+			}
+		})
+	}
+}
+
+func (ck *checker) overflow(name string, rec liveRecord) {
+	length, first := record.DecodeOverflowStub(rec.data)
+	owner := fmt.Sprintf("overflow chain of document %d in %s", rec.docId, name)
+
+	total := 0
+	ck.walkChain(first, owner, storage.PageTypeOverflow, 0, func(pageNum uint32, page []byte) {
+		used := int(binary.LittleEndian.Uint32(page[4:8]))
+		if used > len(page)-record.OverflowHeaderSize {
+			ck.report(pageNum, "%s: page claims %d bytes", owner, used)
+			return
+		}
+		total += used
+	})
+
+	if total != int(length) {
+		ck.report(0, "%s holds %d of %d bytes", owner, total, length)
+	}
+}
+
+// index checks the _id index of a collection: key order against the
+// separators of every parent, leaf depth, and that each leaf entry points
+// at the live record of its document. Nodes keep no usable parent pointer,
+// so parentage is established by the walk itself.
+func (ck *checker) index(name string, root uint32, records map[uint64]*recordLoc) {
+	owner := "index of " + name
+	leafDepth := -1
+
+	var walk func(pageNum uint32, lo, hi uint64, hasHi bool, depth int)
+	walk = func(pageNum uint32, lo, hi uint64, hasHi bool, depth int) {
+		if !ck.claim(pageNum, owner, storage.PageTypeIndex) {
+			return
+		}
+
+		page, err := ck.p.PinPage(pageNum)
+		if err != nil {
+			ck.report(pageNum, "%s: %v", owner, err)
+			return
+		}
+		defer ck.p.UnpinPage(pageNum)
+
+		node := btree.NewNode(page)
+		numCells := int(node.NumCells())
+
+		inRange := func(i int, key uint64) bool {
+			if key < lo || (hasHi && key >= hi) {
+				ck.report(pageNum, "%s: key %d in cell %d is outside the range its parent gives", owner, key, i)
+				return false
+			}
+			lo = key
+			return true
+		}
+
+		switch {
+		case node.IsLeaf():
+			if 12+numCells*btree.LEAF_CELL_SIZE > len(page) {
+				ck.report(pageNum, "%s: leaf holds %d cells, more than fit", owner, numCells)
+				return
+			}
+
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if depth != leafDepth {
+				ck.report(pageNum, "%s: leaf at depth %d, others are at depth %d", owner, depth, leafDepth)
+			}
+
+			var prev uint64
+			for i := range numCells {
+				key, recPage, recSlot := node.GetLeafCell(uint16(i))
+				if i > 0 && key <= prev {
+					ck.report(pageNum, "%s: key %d in cell %d is not above the previous key %d", owner, key, i, prev)
+				}
+				prev = key
+				inRange(i, key)
+
+				loc, ok := records[key]
+				switch {
+				case !ok:
+					ck.report(pageNum, "%s: key %d points at page %d slot %d, which holds no live record of it", owner, key, recPage, recSlot)
+				case loc.page != recPage || loc.slot != recSlot:
+					ck.report(pageNum, "%s: key %d points at page %d slot %d but the document is on page %d slot %d", owner, key, recPage, recSlot, loc.page, loc.slot)
+				case loc.indexed:
+					ck.report(pageNum, "%s: key %d is indexed twice", owner, key)
+				default:
+					loc.indexed = true
+				}
+			}
+
+		case page[0] == btree.NodeTypeInternal:
+			if 12+numCells*btree.INTERNAL_CELL_SIZE > len(page) {
+				ck.report(pageNum, "%s: node holds %d cells, more than fit", owner, numCells)
+				return
+			}
+
+			childLo := lo
+			for i := range numCells {
+				key, child := node.GetInternalCell(uint16(i))
+				if i > 0 && key <= childLo {
+					ck.report(pageNum, "%s: separator %d in cell %d is not above the previous one", owner, key, i)
+				}
+				if !inRange(i, key) {
+					return
+				}
+				walk(child, childLo, key, true, depth+1)
+				childLo = key
+			}
+			walk(node.RightChild(), childLo, hi, hasHi, depth+1)
+
+		default:
+			ck.report(pageNum, "%s: unknown node type %d", owner, page[0])
+		}
+	}
+
+	walk(root, 0, 0, false, 0)
+}
@@ -0,0 +1,153 @@
+package database_test
+
+import (
+	"encoding/binary"
+	"nanodb/internal/database"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/storage"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// busyDB fills a database with every kind of page: updated and deleted
+// documents, overflow chains, a compressed collection and vectors
+func busyDB(t *testing.T, path string) *database.DB {
+	t.Helper()
+	db := dbtest.Open(t, path, &storage.Options{CachePages: 32})
+
+	docIds := dbtest.Fill(t, db, "docs", 1000, 150)
+	docs, _ := db.Collection("docs")
+	for i, id := range docIds {
+		switch i % 5 {
+		case 0:
+			docs.DeleteById(id)
+		case 1:
+			docs.UpdateById(id, map[string]any{"i": i, "pad": strings.Repeat("u", 400)})
+		}
+	}
+	docs.Insert(map[string]any{"big": strings.Repeat("b", 20000)})
+
+	zipped, _ := db.CreateCollection("zipped")
+	zipped.SetCompression(true)
+	zipped.InsertMany([]map[string]any{{"text": strings.Repeat("zip ", 300)}, {"text": strings.Repeat("zap ", 3000)}})
+
+	vecs, _ := db.CreateCollection("vecs")
+	for i := range 300 {
+		vec := make([]float32, 32)
+		vec[i%32] = 1
+		if err := vecs.InsertVector(uint64(10+i), vec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := docs.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func reported(problems []database.Problem, text string) bool {
+	for _, p := range problems {
+		if strings.Contains(p.Message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheckCleanDatabase(t *testing.T) {
+	for _, path := range []string{filepath.Join(t.TempDir(), "c.db"), storage.MemoryPath} {
+		db := busyDB(t, path)
+		if problems := db.Check(); len(problems) > 0 {
+			t.Fatalf("%s: %d problems, the first %v", path, len(problems), problems[0])
+		}
+		db.Close()
+	}
+}
+
+func TestCheckFindsDamage(t *testing.T) {
+	cases := map[string]struct {
+		damage func(t *testing.T, db *database.DB)
+		want   string
+	}{
+		"orphan": {
+			damage: func(t *testing.T, db *database.DB) {
+				pageNum, _ := db.Pager.AllocatePage(db.Header)
+				buff := db.Pager.GetBuff()
+				defer storage.ReleasePageBuffer(buff)
+				db.Pager.WritePage(pageNum, storage.PageTypeData, buff)
+			},
+			want: "orphaned data page",
+		},
+		"cross-link": {
+			damage: func(t *testing.T, db *database.DB) {
+				docs, _ := db.Collection("docs")
+				db.Header.FreeList = docs.LastPage
+			},
+			want: "cross-linked",
+		},
+		"document id": {
+			damage: func(t *testing.T, db *database.DB) {
+				docs, _ := db.Collection("docs")
+				page, _ := db.Pager.ReadPage(docs.RootPage)
+				defer storage.ReleasePageBuffer(page)
+				offset := binary.LittleEndian.Uint16(page[8:])
+				binary.LittleEndian.PutUint64(page[offset:], 0xdeadbeef)
+				db.Pager.WritePage(docs.RootPage, storage.PageTypeData, page)
+			},
+			want: "missing from the index",
+		},
+		"page type": {
+			damage: func(t *testing.T, db *database.DB) {
+				docs, _ := db.Collection("docs")
+				page, _ := db.Pager.ReadPage(docs.RootPage)
+				defer storage.ReleasePageBuffer(page)
+				db.Pager.WritePage(docs.RootPage, storage.PageTypeVector, page)
+			},
+			want: "labelled as a vector page but used as a data page",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			db := busyDB(t, storage.MemoryPath)
+			defer db.Close()
+
+			db.Pager.Begin()
+			c.damage(t, db)
+			db.Pager.WriteHeader(db.Header)
+			if err := storage.Finish(db.Pager, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			problems := db.Check()
+			if !reported(problems, c.want) {
+				t.Fatalf("%q not reported, got %v", c.want, problems)
+			}
+		})
+	}
+}
+
+func TestEveryPageIsTyped(t *testing.T) {
+	db := busyDB(t, filepath.Join(t.TempDir(), "t.db"))
+	defer db.Close()
+
+	kinds := make(map[storage.PageType]int)
+	for pageNum := range db.Header.PageCount {
+		pr, err := db.Pager.Prologue(pageNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds[pr.Type]++
+	}
+
+	if kinds[storage.PageTypeUnknown] != 0 {
+		t.Fatalf("%d pages without a type", kinds[storage.PageTypeUnknown])
+	}
+	for _, kind := range []storage.PageType{storage.PageTypeHeader, storage.PageTypeCatalog, storage.PageTypeData, storage.PageTypeOverflow, storage.PageTypeIndex, storage.PageTypeVector, storage.PageTypeFreeSpaceMap, storage.PageTypeFree} {
+		if kinds[kind] == 0 {
+			t.Errorf("no %v page in the database", kind)
+		}
+	}
+}
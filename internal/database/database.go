@@ -0,0 +1,250 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"nanodb/internal/btree"
+	"nanodb/internal/collection"
+	"nanodb/internal/record"
+	"nanodb/internal/storage"
+)
+
+// DB is an open database file together with its catalog and collections.
+// Collections handle their own locking; DB itself does not.
+type DB struct {
+	Pager       storage.PageStore
+	Header      *storage.DBHeader
+	Catalog     *collection.Collection
+	Collections map[string]*collection.Collection
+
+	path string
+	opts *storage.Options
+}
+
+// Open opens the database at path, creating it when the file is empty.
+// storage.MemoryPath (":memory:") opens a database that is never written
+// to disk.
+func Open(path string, opts *storage.Options) (*DB, error) {
+	db := &DB{path: path, opts: opts}
+
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (db *DB) Path() string {
+	return db.path
+}
+
+func (db *DB) load() error {
+	p, err := storage.Open(db.path, db.opts)
+	if err != nil {
+		return err
+	}
+
+	return db.attach(p)
+}
+
+// attach reads the header, catalog and collections of an opened store
+func (db *DB) attach(p storage.PageStore) error {
+	// only a file without any pages is initialised, anything else that
+	// fails to read or validate is reported
+	h, err := p.ReadHeader()
+	if errors.Is(err, storage.ErrNoHeader) && !p.ReadOnly() {
+		h, err = bootstrap(p)
+	}
+	if err != nil {
+		p.Close()
+		return fmt.Errorf("open %s: %w", db.path, err)
+	}
+
+	// Load Catalog "_catalog", 1, 0,
+	cat, err := collection.NewCollection(&record.CollectionEntry{
+		Name:      "_catalog",
+		RootPage:  1,
+		IndexRoot: 0,
+		PageId:    0,
+		Slot:      0,
+	}, p, h) //collection insert bypasses the btree so this is fine
+	if err != nil {
+		p.Close()
+		return err
+	}
+
+	collections, err := record.GetCollectionsOfVersion(p, h.Version)
+	if err != nil {
+		p.Close()
+		return err
+	}
+
+	loaded := make(map[string]*collection.Collection)
+	for _, col := range collections {
+		loadedCol, err := collection.NewCollection(&col, p, h)
+		if err != nil {
+			p.Close()
+			return fmt.Errorf("open %s: collection %s: %w", db.path, col.Name, err)
+		}
+		loadedCol.LoadVectorIndex()
+		loadedCol.BTree.CopyOnWrite = db.copyOnWrite()
+		loaded[col.Name] = loadedCol
+	}
+
+	db.Pager = p
+	db.Header = h
+	db.Catalog = cat
+	db.Collections = loaded
+
+	return nil
+}
+
+// bootstrap writes the header and an empty catalog page to a new file
+func bootstrap(p storage.PageStore) (*storage.DBHeader, error) {
+	p.Begin()
+
+	h := &storage.DBHeader{
+		Magic:     storage.Magic,
+		Version:   storage.FormatVersion,
+		PageSize:  uint32(p.PageSize()),
+		PageCount: 1,
+	}
+
+	err := p.WriteHeader(h)
+
+	if err == nil {
+		var catalogPage uint32
+		catalogPage, err = p.AllocatePage(h)
+		if err == nil {
+			rawCatalog := p.GetBuff()
+			storage.InitDataPage(rawCatalog)
+			err = p.WritePage(catalogPage, storage.PageTypeCatalog, rawCatalog)
+			storage.ReleasePageBuffer(rawCatalog)
+		}
+	}
+
+	if err := storage.Finish(p, err, nil); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (db *DB) copyOnWrite() bool {
+	return db.opts != nil && db.opts.CopyOnWriteIndex
+}
+
+func (db *DB) Collection(name string) (*collection.Collection, bool) {
+	col, ok := db.Collections[name]
+	return col, ok
+}
+
+// CreateCollection allocates the first data page and the index root of a
+// new collection and records both in the catalog
+func (db *DB) CreateCollection(name string) (*collection.Collection, error) {
+	if err := db.writable(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := db.Collections[name]; ok {
+		return nil, fmt.Errorf("collection %s already exists", name)
+	}
+
+	if len(name) > record.MaxCollectionNameLen {
+		return nil, fmt.Errorf("collection name of %d bytes is longer than %d", len(name), record.MaxCollectionNameLen)
+	}
+
+	db.Pager.Begin()
+	committed := *db.Header
+
+	col, err := db.createCollectionInternal(name)
+	if err == nil {
+		col.BTree.CopyOnWrite = db.copyOnWrite()
+
+		// registered inside the write, which transactions hold while they
+		// look collections up
+		db.Collections[name] = col
+	}
+
+	err = storage.Finish(db.Pager, err, func() {
+		*db.Header = committed
+		delete(db.Collections, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return col, nil
+}
+
+func (db *DB) createCollectionInternal(cName string) (*collection.Collection, error) {
+	pager := db.Pager
+	header := db.Header
+
+	newColPageNum, err := pager.AllocatePage(header)
+	if err != nil {
+		return nil, err
+	}
+
+	empty := pager.GetBuff()
+
+	storage.InitDataPage(empty)
+	if err := pager.WritePage(newColPageNum, storage.PageTypeData, empty); err != nil {
+		storage.ReleasePageBuffer(empty)
+		return nil, err
+	}
+
+	storage.ReleasePageBuffer(empty)
+
+	newIndexRootPage, err := pager.AllocatePage(header)
+	if err != nil {
+		return nil, err
+	}
+
+	newIndexData := pager.GetBuff()
+
+	node := btree.NewNode(newIndexData)
+
+	node.SetHeader(btree.NodeTypeLeaf, true)
+	node.SetNumCells(0)
+
+	if err := pager.WritePage(newIndexRootPage, storage.PageTypeIndex, newIndexData); err != nil {
+		storage.ReleasePageBuffer(newIndexData)
+		return nil, err
+	}
+
+	storage.ReleasePageBuffer(newIndexData)
+
+	entry := record.EncodeCollectionEntry(cName, newColPageNum, newIndexRootPage, 0, 0)
+	pageId, slot, err := record.InsertCollectionEntry(pager, header, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return collection.NewCollection(&record.CollectionEntry{
+		Name:      cName,
+		RootPage:  newColPageNum,
+		IndexRoot: newIndexRootPage,
+		PageId:    pageId,
+		Slot:      slot,
+	}, pager, header)
+}
+
+// Sync forces everything committed so far to stable storage, for a
+// database opened with a sync mode that does not do so at every commit
+func (db *DB) Sync() error {
+	return db.Pager.Sync()
+}
+
+func (db *DB) Close() error {
+	if collection.TxOpen(db.Pager) {
+		return ErrTxOpen
+	}
+	if db.opts != nil && db.opts.TruncateOnClose && !db.Pager.ReadOnly() {
+		if _, err := db.Truncate(); err != nil {
+			db.Pager.Close()
+			return err
+		}
+	}
+	return db.Pager.Close()
+}
@@ -0,0 +1,86 @@
+package database_test
+
+import (
+	"errors"
+	"nanodb/internal/database"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/storage"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnlyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "r.db")
+	db := dbtest.Open(t, path, nil)
+	docIds := dbtest.Fill(t, db, "a", 30, 100)
+
+	if _, err := database.Open(path, &storage.Options{ReadOnly: true}); err == nil {
+		t.Fatal("opened read-only while a writer has the file")
+	}
+	db.Close()
+
+	db = dbtest.Open(t, path, &storage.Options{ReadOnly: true})
+	defer db.Close()
+
+	a, ok := db.Collection("a")
+	if !ok {
+		t.Fatal("collection missing")
+	}
+	if doc, err := a.FindById(docIds[0]); err != nil || doc == nil {
+		t.Fatalf("document does not read back: %v", err)
+	}
+
+	if _, err := db.CreateCollection("b"); !errors.Is(err, storage.ErrReadOnly) {
+		t.Fatalf("creating a collection: %v", err)
+	}
+	if _, err := a.Insert(map[string]any{"x": 1}); !errors.Is(err, storage.ErrReadOnly) {
+		t.Fatalf("inserting: %v", err)
+	}
+	if err := a.DeleteById(docIds[0]); !errors.Is(err, storage.ErrReadOnly) {
+		t.Fatalf("deleting: %v", err)
+	}
+	if _, err := db.Vacuum(); !errors.Is(err, storage.ErrReadOnly) {
+		t.Fatalf("vacuuming: %v", err)
+	}
+}
+
+func TestMemoryDatabase(t *testing.T) {
+	db := dbtest.Open(t, storage.MemoryPath, nil)
+	docIds := dbtest.Fill(t, db, "a", 200, 300)
+
+	a, _ := db.Collection("a")
+	for _, id := range docIds[:100] {
+		if err := a.DeleteById(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	dbtest.Check(t, db)
+
+	if _, err := db.Vacuum(); err == nil {
+		t.Fatal("vacuumed a memory database in place")
+	}
+
+	// a memory database can be written out to a file
+	path := filepath.Join(t.TempDir(), "out.db")
+	if err := db.VacuumInto(path); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = dbtest.Open(t, path, nil)
+	a, _ = db.Collection("a")
+	if docIds, _ := a.FindAllDocIds(map[string]any{}); len(docIds) != 100 {
+		t.Fatalf("%d documents written out, want 100", len(docIds))
+	}
+	db.Close()
+
+	// and every memory database starts empty
+	db = dbtest.Open(t, storage.MemoryPath, nil)
+	defer db.Close()
+	if len(db.Collections) != 0 {
+		t.Fatal("memory databases share their contents")
+	}
+}
@@ -0,0 +1,115 @@
+package database_test
+
+import (
+	"bytes"
+	"errors"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/storage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIncrementalBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.db")
+	in := func(name string) string { return filepath.Join(dir, name) }
+
+	db := dbtest.Open(t, path, nil)
+	if err := db.BackupIncremental(in("none")); !errors.Is(err, storage.ErrNoBaseBackup) {
+		t.Fatalf("incremental backup without a full one: %v", err)
+	}
+	dbtest.Fill(t, db, "c", 1000, 300)
+	if err := db.Backup(in("base")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the changes are tracked across a reopen
+	c, _ := db.Collection("c")
+	c.InsertMany([]map[string]any{{"after": "base"}, {"after": "base"}})
+	db.Close()
+	db = dbtest.Open(t, path, nil)
+	defer func() { db.Close() }()
+	c, _ = db.Collection("c")
+
+	if err := db.BackupIncremental(in("i1")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := storage.ReadManifest(in("i1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Incremental() || len(m.Pages) == 0 || len(m.Pages) >= int(m.PageCount)/2 {
+		t.Fatalf("incremental backup holds %d of %d pages", len(m.Pages), m.PageCount)
+	}
+
+	c.InsertMany([]map[string]any{{"more": 1}, {"more": 2}, {"more": 3}})
+	if err := db.BackupIncremental(in("i2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Backup(in("full")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.Restore(in("r1.db"), []string{in("base"), in("i1")}); err != nil {
+		t.Fatal(err)
+	}
+	r := dbtest.Open(t, in("r1.db"), &storage.Options{ReadOnly: true})
+	if n := len(docIdSet(t, r, "c")); n != 1002 {
+		t.Fatalf("restored %d documents, want 1002", n)
+	}
+	dbtest.Check(t, r)
+	r.Close()
+
+	// the whole chain gives back what a full backup has, page for page
+	if err := storage.Restore(in("r2.db"), []string{in("base"), in("i1"), in("i2")}); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := os.ReadFile(in("r2.db"))
+	full, _ := os.ReadFile(in("full"))
+	if !bytes.Equal(restored, full) {
+		t.Fatalf("restored %d bytes differ from the %d of a full backup", len(restored), len(full))
+	}
+
+	for name, chain := range map[string][]string{
+		"gap":              {in("base"), in("i2")},
+		"incremental only": {in("i1")},
+		"two full":         {in("base"), in("full")},
+	} {
+		if err := storage.Restore(in("bad.db"), chain); err == nil {
+			t.Fatalf("restored a chain with %s", name)
+		}
+	}
+
+	// a vacuumed file is new, backups of the old one do not apply to it
+	if _, err := db.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BackupIncremental(in("i3")); !errors.Is(err, storage.ErrNoBaseBackup) {
+		t.Fatalf("incremental backup after a vacuum: %v", err)
+	}
+}
+
+func TestRestoreChecksPages(t *testing.T) {
+	dir := t.TempDir()
+	db := dbtest.Open(t, filepath.Join(dir, "a.db"), nil)
+	dbtest.Fill(t, db, "c", 100, 100)
+	base := filepath.Join(dir, "base")
+	if err := db.Backup(base); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	raw, _ := os.ReadFile(base)
+	raw[2*storage.DefaultPageSize+100] ^= 0xff
+	os.WriteFile(base, raw, 0o644)
+
+	target := filepath.Join(dir, "r.db")
+	var cpe *storage.CorruptPageError
+	if err := storage.Restore(target, []string{base}); !errors.As(err, &cpe) {
+		t.Fatalf("restoring a damaged backup: %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Fatal("half restored file left behind")
+	}
+}
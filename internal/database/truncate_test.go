@@ -0,0 +1,140 @@
+package database_test
+
+import (
+	"nanodb/internal/database"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/storage"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fillBlobs inserts documents that each take a chain of overflow pages at
+// the end of the file, so deleting them frees its trailing pages
+func fillBlobs(t *testing.T, db *database.DB, name string, n int) []uint64 {
+	t.Helper()
+	c, err := db.CreateCollection(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docIds []uint64
+	for i := range n {
+		id, err := c.Insert(map[string]any{"blob": strings.Repeat(string(rune('a'+i%26)), 30000)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		docIds = append(docIds, id)
+	}
+	return docIds
+}
+
+func TestTruncateGivesBackTrailingPages(t *testing.T) {
+	cases := map[string]storage.Options{
+		"file":      {},
+		"encrypted": {Passphrase: "pw"},
+		"mmap":      {Mmap: true},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			if opts.Mmap && !slices.Contains([]string{"linux", "darwin", "freebsd"}, runtime.GOOS) {
+				t.Skip("no memory-mapped files on", runtime.GOOS)
+			}
+			path := filepath.Join(t.TempDir(), "t.db")
+			db := dbtest.Open(t, path, &opts)
+			defer func() { db.Close() }()
+
+			small := dbtest.Fill(t, db, "small", 50, 50)
+			blobIds := fillBlobs(t, db, "blobs", 20)
+			blobs, _ := db.Collection("blobs")
+			for _, id := range blobIds {
+				if err := blobs.DeleteById(id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.Pager.Checkpoint()
+
+			before := dbtest.FileSize(t, path)
+			shrank, err := db.Truncate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shrank == 0 || dbtest.FileSize(t, path) != before-shrank {
+				t.Fatalf("file went from %d to %d bytes, truncate reports %d", before, dbtest.FileSize(t, path), shrank)
+			}
+			if dbtest.FileSize(t, path) != int64(db.Header.PageCount)*int64(db.Pager.PageSize()) {
+				t.Fatalf("file is %d bytes for %d pages", dbtest.FileSize(t, path), db.Header.PageCount)
+			}
+			dbtest.Check(t, db)
+
+			if again, err := db.Truncate(); err != nil || again != 0 {
+				t.Fatalf("second truncate: %d bytes, %v", again, err)
+			}
+
+			// the file grows again from its new end
+			if _, err := blobs.Insert(map[string]any{"blob": strings.Repeat("z", 50000)}); err != nil {
+				t.Fatal(err)
+			}
+			dbtest.Check(t, db)
+			db.Close()
+
+			db = dbtest.Open(t, path, &opts)
+			if n := len(docIdSet(t, db, "small")); n != len(small) {
+				t.Fatalf("%d documents left in small, want %d", n, len(small))
+			}
+			if n := len(docIdSet(t, db, "blobs")); n != 1 {
+				t.Fatalf("%d documents in blobs, want 1", n)
+			}
+			dbtest.Check(t, db)
+		})
+	}
+}
+
+func TestTruncateOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	opts := &storage.Options{TruncateOnClose: true}
+	db := dbtest.Open(t, path, opts)
+
+	dbtest.Fill(t, db, "small", 10, 50)
+	blobIds := fillBlobs(t, db, "blobs", 10)
+	blobs, _ := db.Collection("blobs")
+	for _, id := range blobIds {
+		blobs.DeleteById(id)
+	}
+	pageCount := db.Header.PageCount
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = dbtest.Open(t, path, nil)
+	defer db.Close()
+	if db.Header.PageCount >= pageCount {
+		t.Fatalf("closing left %d pages, had %d", db.Header.PageCount, pageCount)
+	}
+	if dbtest.FileSize(t, path) != int64(db.Header.PageCount)*int64(db.Pager.PageSize()) {
+		t.Fatalf("file is %d bytes for %d pages", dbtest.FileSize(t, path), db.Header.PageCount)
+	}
+	dbtest.Check(t, db)
+}
+
+func TestTruncateMemoryDatabase(t *testing.T) {
+	db := dbtest.Open(t, storage.MemoryPath, nil)
+	defer db.Close()
+
+	blobIds := fillBlobs(t, db, "blobs", 10)
+	blobs, _ := db.Collection("blobs")
+	for _, id := range blobIds {
+		blobs.DeleteById(id)
+	}
+	pageCount := db.Header.PageCount
+
+	shrank, err := db.Truncate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shrank != int64(pageCount-db.Header.PageCount)*int64(db.Pager.PageSize()) || shrank == 0 {
+		t.Fatalf("truncate reports %d bytes for %d to %d pages", shrank, pageCount, db.Header.PageCount)
+	}
+	dbtest.Check(t, db)
+}
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"nanodb/internal/collection"
+	"nanodb/internal/storage"
+)
+
+// ErrTxOpen is returned by writes made while a transaction is open
+var ErrTxOpen = collection.ErrTxOpen
+
+// Tx is a write transaction across the collections of a database. Its
+// changes are invisible to everyone else until Commit and are all undone
+// by Rollback or a crash, see collection.Tx.
+type Tx struct {
+	*collection.Tx
+	db *DB
+}
+
+// Begin starts a transaction. Until it is committed or rolled back, every
+// other write to the database, made directly on a collection or the
+// database or through a second transaction, fails with ErrTxOpen.
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := collection.Begin(db.Pager, db.Header)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, db: db}, nil
+}
+
+// Collection returns the named collection as the transaction sees it
+func (tx *Tx) Collection(name string) (*collection.TxCollection, bool) {
+	col, ok := tx.db.Collections[name]
+	if !ok {
+		return nil, false
+	}
+	return tx.Use(col), true
+}
+
+// writable returns the error a write outside a transaction fails with
+func (db *DB) writable() error {
+	if db.Pager.ReadOnly() {
+		return storage.ErrReadOnly
+	}
+	if collection.TxOpen(db.Pager) {
+		return ErrTxOpen
+	}
+	return nil
+}
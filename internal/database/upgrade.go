@@ -0,0 +1,94 @@
+package database
+
+import (
+	"errors"
+	"nanodb/internal/storage"
+	"os"
+	"path/filepath"
+)
+
+// Upgrade rewrites the database at path in the current format and returns
+// the format version it had before. Every older format has a smaller page
+// prologue, or none, and so a larger page body, so the database is copied
+// collection by collection into a new file that is renamed over it.
+func Upgrade(path string, opts *storage.Options) (uint16, error) {
+	db, err := Open(path, opts)
+	if err == nil {
+		return db.Header.Version, db.Close()
+	}
+	if !errors.Is(err, storage.ErrNeedsUpgrade) {
+		return 0, err
+	}
+
+	// format 1 does not even have checksums
+	var store storage.PageStore
+	store, err = storage.OpenForUpgrade(path, opts)
+	if errors.Is(err, storage.ErrNeedsUpgrade) {
+		store, err = storage.OpenLegacy(path)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	h, err := store.ReadHeader()
+	if err != nil {
+		store.Close()
+		return 0, err
+	}
+
+	return h.Version, upgradeCopy(path, store, opts)
+}
+
+// upgradeCopy copies the database in store into a new file in the current
+// format and swaps it into place. The collections are created afresh in
+// the copy, so their catalog entries are written in the current layout.
+func upgradeCopy(path string, store storage.PageStore, opts *storage.Options) error {
+	src := &DB{path: path}
+	if err := src.attach(store); err != nil {
+		return err
+	}
+
+	tmp := path + "-upgrade"
+	os.Remove(tmp)
+	os.Remove(tmp + "-wal")
+
+	dstOpts := storage.Options{}
+	if opts != nil {
+		dstOpts = *opts
+	}
+	dstOpts.PageSize = store.PageSize()
+
+	dst, err := Open(tmp, &dstOpts)
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	err = src.copyCollections(dst)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	src.Close()
+	os.Remove(tmp + "-changes")
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// the log was checkpointed when the old file was opened and holds
+	// nothing, and no backup of the old file can be built on
+	for _, name := range []string{path + "-wal", path + "-changes"} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return storage.SyncDir(filepath.Dir(path))
+}
@@ -0,0 +1,151 @@
+package database_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"nanodb/internal/database"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/record"
+	"nanodb/internal/storage"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatIsValidated(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, content := range map[string]string{
+		"junk":  strings.Repeat("hello world ", 1000),
+		"short": "hi",
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0o644)
+
+		if _, err := database.Open(path, nil); !errors.Is(err, storage.ErrNotDatabase) {
+			t.Fatalf("opening %s: %v", name, err)
+		}
+		// and the file is left as it was, not made into a database
+		if raw, _ := os.ReadFile(path); string(raw) != content {
+			t.Fatalf("%s was overwritten", name)
+		}
+	}
+
+	path := filepath.Join(dir, "future.db")
+	db := dbtest.Open(t, path, nil)
+	db.Header.Version = storage.FormatVersion + 1
+	db.Pager.Begin()
+	if err := storage.Finish(db.Pager, db.Pager.WriteHeader(db.Header), nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := database.Open(path, nil); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("opening a newer format: %v", err)
+	}
+}
+
+// a format 1 file has 4096 byte pages without checksums or prologues
+func TestUpgradeFormat1(t *testing.T) {
+	mem := dbtest.Open(t, storage.MemoryPath, nil)
+	docIds := dbtest.Fill(t, mem, "users", 300, 100)
+
+	// catalog entries of format 1 have a one byte name length and end
+	// with the index root
+	entries, err := record.GetAllCollections(mem.Pager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := make([]byte, 4096)
+	storage.InitDataPage(catalog)
+	for _, entry := range entries {
+		old := append([]byte{byte(len(entry.Name))}, entry.Name...)
+		old = binary.LittleEndian.AppendUint32(old, entry.RootPage)
+		old = binary.LittleEndian.AppendUint32(old, entry.IndexRoot)
+		if _, ok, err := record.InsertRecord(catalog, 0, old); err != nil || !ok {
+			t.Fatalf("old catalog entry not inserted: %v", err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "old.db")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pageNum := range mem.Header.PageCount {
+		body, err := mem.Pager.ReadPage(pageNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := make([]byte, 4096)
+		copy(page, body)
+		storage.ReleasePageBuffer(body)
+		switch pageNum {
+		case 0:
+			binary.LittleEndian.PutUint16(page[4:6], 1)
+		case 1:
+			page = catalog
+		}
+		f.WriteAt(page, int64(pageNum)*4096)
+	}
+	f.Close()
+	mem.Close()
+
+	if _, err := database.Open(path, nil); !errors.Is(err, storage.ErrNeedsUpgrade) {
+		t.Fatalf("opening a format 1 file: %v", err)
+	}
+	from, err := database.Upgrade(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 1 {
+		t.Fatalf("upgraded from format %d, want 1", from)
+	}
+
+	db := dbtest.Open(t, path, nil)
+	if db.Header.Version != storage.FormatVersion {
+		t.Fatalf("upgraded to format %d", db.Header.Version)
+	}
+	users, _ := db.Collection("users")
+	for _, id := range docIds {
+		if doc, err := users.FindById(id); err != nil || doc == nil {
+			t.Fatalf("document %d lost in the upgrade: %v", id, err)
+		}
+	}
+	dbtest.Check(t, db)
+	db.Close()
+
+	// upgrading a current file changes nothing
+	if from, err := database.Upgrade(path, nil); err != nil || from != storage.FormatVersion {
+		t.Fatalf("upgrading again: format %d, %v", from, err)
+	}
+}
+
+func TestCollectionNameLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "n.db")
+	db := dbtest.Open(t, path, nil)
+
+	// longer than the one byte length of older formats could hold
+	longest := strings.Repeat("n", record.MaxCollectionNameLen)
+	if _, err := db.CreateCollection(longest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CreateCollection(longest + "n"); err == nil {
+		t.Fatal("created a collection with a name past the limit")
+	}
+	if _, err := db.CreateCollection("after"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = dbtest.Open(t, path, nil)
+	defer db.Close()
+	if len(db.Collections) != 2 {
+		t.Fatalf("%d collections after reopening, want 2", len(db.Collections))
+	}
+	if _, ok := db.Collection(longest); !ok {
+		t.Fatal("longest name does not read back")
+	}
+	dbtest.Check(t, db)
+}
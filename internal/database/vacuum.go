@@ -0,0 +1,164 @@
+package database
+
+import (
+	"fmt"
+	"nanodb/internal/collection"
+	"nanodb/internal/record"
+	"nanodb/internal/storage"
+	"os"
+	"path/filepath"
+)
+
+// VacuumInto writes a compacted copy of the database to a new file at path.
+// Collections are streamed into it one after another, so their pages come
+// out in sequential order and the copy starts with an empty free list.
+// Writes wait until the copy is done, so it is of a single commit.
+func (db *DB) VacuumInto(path string) error {
+	if collection.TxOpen(db.Pager) {
+		return ErrTxOpen
+	}
+
+	db.Pager.Begin()
+	defer db.Pager.Rollback()
+
+	return db.vacuumInto(path)
+}
+
+// vacuumInto is VacuumInto inside a write the caller holds
+func (db *DB) vacuumInto(path string) error {
+	if path == storage.MemoryPath {
+		return fmt.Errorf("cannot vacuum into an in-memory database")
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("vacuum into %s: file already exists", path)
+	}
+
+	// the copy is encrypted with the same passphrase as the original
+	opts := &storage.Options{PageSize: db.Pager.PageSize()}
+	if db.opts != nil {
+		opts.Passphrase = db.opts.Passphrase
+	}
+
+	dst, err := Open(path, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := db.copyCollections(dst); err != nil {
+		dst.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return dst.Close()
+}
+
+func (db *DB) copyCollections(dst *DB) error {
+	entries, err := record.GetCollectionsOfVersion(db.Pager, db.Header.Version)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		src, ok := db.Collections[entry.Name]
+		if !ok {
+			return fmt.Errorf("collection %s is in the catalog but not loaded", entry.Name)
+		}
+
+		col, err := dst.CreateCollection(entry.Name)
+		if err != nil {
+			return err
+		}
+
+		if err := col.SetCompression(src.Compress); err != nil {
+			return err
+		}
+
+		if err := src.CopyTo(col); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Truncate shrinks the file by the free pages at its end, which is cheap
+// next to Vacuum but leaves free pages in the middle of the file alone.
+// It returns the number of bytes the file shrank by.
+func (db *DB) Truncate() (int64, error) {
+	if err := db.writable(); err != nil {
+		return 0, err
+	}
+
+	removed, err := db.Pager.Truncate(db.Header)
+	return int64(removed) * int64(db.Pager.PageSize()), err
+}
+
+// Vacuum rebuilds the database with VacuumInto and renames the copy over
+// the original file, which is how the file shrinks. Writes wait from the
+// start of the copy until the copy is in place, and the collections must
+// be looked up again after; the old ones fail with storage.ErrClosed.
+// If the copy cannot be opened once it is in place, the database is left
+// closed and has to be opened again. It returns the number of bytes the
+// file shrank by.
+func (db *DB) Vacuum() (int64, error) {
+	if err := db.writable(); err != nil {
+		return 0, err
+	}
+
+	pager, ok := db.Pager.(*storage.Pager)
+	if !ok {
+		return 0, fmt.Errorf("cannot vacuum an in-memory database in place")
+	}
+
+	tmp := db.path + "-vacuum"
+	os.Remove(tmp)
+	os.Remove(tmp + "-wal")
+
+	pager.Begin()
+
+	pageSize := int64(pager.PageSize())
+	before := int64(db.Header.PageCount) * pageSize
+
+	err := db.vacuumInto(tmp)
+	os.Remove(tmp + "-changes")
+
+	// the copy is locked before it takes the place of the original, whose
+	// lock only goes once it is out of place, so no other process can get
+	// in between and write to either
+	var file *os.File
+	if err == nil {
+		file, err = storage.LockFile(tmp)
+	}
+	if err != nil {
+		pager.Rollback()
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	// the original file is untouched when this fails, keep using it
+	if err := pager.ReplaceFile(tmp); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	// the copy is in place whether or not the rename is synced yet
+	syncErr := storage.SyncDir(filepath.Dir(db.path))
+
+	// the old pager and collections only return storage.ErrClosed now,
+	// which is what is left when the copy does not open
+	p, err := storage.OpenLocked(file, db.path, db.opts)
+	if err == nil {
+		err = db.attach(p)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("vacuum: %s is in place but could not be opened, reopen the database: %w", db.path, err)
+	}
+	if syncErr != nil {
+		return 0, syncErr
+	}
+
+	return before - int64(db.Header.PageCount)*pageSize, nil
+}
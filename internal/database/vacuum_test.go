@@ -0,0 +1,156 @@
+package database_test
+
+import (
+	"errors"
+	"nanodb/internal/database"
+	"nanodb/internal/dbtest"
+	"nanodb/internal/storage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVacuumShrinksTheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.db")
+	db := dbtest.Open(t, path, nil)
+	defer func() { db.Close() }()
+
+	docIds := dbtest.Fill(t, db, "a", 500, 400)
+	dbtest.Fill(t, db, "b", 20, 100)
+
+	a, _ := db.Collection("a")
+	for _, id := range docIds[10:] {
+		if err := a.DeleteById(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shrank, err := db.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shrank <= 0 {
+		t.Fatalf("vacuum shrank the file by %d bytes", shrank)
+	}
+	if size := dbtest.FileSize(t, path); size != int64(db.Header.PageCount)*int64(db.Pager.PageSize()) {
+		t.Fatalf("file is %d bytes for %d pages", size, db.Header.PageCount)
+	}
+	if _, err := os.Stat(path + "-vacuum"); !os.IsNotExist(err) {
+		t.Fatal("copy left behind")
+	}
+
+	a, _ = db.Collection("a")
+	for _, id := range docIds[:10] {
+		if doc, err := a.FindById(id); err != nil || doc == nil {
+			t.Fatalf("document %d lost: %v", id, err)
+		}
+	}
+	b, _ := db.Collection("b")
+	if docIds, _ := b.FindAllDocIds(map[string]any{}); len(docIds) != 20 {
+		t.Fatalf("collection b has %d documents, want 20", len(docIds))
+	}
+	dbtest.Check(t, db)
+
+	// the database carries on in the copy, locked as before
+	if _, err := a.Insert(map[string]any{"after": true}); err != nil {
+		t.Fatal(err)
+	}
+	if other, err := storage.OpenPager(path, nil); err == nil {
+		other.Close()
+		t.Fatal("vacuumed file opened twice for writing")
+	}
+}
+
+func TestVacuumInto(t *testing.T) {
+	dir := t.TempDir()
+	db := dbtest.Open(t, filepath.Join(dir, "v.db"), nil)
+	defer db.Close()
+	dbtest.Fill(t, db, "a", 100, 200)
+
+	copyPath := filepath.Join(dir, "copy.db")
+	if err := db.VacuumInto(copyPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.VacuumInto(copyPath); err == nil {
+		t.Fatal("vacuumed over an existing file")
+	}
+
+	cp := dbtest.Open(t, copyPath, nil)
+	defer cp.Close()
+	a, ok := cp.Collection("a")
+	if !ok {
+		t.Fatal("collection missing from the copy")
+	}
+	if docIds, _ := a.FindAllDocIds(map[string]any{}); len(docIds) != 100 {
+		t.Fatalf("copy has %d documents, want 100", len(docIds))
+	}
+	if cp.Header.FreeList != 0 {
+		t.Fatal("copy has free pages")
+	}
+	dbtest.Check(t, cp)
+}
+
+// writes made while the copy is taken wait for it, and either land in the
+// copy or fail once it is in place, none are lost with the original file
+func TestVacuumLosesNoWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.db")
+	db := dbtest.Open(t, path, nil)
+	defer func() { db.Close() }()
+	dbtest.Fill(t, db, "a", 2000, 300)
+	a, _ := db.Collection("a")
+
+	started, written := make(chan struct{}), make(chan int)
+	go func() {
+		n := 0
+		for {
+			if _, err := a.Insert(map[string]any{"during": n}); err != nil {
+				if !errors.Is(err, storage.ErrClosed) {
+					t.Error(err)
+				}
+				written <- n
+				return
+			}
+			if n++; n == 10 {
+				close(started)
+			}
+		}
+	}()
+	<-started
+
+	if _, err := db.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	n := <-written
+
+	a, _ = db.Collection("a")
+	if docIds, _ := a.FindAllDocIds(map[string]any{}); len(docIds) != 2000+n {
+		t.Fatalf("%d documents after vacuum, want %d", len(docIds), 2000+n)
+	}
+	dbtest.Check(t, db)
+}
+
+// a collection that cannot be loaded fails the open rather than being left
+// out, where a vacuum would drop it for good
+func TestOpenFailsOnBrokenCollection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.db")
+	db := dbtest.Open(t, path, nil)
+	dbtest.Fill(t, db, "a", 10, 100)
+	dbtest.Fill(t, db, "b", 10, 100)
+	b, _ := db.Collection("b")
+	root := b.RootPage
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("garbage"), int64(root)*storage.DefaultPageSize+100)
+	f.Close()
+
+	if db, err := database.Open(path, nil); err == nil {
+		db.Close()
+		t.Fatal("opened a database with a collection that does not load")
+	}
+}
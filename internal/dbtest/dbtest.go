@@ -0,0 +1,75 @@
+// Package dbtest holds the helpers the tests of the database and its
+// collections share.
+package dbtest
+
+import (
+	"nanodb/internal/collection"
+	"nanodb/internal/database"
+	"nanodb/internal/storage"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Open opens the database at path or fails the test
+func Open(t *testing.T, path string, opts *storage.Options) *database.DB {
+	t.Helper()
+	db, err := database.Open(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Check fails the test when the integrity check finds a problem
+func Check(t *testing.T, db *database.DB) {
+	t.Helper()
+	if problems := db.Check(); len(problems) > 0 {
+		t.Fatalf("check: %v", problems)
+	}
+}
+
+// Count returns the number of documents in c
+func Count(t *testing.T, c *collection.Collection) int {
+	t.Helper()
+	docIds, err := c.FindAllDocIds(map[string]any{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(docIds)
+}
+
+// PaddedDocs returns n documents of about size bytes each
+func PaddedDocs(n, size int) []map[string]any {
+	docs := make([]map[string]any, n)
+	for i := range docs {
+		docs[i] = map[string]any{"i": i, "pad": strings.Repeat("x", size)}
+	}
+	return docs
+}
+
+// Fill inserts n documents of about size bytes into a new collection and
+// returns their ids
+func Fill(t *testing.T, db *database.DB, name string, n, size int) []uint64 {
+	t.Helper()
+	c, err := db.CreateCollection(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docIds, err := c.InsertMany(PaddedDocs(n, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *docIds
+}
+
+// FileSize returns the size of the file at path
+func FileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
@@ -0,0 +1,113 @@
+package record
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// documents of a collection with compression on are deflated before they
+// are stored. the record's data length carries CompressedFlag, so pages
+// can mix compressed and plain records and reads do not need to know the
+// collection's setting. a compressed record is the length of the document
+// followed by the deflate stream: [length 4] [deflated], so reads inflate
+// exactly as much as was compressed.
+
+const CompressedFlag uint32 = 0x40000000 // set in a record's data length
+
+// MaxDocSize is the largest document the data length of a record can hold
+// beside its flags, before or after compression
+const MaxDocSize = int(CompressedFlag - 1)
+
+// smaller documents rarely shrink enough to pay for the deflate header
+const MinCompressSize = 64
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// Compress deflates data and reports whether that made it smaller
+func Compress(data []byte) ([]byte, bool) {
+	if len(data) < MinCompressSize {
+		return data, false
+	}
+
+	var buf bytes.Buffer
+	buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(data))))
+
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return data, false
+	}
+	if err := w.Close(); err != nil {
+		return data, false
+	}
+
+	if buf.Len() >= len(data) {
+		return data, false
+	}
+	return buf.Bytes(), true
+}
+
+// deflate cannot do better than about 1032 to 1, a record that claims more
+// is corrupt
+const maxDeflateRatio = 1032
+
+// Decompress inflates a stored document to the length stored with it. A
+// corrupt record fails rather than inflating to any other length, and the
+// length is checked against the size of the record before anything is
+// allocated for it.
+func Decompress(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("compressed document of %d bytes has no length", len(data))
+	}
+
+	size := int(binary.LittleEndian.Uint32(data))
+	if size > MaxDocSize || size > (len(data)-4)*maxDeflateRatio {
+		return nil, fmt.Errorf("compressed document of %d bytes claims to inflate to %d", len(data), size)
+	}
+	return inflate(data[4:], size)
+}
+
+// inflate inflates data, which must come to exactly size bytes
+func inflate(data []byte, size int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	// one byte more than expected tells a stream that goes on
+	out := make([]byte, size+1)
+	n, err := io.ReadFull(r, out)
+	if err == nil {
+		return nil, fmt.Errorf("compressed document inflates past %d bytes", size)
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("compressed document inflates to %d bytes, want %d", n, size)
+	}
+	return out[:n], nil
+}
+
+// IsCompressed reports whether a live slot holds a deflated document
+func IsCompressed(page []byte, slot uint16) bool {
+	slotOffset := 8 + slot*4
+
+	offset := binary.LittleEndian.Uint16(page[slotOffset:])
+	recordLen := binary.LittleEndian.Uint16(page[slotOffset+2:])
+
+	if isDeleted(recordLen) {
+		return false
+	}
+
+	return binary.LittleEndian.Uint32(page[offset+8:])&CompressedFlag != 0
+}
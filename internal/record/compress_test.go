@@ -0,0 +1,82 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("key value "), 500)
+
+	packed, ok := Compress(data)
+	if !ok || len(packed) >= len(data) {
+		t.Fatalf("%d bytes compressed to %d", len(data), len(packed))
+	}
+	got, err := Decompress(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("document does not inflate to what was compressed")
+	}
+
+	if _, ok := Compress(randomBytes(1000)); ok {
+		t.Fatal("random bytes compressed")
+	}
+	if _, ok := Compress(data[:MinCompressSize-1]); ok {
+		t.Fatal("document below the minimum compressed")
+	}
+}
+
+func TestInflateIsExact(t *testing.T) {
+	packed, _ := Compress(make([]byte, 1<<20))
+	stream := packed[4:]
+
+	if _, err := inflate(stream, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inflate(stream, 1<<20-1); err == nil {
+		t.Fatal("inflated past the stored length")
+	}
+	if _, err := inflate(stream, 1<<20+1); err == nil {
+		t.Fatal("inflated short of the stored length")
+	}
+	if _, err := Decompress(packed[:len(packed)/2]); err == nil {
+		t.Fatal("truncated document inflated")
+	}
+}
+
+// a corrupt length is refused before anything is allocated for it
+func TestDecompressChecksTheLength(t *testing.T) {
+	packed, _ := Compress(bytes.Repeat([]byte("abc"), 200))
+
+	for _, size := range []uint32{uint32(MaxDocSize) + 1, uint32(len(packed)-4)*maxDeflateRatio + 1} {
+		corrupt := bytes.Clone(packed)
+		binary.LittleEndian.PutUint32(corrupt, size)
+		if _, err := Decompress(corrupt); err == nil {
+			t.Fatalf("document claiming %d bytes inflated", size)
+		}
+	}
+	if _, err := Decompress(packed[:3]); err == nil {
+		t.Fatal("document without a length inflated")
+	}
+}
+
+func TestCompressedFlagInSlot(t *testing.T) {
+	page := newDataPage()
+	packed, _ := Compress(bytes.Repeat([]byte("abc"), 200))
+
+	plainSlot, _, _ := InsertRecord(page, 1, []byte("plain"))
+	packedSlot, ok, err := InsertRecordFlags(page, 2, packed, CompressedFlag)
+	if err != nil || !ok {
+		t.Fatalf("compressed record not inserted: %v", err)
+	}
+
+	if IsCompressed(page, plainSlot) || !IsCompressed(page, packedSlot) {
+		t.Fatal("compressed flag read back wrong")
+	}
+	if _, data, _ := ReadRecord(page, packedSlot); !bytes.Equal(data, packed) {
+		t.Fatal("flag changed the stored bytes")
+	}
+}
@@ -0,0 +1,145 @@
+package record
+
+import (
+	"encoding/binary"
+	"fmt"
+	"nanodb/internal/storage"
+)
+
+// documents that do not fit on an empty data page are written to a chain
+// of overflow pages. the slot keeps an 8-byte stub instead:
+// [total length 4] [first overflow page 4]
+//
+// overflow page layout: [next page 4] [bytes used 4] [data]
+
+const OverflowFlag uint32 = 0x80000000 // set in a record's data length
+
+const OverflowHeaderSize = 8
+
+const overflowStubSize = 8
+
+// MaxInlineSize is the largest document stored directly in a data page
+// with the given usable page size
+func MaxInlineSize(usableSize int) int {
+	// page header, one slot and the record header
+	return min(usableSize-8-4-12, int(^DeletedFlag)-12)
+}
+
+func EncodeOverflowStub(length uint32, firstPage uint32) []byte {
+	stub := make([]byte, overflowStubSize)
+	writeUint32(stub[0:4], length)
+	writeUint32(stub[4:8], firstPage)
+	return stub
+}
+
+func DecodeOverflowStub(stub []byte) (uint32, uint32) {
+	return binary.LittleEndian.Uint32(stub[0:4]), binary.LittleEndian.Uint32(stub[4:8])
+}
+
+// OverflowRoot returns the first overflow page of a live slot, or 0 if the
+// document is stored inline
+func OverflowRoot(page []byte, slot uint16) uint32 {
+	slotOffset := 8 + slot*4
+
+	offset := binary.LittleEndian.Uint16(page[slotOffset:])
+	recordLen := binary.LittleEndian.Uint16(page[slotOffset+2:])
+
+	if isDeleted(recordLen) {
+		return 0
+	}
+
+	if binary.LittleEndian.Uint32(page[offset+8:])&OverflowFlag == 0 {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(page[offset+16:])
+}
+
+// WriteOverflow stores data in a freshly allocated page chain and returns
+// its first page
+func WriteOverflow(p storage.PageStore, h *storage.DBHeader, data []byte) (uint32, error) {
+	chunkSize := p.UsableSize() - OverflowHeaderSize
+
+	first, err := p.AllocatePage(h)
+	if err != nil {
+		return 0, err
+	}
+
+	curr := first
+	for curr != 0 {
+		n := min(chunkSize, len(data))
+
+		var next uint32
+		if n < len(data) {
+			next, err = p.AllocatePage(h)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		page := p.GetBuff()
+		writeUint32(page[0:4], next)
+		writeUint32(page[4:8], uint32(n))
+		copy(page[OverflowHeaderSize:], data[:n])
+
+		err := p.WritePage(curr, storage.PageTypeOverflow, page)
+		storage.ReleasePageBuffer(page)
+		if err != nil {
+			return 0, err
+		}
+
+		data = data[n:]
+		curr = next
+	}
+
+	return first, nil
+}
+
+func ReadOverflow(p storage.PageStore, firstPage uint32, length uint32) ([]byte, error) {
+	data := make([]byte, 0, length)
+
+	curr := firstPage
+	for curr != 0 {
+		page, err := p.PinPage(curr)
+		if err != nil {
+			return nil, err
+		}
+
+		used := binary.LittleEndian.Uint32(page[4:8])
+		if int(used) > len(page)-OverflowHeaderSize || len(data)+int(used) > int(length) {
+			p.UnpinPage(curr)
+			return nil, fmt.Errorf("overflow page %d holds %d bytes, chain is corrupt", curr, used)
+		}
+
+		data = append(data, page[OverflowHeaderSize:OverflowHeaderSize+used]...)
+		next := binary.LittleEndian.Uint32(page[0:4])
+		p.UnpinPage(curr)
+
+		curr = next
+	}
+
+	if len(data) != int(length) {
+		return nil, fmt.Errorf("overflow chain at page %d holds %d of %d bytes", firstPage, len(data), length)
+	}
+
+	return data, nil
+}
+
+// FreeOverflow returns every page of an overflow chain to the free list
+func FreeOverflow(p storage.PageStore, h *storage.DBHeader, firstPage uint32) error {
+	curr := firstPage
+	for curr != 0 {
+		page, err := p.PinPage(curr)
+		if err != nil {
+			return err
+		}
+		next := binary.LittleEndian.Uint32(page[0:4])
+		p.UnpinPage(curr)
+
+		if err := p.FreePage(h, curr); err != nil {
+			return err
+		}
+		curr = next
+	}
+	return nil
+}
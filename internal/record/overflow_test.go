@@ -0,0 +1,105 @@
+package record
+
+import (
+	"bytes"
+	"math/rand"
+	"nanodb/internal/storage"
+	"testing"
+)
+
+// newTestStore returns an empty in-memory database inside a write
+func newTestStore(t *testing.T) (storage.PageStore, *storage.DBHeader) {
+	t.Helper()
+	p, err := storage.NewMemPager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Begin()
+	t.Cleanup(func() { p.Commit() })
+
+	h := &storage.DBHeader{Magic: storage.Magic, Version: storage.FormatVersion, PageSize: uint32(p.PageSize()), PageCount: 1}
+	if err := p.WriteHeader(h); err != nil {
+		t.Fatal(err)
+	}
+	return p, h
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestOverflowChain(t *testing.T) {
+	p, h := newTestStore(t)
+	data := randomBytes(3*p.UsableSize() + 123)
+
+	first, err := WriteOverflow(p, h, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := h.PageCount - 1
+
+	got, err := ReadOverflow(p, first, uint32(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("overflow chain does not read back what was written")
+	}
+
+	if err := FreeOverflow(p, h, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// the freed chain is reused before the file grows
+	if _, err := WriteOverflow(p, h, data); err != nil {
+		t.Fatal(err)
+	}
+	if h.PageCount-1 != pages {
+		t.Fatalf("second chain grew the file to %d pages, want %d", h.PageCount, pages+1)
+	}
+}
+
+func TestOverflowStubInSlot(t *testing.T) {
+	p, h := newTestStore(t)
+	data := randomBytes(2 * p.UsableSize())
+
+	first, err := WriteOverflow(p, h, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := p.GetBuff()
+	defer storage.ReleasePageBuffer(page)
+	storage.InitDataPage(page)
+
+	slot, ok, err := InsertOverflowStub(page, 42, EncodeOverflowStub(uint32(len(data)), first))
+	if err != nil || !ok {
+		t.Fatalf("stub not inserted: %v", err)
+	}
+	if root := OverflowRoot(page, slot); root != first {
+		t.Fatalf("slot points at page %d, want %d", root, first)
+	}
+
+	docId, got, deleted, err := LoadRecord(p, page, slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docId != 42 || deleted || !bytes.Equal(got, data) {
+		t.Fatal("stubbed record does not load the whole document")
+	}
+}
+
+func TestMaxInlineSize(t *testing.T) {
+	for _, usable := range []int{4096 - storage.PagePrologueSize, 65536 - storage.PagePrologueSize} {
+		max := MaxInlineSize(usable)
+
+		page := make([]byte, usable)
+		storage.InitDataPage(page)
+		if _, ok, err := InsertRecord(page, 1, make([]byte, max)); err != nil || !ok {
+			t.Fatalf("%d byte record does not fit a %d byte page: %v", max, usable, err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package record
 
 import (
 	"encoding/binary"
+	"fmt"
 	"nanodb/internal/storage"
 
 	"github.com/vmihailenco/msgpack/v5"
@@ -14,10 +15,15 @@ type Slot struct {
 	Length uint16
 }
 
+// collection flags kept in its catalog entry
+const CollectionCompressed uint8 = 1
+
 type CollectionEntry struct {
 	Name      string
 	RootPage  uint32
 	IndexRoot uint32
+	FsmRoot   uint32
+	Flags     uint8
 	PageId    uint32
 	Slot      uint16
 }
@@ -50,46 +56,162 @@ func DecodeDoc(data []byte) (map[string]any, error) {
 	return doc, err
 }
 
+// InsertRecord stores a document on the page and returns the slot it was
+// given. Deleted slot entries are reused, and the page is compacted when
+// the record only fits once dead records are reclaimed.
 func InsertRecord(
 	page []byte,
 	docId uint64,
 	data []byte,
-) (bool, error) {
+) (uint16, bool, error) {
+	return insertRecord(page, docId, uint32(len(data)), data)
+}
 
-	slotCount := binary.LittleEndian.Uint16(page[0:2])
-	freeStart := binary.LittleEndian.Uint16(page[2:4])
+// InsertOverflowStub stores the stub of a document that lives in an
+// overflow chain, see WriteOverflow
+func InsertOverflowStub(page []byte, docId uint64, stub []byte) (uint16, bool, error) {
+	return insertRecord(page, docId, uint32(len(stub))|OverflowFlag, stub)
+}
 
-	recordSize := uint16(12 + len(data))
-	slotLength := uint16(4)
+// InsertRecordFlags is InsertRecord for data that is an overflow stub or
+// compressed, as described by flags (OverflowFlag, CompressedFlag)
+func InsertRecordFlags(page []byte, docId uint64, data []byte, flags uint32) (uint16, bool, error) {
+	return insertRecord(page, docId, uint32(len(data))|flags, data)
+}
 
-	requiredSpace := recordSize + slotLength
+func insertRecord(page []byte, docId uint64, lenField uint32, data []byte) (uint16, bool, error) {
 
-	headeEnd := uint16(8 + slotCount*4)
+	// the top bit of a slot length is the deleted flag
+	if 12+len(data) > int(^DeletedFlag) {
+		return 0, false, nil
+	}
 
-	if freeStart < headeEnd+requiredSpace {
-		return false, nil // page full
+	recordSize := 12 + len(data)
+
+	slot, reuse := findDeletedSlot(page)
+	if FreeSpace(page) < requiredSpace(recordSize, reuse) {
+		if FreeSpace(page)+DeadSpace(page) < requiredSpace(recordSize, reuse) {
+			return 0, false, nil // page full
+		}
+
+		CompactPage(page)
+
+		// compaction drops trailing tombstones, so the free slot may be gone
+		slot, reuse = findDeletedSlot(page)
+		if FreeSpace(page) < requiredSpace(recordSize, reuse) {
+			return 0, false, nil
+		}
 	}
 
+	slotCount := binary.LittleEndian.Uint16(page[0:2])
+	freeStart := binary.LittleEndian.Uint16(page[2:4])
+
 	//write record
-	recordOffset := freeStart - recordSize
+	recordOffset := freeStart - uint16(recordSize)
 	writeUint64(page[recordOffset:], docId)
-	writeUint32(page[recordOffset+8:], uint32(len(data)))
+	writeUint32(page[recordOffset+8:], lenField)
 	copy(page[recordOffset+12:], data)
 
+	if !reuse {
+		slot = slotCount
+		slotCount++
+	}
+
 	//write slot
-	slotOffset := 8 + slotCount*4
+	slotOffset := 8 + slot*4
 	writeUint16(page[slotOffset:], recordOffset)
-	writeUint16(page[slotOffset+2:], recordSize)
+	writeUint16(page[slotOffset+2:], uint16(recordSize))
 
 	//update page header
-	slotCount++
 	freeStart = recordOffset
 	writeUint16(page[0:2], slotCount)
 	writeUint16(page[2:4], freeStart)
 
-	return true, nil
+	return slot, true, nil
+}
+
+// requiredSpace counts a new slot entry unless a deleted one is reused
+func requiredSpace(recordSize int, reuse bool) int {
+	if reuse {
+		return recordSize
+	}
+	return recordSize + 4
 }
 
+// findDeletedSlot returns the first tombstoned slot entry on the page
+func findDeletedSlot(page []byte) (uint16, bool) {
+	slotCount := binary.LittleEndian.Uint16(page[0:2])
+
+	for slot := range slotCount {
+		if isDeleted(binary.LittleEndian.Uint16(page[10+slot*4:])) {
+			return slot, true
+		}
+	}
+	return 0, false
+}
+
+// FreeSpace is the gap between the slot array and the record area
+func FreeSpace(page []byte) int {
+	slotCount := binary.LittleEndian.Uint16(page[0:2])
+	freeStart := binary.LittleEndian.Uint16(page[2:4])
+
+	return int(freeStart) - (8 + int(slotCount)*4)
+}
+
+// DeadSpace is the number of bytes in the record area that no live slot
+// points at, which CompactPage would give back
+func DeadSpace(page []byte) int {
+	slotCount := binary.LittleEndian.Uint16(page[0:2])
+	freeStart := binary.LittleEndian.Uint16(page[2:4])
+
+	live := 0
+	for slot := range slotCount {
+		recordLen := binary.LittleEndian.Uint16(page[10+slot*4:])
+		if !isDeleted(recordLen) {
+			live += int(recordLen)
+		}
+	}
+
+	return len(page) - int(freeStart) - live
+}
+
+// CompactPage slides the live records to the end of the page so that the
+// space of deleted ones joins the free gap. Slot ids do not change, which
+// keeps index entries valid; deleted slots are left as empty tombstones
+// for InsertRecord to reuse, and those at the end of the array are dropped.
+func CompactPage(page []byte) {
+	slotCount := binary.LittleEndian.Uint16(page[0:2])
+
+	// records are copied out first since live ones may overlap their new place
+	scratch := make([]byte, len(page))
+	copy(scratch, page)
+
+	freeStart := uint16(len(page))
+	liveCount := uint16(0)
+
+	for slot := range slotCount {
+		slotOffset := 8 + slot*4
+		offset := binary.LittleEndian.Uint16(scratch[slotOffset:])
+		recordLen := binary.LittleEndian.Uint16(scratch[slotOffset+2:])
+
+		if isDeleted(recordLen) {
+			writeUint16(page[slotOffset:], 0)
+			writeUint16(page[slotOffset+2:], DeletedFlag)
+			continue
+		}
+
+		freeStart -= recordLen
+		copy(page[freeStart:], scratch[offset:offset+recordLen])
+		writeUint16(page[slotOffset:], freeStart)
+		liveCount = slot + 1
+	}
+
+	writeUint16(page[0:2], liveCount)
+	writeUint16(page[2:4], freeStart)
+}
+
+// ReadRecord returns the bytes stored in a slot. For a document kept in
+// overflow pages that is its stub; LoadRecord follows the chain instead.
 func ReadRecord(page []byte, slot uint16) (uint64, []byte, bool) {
 	slotOffset := 8 + slot*4
 
@@ -101,7 +223,7 @@ func ReadRecord(page []byte, slot uint16) (uint64, []byte, bool) {
 	}
 
 	docId := binary.LittleEndian.Uint64(page[offset:])
-	dataLen := binary.LittleEndian.Uint32(page[offset+8:])
+	dataLen := binary.LittleEndian.Uint32(page[offset+8:]) & ^(OverflowFlag | CompressedFlag)
 
 	data := make([]byte, dataLen)
 	copy(data, page[offset+12:offset+12+uint16(dataLen)])
@@ -109,24 +231,94 @@ func ReadRecord(page []byte, slot uint16) (uint64, []byte, bool) {
 	return docId, data, false
 }
 
-func EncodeCollectionEntry(name string, root uint32, indexRoot uint32) []byte { // [name length (1 byte), name (n bytes), root page (4 bytes), index page (4 bytes)]
-	buff := make([]byte, len(name)+9)
-	buff[0] = byte(len(name))    // name length
-	copy(buff[1:], []byte(name)) // name
-	writeUint32(buff[1+len(name):], root)
-	writeUint32(buff[5+len(name):], indexRoot)
+// LoadRecord reads a slot like ReadRecord but returns the whole document
+// when it was spilled into overflow pages, inflated if it was compressed
+func LoadRecord(p storage.PageStore, page []byte, slot uint16) (uint64, []byte, bool, error) {
+	docId, data, deleted := ReadRecord(page, slot)
+	if deleted {
+		return docId, data, deleted, nil
+	}
+
+	var err error
+	if OverflowRoot(page, slot) != 0 {
+		length, first := DecodeOverflowStub(data)
+		data, err = ReadOverflow(p, first, length)
+		if err != nil {
+			return 0, nil, false, err
+		}
+	}
+
+	if IsCompressed(page, slot) {
+		data, err = Decompress(data)
+		if err != nil {
+			return 0, nil, false, fmt.Errorf("record %d: %w", docId, err)
+		}
+	}
+
+	return docId, data, false, nil
+}
+
+// MaxCollectionNameLen is the longest collection name, short enough for
+// its catalog entry to fit a page of the smallest size
+const MaxCollectionNameLen = 1024
+
+func EncodeCollectionEntry(name string, root uint32, indexRoot uint32, fsmRoot uint32, flags uint8) []byte { // [name length (2 bytes), name (n bytes), root page (4 bytes), index page (4 bytes), fsm page (4 bytes), flags (1 byte)]
+	buff := make([]byte, len(name)+15)
+	writeUint16(buff, uint16(len(name))) // name length
+	copy(buff[2:], []byte(name))         // name
+	writeUint32(buff[2+len(name):], root)
+	writeUint32(buff[6+len(name):], indexRoot)
+	writeUint32(buff[10+len(name):], fsmRoot)
+	buff[14+len(name)] = flags
 	return buff
 }
 
 func DecodeCollectionEntry(data []byte) CollectionEntry {
+	nameLen := int(binary.LittleEndian.Uint16(data[0:2]))
+	name := string(data[2 : 2+nameLen])
+	return CollectionEntry{
+		Name:      name,
+		RootPage:  binary.LittleEndian.Uint32(data[2+nameLen:]),
+		IndexRoot: binary.LittleEndian.Uint32(data[6+nameLen:]),
+		FsmRoot:   binary.LittleEndian.Uint32(data[10+nameLen:]),
+		Flags:     data[14+nameLen],
+	}
+}
+
+// decodeOldCollectionEntry decodes an entry written before format 5, whose
+// name length is a single byte
+func decodeOldCollectionEntry(data []byte) CollectionEntry {
 	nameLen := int(data[0])
 	name := string(data[1 : 1+nameLen])
 	root := binary.LittleEndian.Uint32(data[1+nameLen : 5+nameLen])
 	indexRoot := binary.LittleEndian.Uint32(data[5+nameLen:])
-	return CollectionEntry{Name: name, RootPage: root, IndexRoot: indexRoot}
+
+	// entries written before format 3 have no free-space map
+	var fsmRoot uint32
+	if len(data) >= 13+nameLen {
+		fsmRoot = binary.LittleEndian.Uint32(data[9+nameLen:])
+	}
+
+	// and before format 4 no flags
+	var flags uint8
+	if len(data) >= 14+nameLen {
+		flags = data[13+nameLen]
+	}
+
+	return CollectionEntry{Name: name, RootPage: root, IndexRoot: indexRoot, FsmRoot: fsmRoot, Flags: flags}
+}
+
+func GetAllCollections(p storage.PageStore) ([]CollectionEntry, error) {
+	return GetCollectionsOfVersion(p, storage.FormatVersion)
 }
 
-func GetAllCollections(p *storage.Pager) ([]CollectionEntry, error) {
+// GetCollectionsOfVersion reads the catalog of a database in an older
+// format, for nanodb upgrade to copy
+func GetCollectionsOfVersion(p storage.PageStore, version uint16) ([]CollectionEntry, error) {
+	decode := DecodeCollectionEntry
+	if version < 5 {
+		decode = decodeOldCollectionEntry
+	}
 
 	currPageId := uint32(1)
 	var collections []CollectionEntry
@@ -146,8 +338,8 @@ func GetAllCollections(p *storage.Pager) ([]CollectionEntry, error) {
 				continue
 			}
 			// 2. Decode the specific CollectionEntry format
-			// [NameLen (1)] [Name] [RootPage (4)]
-			entry := DecodeCollectionEntry(data)
+			// [NameLen (2)] [Name] [RootPage (4)] [IndexRoot (4)] [FsmRoot (4)] [Flags (1)]
+			entry := decode(data)
 			entry.PageId = currPageId
 			entry.Slot = slot
 			collections = append(collections, entry)
@@ -160,6 +352,67 @@ func GetAllCollections(p *storage.Pager) ([]CollectionEntry, error) {
 	return collections, nil
 }
 
+// InsertCollectionEntry adds an encoded entry to the first catalog page
+// with room for it, extending the catalog chain when all are full
+func InsertCollectionEntry(p storage.PageStore, h *storage.DBHeader, entry []byte) (uint32, uint16, error) {
+	var currentPageNum uint32 = 1
+	for {
+		page, err := p.ReadPage(currentPageNum)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		slot, success, err := InsertRecord(page, 0, entry)
+		if err != nil {
+			storage.ReleasePageBuffer(page)
+			return 0, 0, err
+		}
+
+		// if success record inserted
+		if success {
+			err := p.WritePage(currentPageNum, storage.PageTypeCatalog, page)
+			storage.ReleasePageBuffer(page)
+			return currentPageNum, slot, err
+		}
+
+		//move to next page
+		nextPage := binary.LittleEndian.Uint32(page[4:8])
+
+		if nextPage != 0 {
+			currentPageNum = nextPage
+			storage.ReleasePageBuffer(page)
+			continue
+		}
+
+		// if no page then allocate new page for
+		newPageId, err := p.AllocatePage(h)
+		if err != nil {
+			storage.ReleasePageBuffer(page)
+			return 0, 0, err
+		}
+
+		emptyCatPage := p.GetBuff()
+		storage.InitDataPage(emptyCatPage)
+
+		if err := p.WritePage(newPageId, storage.PageTypeCatalog, emptyCatPage); err != nil {
+			storage.ReleasePageBuffer(page)
+			storage.ReleasePageBuffer(emptyCatPage)
+			return 0, 0, err
+		}
+
+		binary.LittleEndian.PutUint32(page[4:8], newPageId)
+
+		if err := p.WritePage(currentPageNum, storage.PageTypeCatalog, page); err != nil {
+			storage.ReleasePageBuffer(page)
+			storage.ReleasePageBuffer(emptyCatPage)
+			return 0, 0, err
+		}
+		currentPageNum = newPageId
+		storage.ReleasePageBuffer(page)
+		storage.ReleasePageBuffer(emptyCatPage)
+	}
+}
+
 func MarkSlotDeleted(page []byte, slotIdx uint16) {
 	lenOffset := 10 + slotIdx*4
 
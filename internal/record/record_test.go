@@ -0,0 +1,99 @@
+package record
+
+import (
+	"bytes"
+	"nanodb/internal/storage"
+	"testing"
+)
+
+func newDataPage() []byte {
+	page := make([]byte, 4096-storage.PagePrologueSize)
+	storage.InitDataPage(page)
+	return page
+}
+
+// fill inserts records of size bytes until the page is full and returns
+// their slots
+func fill(t *testing.T, page []byte, size int) []uint16 {
+	t.Helper()
+	var slots []uint16
+	for docId := uint64(1); ; docId++ {
+		slot, ok, err := InsertRecord(page, docId, bytes.Repeat([]byte{byte(docId)}, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return slots
+		}
+		slots = append(slots, slot)
+	}
+}
+
+func TestDeletedSlotIsReused(t *testing.T) {
+	page := newDataPage()
+	slots := fill(t, page, 100)
+
+	MarkSlotDeleted(page, slots[3])
+
+	slot, ok, err := InsertRecord(page, 99, make([]byte, 100))
+	if err != nil || !ok {
+		t.Fatalf("record does not fit in the room of a deleted one: %v", err)
+	}
+	if slot != slots[3] {
+		t.Fatalf("record went to slot %d, want the deleted slot %d", slot, slots[3])
+	}
+}
+
+func TestCompactionKeepsSlotIds(t *testing.T) {
+	page := newDataPage()
+	slots := fill(t, page, 200)
+
+	// every other record goes, none of the holes is big enough alone
+	for i := 0; i < len(slots); i += 2 {
+		MarkSlotDeleted(page, slots[i])
+	}
+	if DeadSpace(page) < 600 {
+		t.Fatalf("only %d dead bytes after the deletes", DeadSpace(page))
+	}
+
+	if _, ok, err := InsertRecord(page, 1000, make([]byte, 500)); err != nil || !ok {
+		t.Fatalf("record does not fit after compaction: %v", err)
+	}
+
+	for i := 1; i < len(slots); i += 2 {
+		docId, data, deleted := ReadRecord(page, slots[i])
+		if deleted || docId != uint64(i+1) || !bytes.Equal(data, bytes.Repeat([]byte{byte(i + 1)}, 200)) {
+			t.Fatalf("slot %d does not hold record %d after compaction", slots[i], i+1)
+		}
+	}
+}
+
+func TestCompactionDropsTrailingTombstones(t *testing.T) {
+	page := newDataPage()
+	slots := fill(t, page, 300)
+	last := slots[len(slots)-1]
+
+	MarkSlotDeleted(page, last)
+	MarkSlotDeleted(page, last-1)
+	CompactPage(page)
+
+	if DeadSpace(page) != 0 {
+		t.Fatalf("%d dead bytes left after compaction", DeadSpace(page))
+	}
+	if count := int(page[0]) | int(page[1])<<8; count != len(slots)-2 {
+		t.Fatalf("%d slots after compaction, want %d", count, len(slots)-2)
+	}
+}
+
+func TestFullPageRejectsRecord(t *testing.T) {
+	page := newDataPage()
+	fill(t, page, 100)
+
+	before := bytes.Clone(page)
+	if _, ok, err := InsertRecord(page, 1, make([]byte, 100)); err != nil || ok {
+		t.Fatalf("record inserted into a full page: %v", err)
+	}
+	if !bytes.Equal(page, before) {
+		t.Fatal("rejected insert changed the page")
+	}
+}
@@ -0,0 +1,453 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// pages copied per turn of the write lock, writers run between turns
+const backupBatchPages = 256
+
+// every backup has a manifest beside it, named like it with this suffix
+const ManifestSuffix = ".manifest"
+
+var ErrNoBaseBackup = errors.New("no full backup taken since change tracking began")
+
+// BackupManifest describes a backup. A full backup is a database file; an
+// incremental one holds only the pages written since the backup before
+// it, one after another in the order of Pages.
+type BackupManifest struct {
+	Database   string   `json:"database"`         // change tracker id of the source, empty if it had none
+	Generation uint64   `json:"generation"`       // 0 if the backup cannot be built on
+	Parent     uint64   `json:"parent,omitempty"` // generation an incremental backup applies on top of
+	PageSize   int      `json:"pageSize"`
+	PageCount  uint32   `json:"pageCount"`
+	Pages      []uint32 `json:"pages,omitempty"`
+}
+
+func (m *BackupManifest) Incremental() bool {
+	return m.Parent != 0
+}
+
+// Backup writes a consistent copy of the committed database to a new file
+// at path while writers keep going. Pages are copied in batches between
+// transactions. Pages written after they were copied are copied again, the
+// last of them under the write lock together with the final page count, so
+// the copy matches the database as of a single commit. The copy is a
+// database file without a log and, if the database is encrypted, stays
+// encrypted with the same passphrase.
+func (p *Pager) Backup(path string) error {
+	return p.writeBackup(path, false)
+}
+
+// BackupIncremental works like Backup but only copies the pages written
+// since the last backup, full or incremental
+func (p *Pager) BackupIncremental(path string) error {
+	return p.writeBackup(path, true)
+}
+
+func (p *Pager) writeBackup(path string, incremental bool) error {
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	m, err := p.backupTo(out, incremental)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = writeManifest(path, m)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func (p *Pager) backupTo(out *os.File, incremental bool) (*BackupManifest, error) {
+	p.txMu.Lock()
+	if p.backup != nil {
+		p.txMu.Unlock()
+		return nil, fmt.Errorf("a backup is already running")
+	}
+
+	if incremental && p.changes == nil {
+		p.txMu.Unlock()
+		return nil, ErrReadOnly
+	}
+	if incremental && p.changes.generation == 0 {
+		p.txMu.Unlock()
+		return nil, ErrNoBaseBackup
+	}
+
+	h, err := readHeader(p)
+	if err != nil {
+		p.txMu.Unlock()
+		return nil, err
+	}
+
+	// a full backup copies pages 0 to count in order, an incremental one
+	// the pages in todo
+	count := int(h.PageCount)
+	var todo []uint32
+	if incremental {
+		// logged pages only reach the tracker at the next checkpoint
+		changed := make(map[uint32]struct{})
+		for _, pageNum := range append(p.changes.pages(), p.wal.Pages()...) {
+			if pageNum < h.PageCount {
+				changed[pageNum] = struct{}{}
+			}
+		}
+		todo = slices.Sorted(maps.Keys(changed))
+		count = len(todo)
+	}
+
+	p.backup = make(map[uint32]struct{})
+	p.txMu.Unlock()
+
+	defer func() {
+		p.txMu.Lock()
+		p.backup = nil
+		p.txMu.Unlock()
+	}()
+
+	m := &BackupManifest{PageSize: p.pageSize}
+	slots := make(map[uint32]int64) // where an incremental backup put each page
+
+	raw := make([]byte, p.pageSize)
+	copyPage := func(pageNum uint32) error {
+		if err := p.wal.ReadPage(pageNum, raw, p.file); err != nil {
+			return err
+		}
+		if err := verifyChecksum(pageNum, raw); err != nil {
+			return err
+		}
+
+		offset := int64(pageNum) * int64(p.pageSize)
+		if incremental {
+			var ok bool
+			if offset, ok = slots[pageNum]; !ok {
+				offset = int64(len(m.Pages)) * int64(p.pageSize)
+				slots[pageNum] = offset
+				m.Pages = append(m.Pages, pageNum)
+			}
+		}
+
+		_, err := out.WriteAt(raw, offset)
+		return err
+	}
+
+	var next int // first entry the sequential pass has not reached
+	for {
+		p.txMu.Lock()
+
+		// between transactions every committed page is in the log or the file
+		final := next >= count && len(p.backup) <= backupBatchPages
+		copied := 0
+
+		for pageNum := range p.backup {
+			if !final && copied == backupBatchPages {
+				break
+			}
+			if err := copyPage(pageNum); err != nil {
+				p.txMu.Unlock()
+				return nil, err
+			}
+			delete(p.backup, pageNum)
+			copied++
+		}
+
+		for ; next < count && copied < backupBatchPages; next++ {
+			pageNum := uint32(next)
+			if incremental {
+				pageNum = todo[next]
+			}
+			if err := copyPage(pageNum); err != nil {
+				p.txMu.Unlock()
+				return nil, err
+			}
+			copied++
+		}
+
+		if final {
+			err := p.finishBackup(out, m, incremental)
+			p.txMu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return m, nil
+		}
+
+		p.txMu.Unlock()
+	}
+}
+
+// finishBackup runs under the write lock once the copy is complete and
+// starts a new generation, so the next incremental backup holds the pages
+// written from here on
+func (p *Pager) finishBackup(out *os.File, m *BackupManifest, incremental bool) error {
+	h, err := readHeader(p)
+	if err != nil {
+		return err
+	}
+	m.PageCount = h.PageCount
+
+	if !incremental {
+		if err := out.Truncate(int64(h.PageCount) * int64(p.pageSize)); err != nil {
+			return err
+		}
+	}
+
+	// the copy must be on disk before the tracker forgets what it holds
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	// a read-only database cannot start a generation, its backup is
+	// complete but nothing can be applied on top of it
+	if p.changes == nil {
+		return nil
+	}
+
+	// the logged pages are in the copy, checkpointed now they are marked
+	// in the generation that ends here rather than in the next one
+	if err := checkpoint(p.wal, p.file, p.changes); err != nil {
+		return err
+	}
+
+	parent := p.changes.generation
+	if err := p.changes.reset(); err != nil {
+		return err
+	}
+
+	m.Database = p.changes.id
+	m.Generation = p.changes.generation
+	if incremental {
+		m.Parent = parent
+	}
+	return nil
+}
+
+// Backup writes every page to a new database file at path. Nothing tracks
+// changes in memory, so the backup cannot be built on.
+func (m *MemPager) Backup(path string) error {
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := m.backupTo(out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = writeManifest(path, manifest)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func (m *MemPager) backupTo(out *os.File) (*BackupManifest, error) {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	h, err := readHeader(m)
+	if err != nil {
+		return nil, err
+	}
+
+	for pageNum := range h.PageCount {
+		body, err := m.PinPage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		pr, err := m.Prologue(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := out.WriteAt(encodePage(pr, body), int64(pageNum)*int64(m.pageSize)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := out.Sync(); err != nil {
+		return nil, err
+	}
+	return &BackupManifest{PageSize: m.pageSize, PageCount: h.PageCount}, nil
+}
+
+func (m *MemPager) BackupIncremental(path string) error {
+	return fmt.Errorf("in-memory databases do not track changed pages")
+}
+
+func writeManifest(path string, m *BackupManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path+ManifestSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ManifestSuffix)
+	}
+	return err
+}
+
+// ReadManifest reads the manifest of the backup at path
+func ReadManifest(path string) (*BackupManifest, error) {
+	data, err := os.ReadFile(path + ManifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &BackupManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s%s: %w", path, ManifestSuffix, err)
+	}
+	return m, nil
+}
+
+// Restore builds a database at target from a full backup followed by
+// incremental backups, each of which must apply on top of the one before.
+// Every page is checked against its checksum on the way.
+func Restore(target string, backups []string) error {
+	if len(backups) == 0 {
+		return fmt.Errorf("restore needs a full backup")
+	}
+
+	manifests := make([]*BackupManifest, len(backups))
+	for i, path := range backups {
+		m, err := ReadManifest(path)
+		if err != nil {
+			return err
+		}
+		manifests[i] = m
+
+		if i == 0 {
+			if m.Incremental() {
+				return fmt.Errorf("%s is an incremental backup, restore starts from a full one", path)
+			}
+			continue
+		}
+
+		prev := manifests[i-1]
+		switch {
+		case !m.Incremental():
+			return fmt.Errorf("%s is a full backup, only incremental ones can follow the first", path)
+		case m.Database != prev.Database || m.Parent != prev.Generation || prev.Generation == 0:
+			return fmt.Errorf("%s does not apply on top of %s", path, backups[i-1])
+		case m.PageSize != prev.PageSize:
+			return fmt.Errorf("%s has %d byte pages, %s has %d", path, m.PageSize, backups[i-1], prev.PageSize)
+		}
+	}
+
+	if _, err := os.Stat(target + "-wal"); err == nil {
+		return fmt.Errorf("restore to %s: a log for it already exists", target)
+	}
+
+	out, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = restoreTo(out, backups, manifests)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(target)
+		return err
+	}
+
+	return SyncDir(filepath.Dir(target))
+}
+
+func restoreTo(out *os.File, backups []string, manifests []*BackupManifest) error {
+	base := manifests[0]
+	pageSize := int64(base.PageSize)
+
+	in, err := os.Open(backups[0])
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if info, err := in.Stat(); err != nil {
+		return err
+	} else if info.Size() != int64(base.PageCount)*pageSize {
+		return fmt.Errorf("%s holds %d bytes, its manifest says %d pages", backups[0], info.Size(), base.PageCount)
+	}
+
+	raw := make([]byte, pageSize)
+	for pageNum := range base.PageCount {
+		offset := int64(pageNum) * pageSize
+		if _, err := in.ReadAt(raw, offset); err != nil {
+			return err
+		}
+		if err := verifyChecksum(pageNum, raw); err != nil {
+			return fmt.Errorf("%s: %w", backups[0], err)
+		}
+		if _, err := out.WriteAt(raw, offset); err != nil {
+			return err
+		}
+	}
+
+	for i := 1; i < len(backups); i++ {
+		if err := applyIncremental(out, backups[i], manifests[i], raw); err != nil {
+			return err
+		}
+	}
+
+	last := manifests[len(manifests)-1]
+	if err := out.Truncate(int64(last.PageCount) * pageSize); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func applyIncremental(out *os.File, path string, m *BackupManifest, raw []byte) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	pageSize := int64(len(raw))
+	if info, err := in.Stat(); err != nil {
+		return err
+	} else if info.Size() != int64(len(m.Pages))*pageSize {
+		return fmt.Errorf("%s holds %d bytes, its manifest lists %d pages", path, info.Size(), len(m.Pages))
+	}
+
+	for i, pageNum := range m.Pages {
+		if _, err := in.ReadAt(raw, int64(i)*pageSize); err != nil {
+			return err
+		}
+		if err := verifyChecksum(pageNum, raw); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if _, err := out.WriteAt(raw, int64(pageNum)*pageSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
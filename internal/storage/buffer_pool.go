@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+)
+
+const DefaultCachePages = 1024
+
+// a frame's data slice is never modified once published. WritePage swaps
+// in a fresh slice so pinned readers keep a stable image.
+type frame struct {
+	pageNum  uint32
+	prologue PagePrologue
+	data     []byte
+	dirty    bool
+	pins     int
+	elem     *list.Element
+}
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Pages     int
+}
+
+type bufferPool struct {
+	mu       sync.Mutex
+	capacity int
+	pageSize int // size of the page bodies held in frames
+	frames   map[uint32]*frame
+	lru      *list.List // front is most recently used
+	store    func(pageNum uint32, pr PagePrologue, data []byte) error
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// store is called with every dirty frame that has to leave the pool
+func newBufferPool(capacity int, pageSize int, store func(pageNum uint32, pr PagePrologue, data []byte) error) *bufferPool {
+	return &bufferPool{
+		capacity: capacity,
+		pageSize: pageSize,
+		frames:   make(map[uint32]*frame),
+		lru:      list.New(),
+		store:    store,
+	}
+}
+
+// pin returns the cached image of pageNum and its prologue, loading them
+// with load on a miss. The frame stays resident until it is unpinned.
+func (bp *bufferPool) pin(pageNum uint32, load func([]byte) (PagePrologue, error)) ([]byte, PagePrologue, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if f, ok := bp.frames[pageNum]; ok {
+		bp.hits++
+		f.pins++
+		bp.lru.MoveToFront(f.elem)
+		return f.data, f.prologue, nil
+	}
+
+	bp.misses++
+
+	data := make([]byte, bp.pageSize)
+	pr, err := load(data)
+	if err != nil {
+		return nil, PagePrologue{}, err
+	}
+
+	f := bp.insert(pageNum, pr, data)
+	f.pins++
+
+	// a caller that gets an error does not unpin, so the frame goes again
+	if err := bp.evict(); err != nil {
+		bp.lru.Remove(f.elem)
+		delete(bp.frames, pageNum)
+		return nil, PagePrologue{}, err
+	}
+	return data, pr, nil
+}
+
+func (bp *bufferPool) unpin(pageNum uint32) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if f, ok := bp.frames[pageNum]; ok && f.pins > 0 {
+		f.pins--
+	}
+}
+
+// put installs a copy of data as the newest image of pageNum and marks it dirty
+func (bp *bufferPool) put(pageNum uint32, pr PagePrologue, data []byte) error {
+	image := make([]byte, bp.pageSize)
+	copy(image, data)
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if f, ok := bp.frames[pageNum]; ok {
+		f.prologue = pr
+		f.data = image
+		f.dirty = true
+		bp.lru.MoveToFront(f.elem)
+		return nil
+	}
+
+	f := bp.insert(pageNum, pr, image)
+	f.dirty = true
+
+	return bp.evict()
+}
+
+func (bp *bufferPool) insert(pageNum uint32, pr PagePrologue, data []byte) *frame {
+	f := &frame{pageNum: pageNum, prologue: pr, data: data}
+	f.elem = bp.lru.PushFront(f)
+	bp.frames[pageNum] = f
+	return f
+}
+
+// evict drops least recently used frames until the pool is back within
+// capacity, storing dirty ones first. Pinned frames are
+// skipped, so the pool can briefly run over capacity.
+func (bp *bufferPool) evict() error {
+	elem := bp.lru.Back()
+
+	for len(bp.frames) > bp.capacity && elem != nil {
+		f := elem.Value.(*frame)
+		prev := elem.Prev()
+
+		if f.pins == 0 {
+			if f.dirty {
+				if err := bp.store(f.pageNum, f.prologue, f.data); err != nil {
+					return err
+				}
+			}
+
+			bp.lru.Remove(elem)
+			delete(bp.frames, f.pageNum)
+			bp.evictions++
+		}
+
+		elem = prev
+	}
+
+	return nil
+}
+
+// flush stores every dirty frame
+func (bp *bufferPool) flush() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	for elem := bp.lru.Back(); elem != nil; elem = elem.Prev() {
+		f := elem.Value.(*frame)
+		if !f.dirty {
+			continue
+		}
+
+		if err := bp.store(f.pageNum, f.prologue, f.data); err != nil {
+			return err
+		}
+		f.dirty = false
+	}
+
+	return nil
+}
+
+// rollback drops every dirty frame along with the frames of pages, whose
+// newer images were cut from the log
+func (bp *bufferPool) rollback(pages []uint32) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	for n, f := range bp.frames {
+		if f.dirty {
+			bp.lru.Remove(f.elem)
+			delete(bp.frames, n)
+		}
+	}
+	for _, n := range pages {
+		if f, ok := bp.frames[n]; ok {
+			bp.lru.Remove(f.elem)
+			delete(bp.frames, n)
+		}
+	}
+}
+
+// discard drops the frames of pageNum and every page after it, which must
+// be clean. It is used when the file shrinks below them.
+func (bp *bufferPool) discard(pageNum uint32) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	for n, f := range bp.frames {
+		if n >= pageNum {
+			bp.lru.Remove(f.elem)
+			delete(bp.frames, n)
+		}
+	}
+}
+
+func (bp *bufferPool) stats() CacheStats {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	return CacheStats{
+		Hits:      bp.hits,
+		Misses:    bp.misses,
+		Evictions: bp.evictions,
+		Pages:     len(bp.frames),
+	}
+}
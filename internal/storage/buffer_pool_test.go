@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+const testBodySize = 64
+
+// testPool is a pool over a map standing in for the log
+type testPool struct {
+	*bufferPool
+	stored map[uint32][]byte
+	err    error // returned by the store when set
+}
+
+func newTestPool(capacity int) *testPool {
+	tp := &testPool{stored: make(map[uint32][]byte)}
+	tp.bufferPool = newBufferPool(capacity, testBodySize, func(pageNum uint32, pr PagePrologue, data []byte) error {
+		if tp.err != nil {
+			return tp.err
+		}
+		tp.stored[pageNum] = bytes.Clone(data)
+		return nil
+	})
+	return tp
+}
+
+func (tp *testPool) load(t *testing.T, pageNum uint32) []byte {
+	t.Helper()
+	data, _, err := tp.pin(pageNum, func(body []byte) (PagePrologue, error) {
+		body[0] = byte(pageNum)
+		return PagePrologue{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func (tp *testPool) resident(pageNum uint32) bool {
+	_, ok := tp.frames[pageNum]
+	return ok
+}
+
+func TestBufferPoolEvictsLeastRecentlyUsed(t *testing.T) {
+	tp := newTestPool(2)
+
+	tp.load(t, 1)
+	tp.unpin(1)
+	tp.load(t, 2)
+	tp.unpin(2)
+	tp.load(t, 1) // 2 is now the least recently used
+	tp.unpin(1)
+	tp.load(t, 3)
+	tp.unpin(3)
+
+	if !tp.resident(1) || tp.resident(2) || !tp.resident(3) {
+		t.Fatal("page 2 was not the one evicted")
+	}
+
+	stats := tp.stats()
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 1 || stats.Pages != 2 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestBufferPoolStoresDirtyFramesOnEviction(t *testing.T) {
+	tp := newTestPool(1)
+
+	if err := tp.put(1, PagePrologue{}, bytes.Repeat([]byte{'d'}, testBodySize)); err != nil {
+		t.Fatal(err)
+	}
+	if len(tp.stored) != 0 {
+		t.Fatal("dirty frame stored before it was evicted")
+	}
+
+	tp.load(t, 2)
+	tp.unpin(2)
+
+	if !bytes.Equal(tp.stored[1], bytes.Repeat([]byte{'d'}, testBodySize)) {
+		t.Fatal("evicted dirty frame was not stored")
+	}
+	if _, ok := tp.stored[2]; ok {
+		t.Fatal("clean frame was stored")
+	}
+}
+
+func TestBufferPoolKeepsPinnedFrames(t *testing.T) {
+	tp := newTestPool(1)
+
+	pinned := tp.load(t, 1)
+	tp.load(t, 2)
+	tp.unpin(2)
+
+	if !tp.resident(1) {
+		t.Fatal("pinned frame was evicted")
+	}
+	if pinned[0] != 1 {
+		t.Fatal("pinned image changed")
+	}
+
+	tp.unpin(1)
+	tp.load(t, 3)
+	tp.unpin(3)
+	if tp.resident(1) {
+		t.Fatal("unpinned frame was kept over capacity")
+	}
+}
+
+func TestBufferPoolWriteLeavesPinnedImage(t *testing.T) {
+	tp := newTestPool(4)
+
+	pinned := tp.load(t, 1)
+	if err := tp.put(1, PagePrologue{}, bytes.Repeat([]byte{'n'}, testBodySize)); err != nil {
+		t.Fatal(err)
+	}
+
+	if pinned[0] != 1 {
+		t.Fatal("write changed the image a reader has pinned")
+	}
+	if data := tp.load(t, 1); data[0] != 'n' {
+		t.Fatal("write is not the newest image")
+	}
+}
+
+func TestBufferPoolFlushStoresDirtyFrames(t *testing.T) {
+	tp := newTestPool(4)
+
+	tp.put(1, PagePrologue{}, bytes.Repeat([]byte{'a'}, testBodySize))
+	tp.put(2, PagePrologue{}, bytes.Repeat([]byte{'b'}, testBodySize))
+	tp.load(t, 3)
+	tp.unpin(3)
+
+	if err := tp.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tp.stored) != 2 || tp.stored[1][0] != 'a' || tp.stored[2][0] != 'b' {
+		t.Fatalf("flush stored %d pages", len(tp.stored))
+	}
+
+	clear(tp.stored)
+	if err := tp.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tp.stored) != 0 {
+		t.Fatal("flushed frames are still dirty")
+	}
+}
+
+// a load whose eviction fails leaves no pinned frame behind
+func TestBufferPoolFailedEvictionUnpins(t *testing.T) {
+	tp := newTestPool(1)
+	tp.put(1, PagePrologue{}, bytes.Repeat([]byte{'d'}, testBodySize))
+
+	tp.err = errors.New("log full")
+	for range 3 {
+		if _, _, err := tp.pin(2, func([]byte) (PagePrologue, error) { return PagePrologue{}, nil }); err == nil {
+			t.Fatal("load did not report the failed eviction")
+		}
+	}
+	if tp.resident(2) {
+		t.Fatal("frame of a failed load stayed in the pool")
+	}
+
+	tp.err = nil
+	tp.load(t, 2)
+	tp.unpin(2)
+	tp.load(t, 3)
+	tp.unpin(3)
+	if stats := tp.stats(); stats.Pages != 1 {
+		t.Fatalf("%d frames in a pool of one", stats.Pages)
+	}
+}
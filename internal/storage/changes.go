@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// changes file layout: [magic 4] [crc 4] [generation 8] [id 16] [bitmap]
+// the crc covers generation and id
+
+const changesHeaderSize = 32
+
+var changesMagic = [4]byte{'N', 'D', 'B', 'C'}
+
+// changeTracker remembers which pages were written since the last backup,
+// one bit per page, in a file beside the database. Pages are marked when
+// the log is checkpointed and the bits reach the file before the log is
+// reset, so a crash can leave extra bits set but never lose one.
+//
+// Every backup starts a new generation with an empty bitmap. The id tells
+// apart the generations of different trackers, since a tracker that is
+// missing or damaged is replaced by a new one starting from generation 0.
+type changeTracker struct {
+	file       *os.File
+	sync       SyncMode
+	id         string
+	generation uint64 // of the last backup, 0 before the first
+	bits       []byte
+}
+
+func openChangeTracker(filename string, mode SyncMode) (*changeTracker, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	t := &changeTracker{sync: mode}
+	if !t.decode(data) {
+		// nothing is known about earlier backups, the next incremental
+		// backup needs a full one taken under the new id first
+		id := make([]byte, 16)
+		rand.Read(id)
+		t.id = hex.EncodeToString(id)
+
+		if err := t.rewrite(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	t.file, err = os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *changeTracker) decode(data []byte) bool {
+	if len(data) < changesHeaderSize || [4]byte(data[0:4]) != changesMagic {
+		return false
+	}
+	if crc32.Checksum(data[8:changesHeaderSize], castagnoli) != binary.LittleEndian.Uint32(data[4:8]) {
+		return false
+	}
+
+	t.generation = binary.LittleEndian.Uint64(data[8:16])
+	t.id = hex.EncodeToString(data[16:32])
+	t.bits = data[changesHeaderSize:]
+	return true
+}
+
+// rewrite replaces the file with the current generation and bitmap. The
+// new file is renamed into place, so a crash leaves either one or the other.
+func (t *changeTracker) rewrite(filename string) error {
+	data := make([]byte, changesHeaderSize+len(t.bits))
+	copy(data[0:4], changesMagic[:])
+	binary.LittleEndian.PutUint64(data[8:16], t.generation)
+	hex.Decode(data[16:32], []byte(t.id))
+	binary.LittleEndian.PutUint32(data[4:8], crc32.Checksum(data[8:changesHeaderSize], castagnoli))
+	copy(data[changesHeaderSize:], t.bits)
+
+	tmp := filename + "-tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return SyncDir(filepath.Dir(filename))
+}
+
+// mark sets the bits of pages and writes the bytes that changed
+func (t *changeTracker) mark(pages []uint32) error {
+	lo, hi := -1, -1
+	for _, pageNum := range pages {
+		i := int(pageNum / 8)
+		if i >= len(t.bits) {
+			t.bits = append(t.bits, make([]byte, i+1-len(t.bits))...)
+		}
+
+		bit := byte(1) << (pageNum % 8)
+		if t.bits[i]&bit != 0 {
+			continue
+		}
+		t.bits[i] |= bit
+
+		if lo == -1 || i < lo {
+			lo = i
+		}
+		hi = max(hi, i)
+	}
+
+	if lo == -1 {
+		return nil
+	}
+
+	if _, err := t.file.WriteAt(t.bits[lo:hi+1], int64(changesHeaderSize+lo)); err != nil {
+		return err
+	}
+	if t.sync != SyncOff {
+		return t.file.Sync()
+	}
+	return nil
+}
+
+// pages lists the pages marked since the last backup
+func (t *changeTracker) pages() []uint32 {
+	var pages []uint32
+	for i, b := range t.bits {
+		for bit := range 8 {
+			if b&(1<<bit) != 0 {
+				pages = append(pages, uint32(i*8+bit))
+			}
+		}
+	}
+	return pages
+}
+
+// reset starts the generation of a new backup with no pages marked
+func (t *changeTracker) reset() error {
+	filename := t.file.Name()
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+
+	generation, bits := t.generation, t.bits
+	t.generation++
+	t.bits = nil
+
+	err := t.rewrite(filename)
+	if err != nil {
+		// the old file is still in place, keep going with it
+		t.generation, t.bits = generation, bits
+	}
+
+	file, openErr := os.OpenFile(filename, os.O_RDWR, 0644)
+	if openErr != nil {
+		return openErr
+	}
+	t.file = file
+	return err
+}
+
+func (t *changeTracker) Close() error {
+	return t.file.Close()
+}
+
+// SyncDir makes a rename in dir durable
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
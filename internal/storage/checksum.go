@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// every page on disk starts with a prologue whose first field is a CRC32C
+// of the rest of the page. callers above the pager only ever see the body
+// after the prologue.
+
+type CorruptPageError struct {
+	PageNum  uint32
+	Stored   uint32
+	Computed uint32
+}
+
+func (e *CorruptPageError) Error() string {
+	return fmt.Sprintf("page %d is corrupt: stored checksum %08x, computed %08x", e.PageNum, e.Stored, e.Computed)
+}
+
+// encodePage builds the on-disk image of a page body
+func encodePage(pr PagePrologue, body []byte) []byte {
+	raw := make([]byte, PagePrologueSize+len(body))
+	putPrologue(raw, pr)
+	copy(raw[PagePrologueSize:], body)
+	stampChecksum(raw)
+	return raw
+}
+
+// decodePage verifies an on-disk image whose prologue is prologueSize
+// bytes long and copies its body into body
+func decodePage(pageNum uint32, raw []byte, body []byte, prologueSize int) (PagePrologue, error) {
+	if err := verifyChecksum(pageNum, raw); err != nil {
+		return PagePrologue{}, err
+	}
+
+	copy(body, raw[prologueSize:])
+	return readPrologue(raw, prologueSize), nil
+}
+
+func stampChecksum(raw []byte) {
+	binary.LittleEndian.PutUint32(raw[0:4], crc32.Checksum(raw[PageChecksumSize:], castagnoli))
+}
+
+func verifyChecksum(pageNum uint32, raw []byte) error {
+	stored := binary.LittleEndian.Uint32(raw[0:4])
+	computed := crc32.Checksum(raw[PageChecksumSize:], castagnoli)
+
+	if stored != computed {
+		return &CorruptPageError{PageNum: pageNum, Stored: stored, Computed: computed}
+	}
+	return nil
+}
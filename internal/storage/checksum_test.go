@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPageImageRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte{'b'}, testPageSize-PagePrologueSize)
+	pr := PagePrologue{Type: PageTypeIndex, LSN: 7}
+
+	raw := encodePage(pr, body)
+
+	got := make([]byte, len(body))
+	gotPr, err := decodePage(5, raw, got, PagePrologueSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatal("body changed")
+	}
+	if gotPr.Type != pr.Type || gotPr.LSN != pr.LSN {
+		t.Fatalf("prologue %+v, want %+v", gotPr, pr)
+	}
+}
+
+func TestCorruptPageImage(t *testing.T) {
+	raw := encodePage(PagePrologue{Type: PageTypeData}, make([]byte, testPageSize-PagePrologueSize))
+
+	for _, offset := range []int{PageChecksumSize, PagePrologueSize, testPageSize - 1} {
+		corrupt := bytes.Clone(raw)
+		corrupt[offset] ^= 0x01
+
+		_, err := decodePage(9, corrupt, make([]byte, testPageSize), PagePrologueSize)
+		var cpe *CorruptPageError
+		if !errors.As(err, &cpe) {
+			t.Fatalf("flipped bit at %d: %v", offset, err)
+		}
+		if cpe.PageNum != 9 {
+			t.Fatalf("error names page %d, want 9", cpe.PageNum)
+		}
+	}
+}
+
+func TestPagerReportsCorruptPage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.db")
+	p, err := OpenPager(path, &Options{Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestDatabase(t, p)
+
+	p.Begin()
+	pageNum, _ := p.AllocatePage(h)
+	writeFilled(t, p, pageNum, 'x')
+	if err := Finish(p, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'y'}, int64(pageNum)*DefaultPageSize+100)
+	f.Close()
+
+	p, err = OpenPager(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	_, err = p.ReadPage(pageNum)
+	var cpe *CorruptPageError
+	if !errors.As(err, &cpe) || cpe.PageNum != pageNum {
+		t.Fatalf("reading the damaged page: %v", err)
+	}
+}
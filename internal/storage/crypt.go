@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// pages of an encrypted database are sealed with AES-256-GCM under a key
+// derived from the passphrase. The page number and the prologue are the
+// associated data, so a page moved to another position, or relabelled,
+// fails to open. The prologue itself stays readable.
+// page layout: [prologue 16][nonce 12][ciphertext][tag 16]
+//
+// page 0 stays readable so that the page size and key parameters can be
+// found before the key is known: [prologue 16][header][salt 16][key check 12]
+
+const pageNonceSize = 12
+const pageTagSize = 16
+
+// EncryptionOverhead is what every page of an encrypted database gives up
+const EncryptionOverhead = pageNonceSize + pageTagSize
+
+const kdfSaltSize = 16
+const kdfIterations = 210000
+const keyCheckSize = EncryptionOverhead - kdfSaltSize
+
+// set in the version word of an encrypted database's header
+const encryptedFlag = 0x8000
+
+var ErrKeyRequired = errors.New("database is encrypted, a passphrase is required")
+var ErrWrongKey = errors.New("wrong passphrase for encrypted database")
+
+type pageCipher struct {
+	aead  cipher.AEAD
+	salt  []byte
+	check []byte
+}
+
+func newPageCipher(passphrase string, salt []byte) (*pageCipher, error) {
+	key, err := pbkdf2.Key(sha512.New, passphrase, salt, kdfIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("nanodb key check"))
+
+	return &pageCipher{
+		aead:  aead,
+		salt:  salt,
+		check: mac.Sum(nil)[:keyCheckSize],
+	}, nil
+}
+
+// loadPageCipher returns the cipher for the database behind wal and file,
+// or nil when it is not encrypted. A new database is encrypted when a
+// passphrase is given; an existing one has to be opened the way it was
+// created.
+func loadPageCipher(wal *WAL, file dbFile, pageSize, prologueSize int, passphrase string) (*pageCipher, error) {
+	raw := make([]byte, pageSize)
+
+	err := wal.ReadPage(0, raw, file)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if passphrase == "" {
+			return nil, nil
+		}
+
+		salt := make([]byte, kdfSaltSize)
+		rand.Read(salt)
+		return newPageCipher(passphrase, salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyChecksum(0, raw); err != nil {
+		return nil, err
+	}
+
+	version := binary.LittleEndian.Uint16(raw[prologueSize+4:])
+	encrypted := version&encryptedFlag != 0
+
+	switch {
+	case !encrypted && passphrase == "":
+		return nil, nil
+	case !encrypted:
+		return nil, fmt.Errorf("database is not encrypted")
+	case passphrase == "":
+		return nil, ErrKeyRequired
+	}
+
+	trailer := raw[pageSize-EncryptionOverhead:]
+	c, err := newPageCipher(passphrase, trailer[:kdfSaltSize])
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(c.check, trailer[kdfSaltSize:]) {
+		return nil, ErrWrongKey
+	}
+	return c, nil
+}
+
+// pageAD is the page number followed by the prologue after its checksum,
+// which format 5 and older did not have
+func pageAD(pageNum uint32, prologue []byte) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, pageNum), prologue...)
+}
+
+// encode builds the on-disk image of a page body
+func (c *pageCipher) encode(pageNum uint32, pr PagePrologue, body []byte) []byte {
+	raw := make([]byte, PagePrologueSize+len(body)+EncryptionOverhead)
+	putPrologue(raw, pr)
+
+	if pageNum == 0 {
+		copy(raw[PagePrologueSize:], body)
+
+		version := binary.LittleEndian.Uint16(body[4:6])
+		binary.LittleEndian.PutUint16(raw[PagePrologueSize+4:], version|encryptedFlag)
+
+		trailer := raw[len(raw)-EncryptionOverhead:]
+		copy(trailer, c.salt)
+		copy(trailer[kdfSaltSize:], c.check)
+	} else {
+		nonce := raw[PagePrologueSize : PagePrologueSize+pageNonceSize]
+		rand.Read(nonce)
+		c.aead.Seal(nonce[len(nonce):len(nonce)], nonce, body, pageAD(pageNum, raw[PageChecksumSize:PagePrologueSize]))
+	}
+
+	stampChecksum(raw)
+	return raw
+}
+
+// decode verifies and opens an on-disk image whose prologue is
+// prologueSize bytes long into body
+func (c *pageCipher) decode(pageNum uint32, raw []byte, body []byte, prologueSize int) (PagePrologue, error) {
+	if err := verifyChecksum(pageNum, raw); err != nil {
+		return PagePrologue{}, err
+	}
+	pr := readPrologue(raw, prologueSize)
+
+	if pageNum == 0 {
+		copy(body, raw[prologueSize:])
+
+		version := binary.LittleEndian.Uint16(body[4:6])
+		binary.LittleEndian.PutUint16(body[4:6], version&^encryptedFlag)
+		return pr, nil
+	}
+
+	nonce := raw[prologueSize : prologueSize+pageNonceSize]
+	if _, err := c.aead.Open(body[:0], nonce, raw[prologueSize+pageNonceSize:], pageAD(pageNum, raw[PageChecksumSize:prologueSize])); err != nil {
+		return PagePrologue{}, fmt.Errorf("page %d failed to decrypt: %w", pageNum, err)
+	}
+	return pr, nil
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const secret = "plaintext marker"
+
+// newEncryptedFile writes pages 1 to n full of the secret to a new file
+// encrypted with passphrase, leaving them in the log until checkpointed
+func newEncryptedFile(t *testing.T, path, passphrase string, n int, checkpoint bool) {
+	t.Helper()
+	p, err := OpenPager(path, &Options{Passphrase: passphrase, Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestDatabase(t, p)
+
+	p.Begin()
+	for range n {
+		pageNum, _ := p.AllocatePage(h)
+		buff := p.GetBuff()
+		copy(buff, bytes.Repeat([]byte(secret), len(buff)/len(secret)))
+		p.WritePage(pageNum, PageTypeData, buff)
+		ReleasePageBuffer(buff)
+	}
+	p.WriteHeader(h)
+	if err := Finish(p, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if checkpoint {
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	crashed := crashImage(t, path)
+	p.Close()
+	os.Rename(crashed, path)
+	os.Rename(crashed+"-wal", path+"-wal")
+}
+
+func TestEncryptedPagesAreNotPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	for _, checkpoint := range []bool{false, true} {
+		path := filepath.Join(dir, "e.db")
+		newEncryptedFile(t, path, "hunter2", 5, checkpoint)
+
+		for _, name := range []string{path, path + "-wal"} {
+			raw, err := os.ReadFile(name)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if bytes.Contains(raw, []byte(secret)) {
+				t.Fatalf("%s holds plaintext, checkpointed %v", filepath.Base(name), checkpoint)
+			}
+		}
+
+		p, err := OpenPager(path, &Options{Passphrase: "hunter2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := p.ReadPage(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(page, []byte(secret)) {
+			t.Fatal("page does not decrypt")
+		}
+		ReleasePageBuffer(page)
+		p.Close()
+
+		os.Remove(path)
+		os.Remove(path + "-wal")
+	}
+}
+
+func TestEncryptionKeyIsChecked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "e.db")
+	newEncryptedFile(t, path, "hunter2", 1, true)
+
+	if _, err := OpenPager(path, nil); !errors.Is(err, ErrKeyRequired) {
+		t.Fatalf("opening without a passphrase: %v", err)
+	}
+	if _, err := OpenPager(path, &Options{Passphrase: "hunter3"}); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("opening with the wrong passphrase: %v", err)
+	}
+
+	plain := filepath.Join(t.TempDir(), "p.db")
+	p, _ := OpenPager(plain, &Options{Sync: SyncOff})
+	newTestDatabase(t, p)
+	p.Close()
+	if p, err := OpenPager(plain, &Options{Passphrase: "hunter2"}); err == nil {
+		p.Close()
+		t.Fatal("opened a plain database with a passphrase")
+	}
+}
+
+// a page copied over another decrypts as neither, the page number is
+// bound into each
+func TestEncryptedPageMovedIsRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "e.db")
+	newEncryptedFile(t, path, "hunter2", 3, true)
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(raw[2*DefaultPageSize:3*DefaultPageSize], raw[1*DefaultPageSize:2*DefaultPageSize])
+	if err := os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := OpenPager(path, &Options{Passphrase: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err := p.ReadPage(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ReadPage(2); err == nil {
+		t.Fatal("page 1 read back as page 2")
+	}
+}
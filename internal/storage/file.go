@@ -0,0 +1,20 @@
+package storage
+
+import "io"
+
+// dbFile is the main database file as the pager and the log see it.
+// *os.File is the default; mmapFile serves the same calls from a mapping.
+type dbFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// pageViewer is a dbFile that lends out its bytes, so a page is decoded
+// where it lies instead of being copied into a buffer first
+type pageViewer interface {
+	// view runs fn on the n bytes at off, which stay valid until it returns
+	view(off int64, n int, fn func(raw []byte) error) error
+}
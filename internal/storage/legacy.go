@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+// format 1 files are a plain array of 4096 byte pages without checksums,
+// written in place with no log
+const legacyPageSize = 4096
+
+func init() {
+	pagePools[legacyPageSize] = newPagePool(legacyPageSize)
+}
+
+// LegacyStore reads a format 1 database so that nanodb upgrade can copy it
+// into a current one. It is read-only and caches nothing.
+type LegacyStore struct {
+	file *os.File
+}
+
+func OpenLegacy(filename string) (*LegacyStore, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(file, true); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &LegacyStore{file: file}, nil
+}
+
+func (l *LegacyStore) PageSize() int {
+	return legacyPageSize
+}
+
+func (l *LegacyStore) UsableSize() int {
+	return legacyPageSize
+}
+
+func (l *LegacyStore) ReadOnly() bool {
+	return true
+}
+
+func (l *LegacyStore) ReadPage(pageNum uint32) ([]byte, error) {
+	buff := l.GetBuff()
+	if _, err := l.file.ReadAt(buff, int64(pageNum)*legacyPageSize); err != nil {
+		ReleasePageBuffer(buff)
+		return nil, err
+	}
+	return buff, nil
+}
+
+// PinPage hands out a fresh copy, there is no cache to pin it in
+func (l *LegacyStore) PinPage(pageNum uint32) ([]byte, error) {
+	return l.ReadPage(pageNum)
+}
+
+func (l *LegacyStore) UnpinPage(pageNum uint32) {}
+
+func (l *LegacyStore) WritePage(pageNum uint32, kind PageType, data []byte) error {
+	return ErrReadOnly
+}
+
+// Prologue reports every page as unknown, format 1 pages do not say
+func (l *LegacyStore) Prologue(pageNum uint32) (PagePrologue, error) {
+	return PagePrologue{}, nil
+}
+
+func (l *LegacyStore) GetBuff() []byte {
+	return pagePools[legacyPageSize].Get().([]byte)
+}
+
+func (l *LegacyStore) ReadHeader() (*DBHeader, error) {
+	buff, err := l.ReadPage(0)
+	if err != nil {
+		return nil, err
+	}
+	defer ReleasePageBuffer(buff)
+
+	h := decodeHeader(buff)
+	if h.Magic != Magic || h.Version != 1 {
+		return nil, fmt.Errorf("not a format 1 database")
+	}
+	return h, nil
+}
+
+func (l *LegacyStore) WriteHeader(h *DBHeader) error {
+	return ErrReadOnly
+}
+
+func (l *LegacyStore) AllocatePage(h *DBHeader) (uint32, error) {
+	return 0, ErrReadOnly
+}
+
+func (l *LegacyStore) FreePage(h *DBHeader, pageNum uint32) error {
+	return ErrReadOnly
+}
+
+func (l *LegacyStore) Truncate(h *DBHeader) (uint32, error) {
+	return 0, ErrReadOnly
+}
+
+func (l *LegacyStore) Begin() {}
+
+func (l *LegacyStore) Commit() error {
+	return ErrReadOnly
+}
+
+func (l *LegacyStore) Rollback() error {
+	return nil
+}
+
+func (l *LegacyStore) Checkpoint() error {
+	return nil
+}
+
+func (l *LegacyStore) Sync() error {
+	return nil
+}
+
+// Snapshot is a plain view of the file, nothing ever changes it
+func (l *LegacyStore) Snapshot() (*Snapshot, error) {
+	return &Snapshot{store: l, lsn: math.MaxUint64}, nil
+}
+
+func (l *LegacyStore) readAt(pageNum uint32, lsn uint64) ([]byte, PagePrologue, error) {
+	data, err := l.ReadPage(pageNum)
+	return data, PagePrologue{}, err
+}
+
+func (l *LegacyStore) Close() error {
+	return l.file.Close()
+}
+
+// readOldHeader reads the header of a format 2 to 5 database opened for
+// upgrade, which Validate would turn away
+func readOldHeader(p pageIO) (*DBHeader, error) {
+	buff, err := p.ReadPage(0)
+	if err != nil {
+		return nil, err
+	}
+	defer ReleasePageBuffer(buff)
+
+	h := decodeHeader(buff)
+	if h.Magic != Magic || h.Version < 2 || h.Version >= FormatVersion {
+		return nil, fmt.Errorf("not a format 2 to %d database", FormatVersion-1)
+	}
+	return h, nil
+}
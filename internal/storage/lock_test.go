@@ -0,0 +1,191 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenLockedKeepsTheLock(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, "tmp.db")
+	path := filepath.Join(dir, "a.db")
+
+	p, err := OpenPager(tmp, &Options{Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestDatabase(t, p)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := LockFile(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is locked from before it took its new name
+	if other, err := OpenPager(path, nil); err == nil {
+		other.Close()
+		t.Fatal("renamed file opened while locked")
+	}
+
+	p, err = OpenLocked(file, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := OpenPager(path, nil); err == nil {
+		other.Close()
+		t.Fatal("file opened twice for writing")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path + "-wal"); !os.IsNotExist(err) {
+		t.Fatalf("log not named after the new name: %v", err)
+	}
+	p, err = OpenPager(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+}
+
+func TestWriterLocksOutOthers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l.db")
+	p, err := OpenPager(path, &Options{Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestDatabase(t, p)
+
+	for _, opts := range []*Options{nil, {ReadOnly: true}} {
+		if other, err := OpenPager(path, opts); err == nil {
+			other.Close()
+			t.Fatalf("opened a database with a writer, read-only %v", opts != nil)
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// readers share the file, and keep writers out while they have it
+	r1, err := OpenPager(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := OpenPager(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, err := OpenPager(path, nil); err == nil {
+		w.Close()
+		t.Fatal("opened a database for writing with readers")
+	}
+	r1.Close()
+	r2.Close()
+
+	p, err = OpenPager(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+}
+
+func TestReadOnlyPager(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "r.db")
+	if _, err := OpenPager(path, &Options{ReadOnly: true}); err == nil {
+		t.Fatal("created a database read-only")
+	}
+
+	p, err := OpenPager(path, &Options{Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestDatabase(t, p)
+	p.Begin()
+	pageNum, _ := p.AllocatePage(h)
+	writeFilled(t, p, pageNum, 'r')
+	p.WriteHeader(h)
+	Finish(p, nil, nil)
+	p.Close()
+
+	p, err = OpenPager(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if !p.ReadOnly() {
+		t.Fatal("pager is not read-only")
+	}
+	page, err := p.ReadPage(pageNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page[0] != 'r' {
+		t.Fatal("page does not read back")
+	}
+	ReleasePageBuffer(page)
+
+	if err := p.WritePage(pageNum, PageTypeData, page); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("write to a read-only pager: %v", err)
+	}
+}
+
+type failingWrites struct {
+	dbFile
+}
+
+func (f failingWrites) WriteAt(b []byte, off int64) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+// a close that cannot checkpoint still gives up the file and its lock, and
+// keeps the log to recover from
+func TestFailedCloseReleasesTheLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.db")
+	p, err := OpenPager(path, &Options{Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestDatabase(t, p)
+	p.Begin()
+	pageNum, err := p.AllocatePage(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFilled(t, p, pageNum, 7)
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.file = failingWrites{p.file}
+	if err := p.Close(); err == nil {
+		t.Fatal("close did not report the failed checkpoint")
+	}
+	if _, err := os.Stat(path + "-wal"); err != nil {
+		t.Fatalf("log removed before it was checkpointed: %v", err)
+	}
+
+	p, err = OpenPager(path, nil)
+	if err != nil {
+		t.Fatalf("file still locked after the failed close: %v", err)
+	}
+	defer p.Close()
+	page, err := p.ReadPage(pageNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page[0] != 7 {
+		t.Fatal("committed page lost with the failed close")
+	}
+}
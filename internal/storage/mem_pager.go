@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// MemPager is a PageStore without a file. Page images are immutable once
+// stored, like the frames of the buffer pool, so PinPage hands them out
+// directly. Everything is lost on Close.
+type MemPager struct {
+	pages    map[uint32]memPage
+	pageSize int
+	lsn      uint64              // guarded by txMu, and pagesMu when changed
+	undo     map[uint32]*memPage // page -> its image at Begin, nil for none
+	versions *versionStore
+	pagesMu  sync.RWMutex
+	mu       sync.Mutex
+	txMu     sync.Mutex
+}
+
+type memPage struct {
+	prologue PagePrologue
+	data     []byte
+}
+
+func NewMemPager(opts *Options) (*MemPager, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = DefaultPageSize
+	}
+	if !ValidPageSize(pageSize) {
+		return nil, fmt.Errorf("invalid page size %d", pageSize)
+	}
+
+	return &MemPager{pages: make(map[uint32]memPage), pageSize: pageSize, versions: newVersionStore()}, nil
+}
+
+func (m *MemPager) PageSize() int {
+	return m.pageSize
+}
+
+// UsableSize matches a file of the same page size, so databases can be
+// copied between the two
+func (m *MemPager) UsableSize() int {
+	return m.pageSize - PagePrologueSize
+}
+
+func (m *MemPager) ReadOnly() bool {
+	return false
+}
+
+func (m *MemPager) ReadPage(pageNum uint32) ([]byte, error) {
+	data, err := m.PinPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
+
+	buff := m.GetBuff()
+	copy(buff, data)
+	return buff, nil
+}
+
+func (m *MemPager) PinPage(pageNum uint32) ([]byte, error) {
+	m.pagesMu.RLock()
+	defer m.pagesMu.RUnlock()
+
+	// like reading past the end of a file
+	page, ok := m.pages[pageNum]
+	if !ok {
+		return nil, fmt.Errorf("page %d does not exist: %w", pageNum, io.EOF)
+	}
+	return page.data, nil
+}
+
+func (m *MemPager) Prologue(pageNum uint32) (PagePrologue, error) {
+	m.pagesMu.RLock()
+	defer m.pagesMu.RUnlock()
+
+	page, ok := m.pages[pageNum]
+	if !ok {
+		return PagePrologue{}, fmt.Errorf("page %d does not exist: %w", pageNum, io.EOF)
+	}
+	return page.prologue, nil
+}
+
+func (m *MemPager) UnpinPage(pageNum uint32) {}
+
+func (m *MemPager) WritePage(pageNum uint32, kind PageType, data []byte) error {
+	image := make([]byte, m.UsableSize())
+	copy(image, data)
+
+	m.pagesMu.Lock()
+	defer m.pagesMu.Unlock()
+
+	if _, ok := m.undo[pageNum]; !ok {
+		if m.undo == nil {
+			m.undo = make(map[uint32]*memPage)
+		}
+		m.undo[pageNum] = nil
+		if old, ok := m.pages[pageNum]; ok {
+			m.undo[pageNum] = &old
+		}
+	}
+
+	m.pages[pageNum] = memPage{prologue: PagePrologue{Type: kind, LSN: m.lsn}, data: image}
+	return nil
+}
+
+func (m *MemPager) GetBuff() []byte {
+	return pagePools[m.UsableSize()].Get().([]byte)
+}
+
+func (m *MemPager) ReadHeader() (*DBHeader, error) {
+	return readHeader(m)
+}
+
+func (m *MemPager) WriteHeader(h *DBHeader) error {
+	return writeHeader(m, h)
+}
+
+func (m *MemPager) AllocatePage(h *DBHeader) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return allocatePage(m, h)
+}
+
+func (m *MemPager) FreePage(h *DBHeader, pageNum uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return freePage(m, h, pageNum)
+}
+
+// Truncate drops the free pages at the end, as Pager.Truncate does for a file
+func (m *MemPager) Truncate(h *DBHeader) (uint32, error) {
+	m.Begin()
+
+	committed := *h
+
+	m.mu.Lock()
+	removed, err := truncateFreePages(m, h)
+	m.mu.Unlock()
+
+	if err == nil {
+		m.pagesMu.Lock()
+		for pageNum := range m.pages {
+			if pageNum >= h.PageCount {
+				delete(m.pages, pageNum)
+			}
+		}
+		m.pagesMu.Unlock()
+	}
+
+	if err := Finish(m, err, func() { *h = committed }); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+func (m *MemPager) Begin() {
+	m.txMu.Lock()
+}
+
+// Commit keeps the images the pages had at Begin for the open snapshots
+func (m *MemPager) Commit() error {
+	m.pagesMu.Lock()
+	m.versions.mu.Lock()
+	if m.versions.active() {
+		for pageNum, old := range m.undo {
+			if old != nil {
+				m.versions.keep(pageNum, old.prologue, old.data, m.lsn)
+			}
+		}
+	}
+	m.undo = nil
+	m.lsn++
+	m.versions.mu.Unlock()
+	m.pagesMu.Unlock()
+
+	m.txMu.Unlock()
+	return nil
+}
+
+// Rollback puts back the images the pages written since Begin had
+func (m *MemPager) Rollback() error {
+	m.pagesMu.Lock()
+	for pageNum, old := range m.undo {
+		if old == nil {
+			delete(m.pages, pageNum)
+		} else {
+			m.pages[pageNum] = *old
+		}
+	}
+	m.undo = nil
+	m.pagesMu.Unlock()
+
+	m.txMu.Unlock()
+	return nil
+}
+
+// Snapshot returns a read-only view of the database as of the last commit
+func (m *MemPager) Snapshot() (*Snapshot, error) {
+	m.pagesMu.RLock()
+	defer m.pagesMu.RUnlock()
+
+	m.versions.mu.Lock()
+	defer m.versions.mu.Unlock()
+	return m.versions.open(m, m.lsn), nil
+}
+
+func (m *MemPager) readAt(pageNum uint32, lsn uint64) ([]byte, PagePrologue, error) {
+	m.pagesMu.RLock()
+	defer m.pagesMu.RUnlock()
+
+	if page, ok := m.pages[pageNum]; ok && page.prologue.LSN < lsn {
+		return page.data, page.prologue, nil
+	}
+	if old := m.undo[pageNum]; old != nil && old.prologue.LSN < lsn {
+		return old.data, old.prologue, nil
+	}
+	if data, pr, ok := m.versions.find(pageNum, lsn); ok {
+		return data, pr, nil
+	}
+	return nil, PagePrologue{}, visibleAt(pageNum, lsn)
+}
+
+func (m *MemPager) Checkpoint() error {
+	return nil
+}
+
+// Sync has nothing to do, the pages never reach stable storage
+func (m *MemPager) Sync() error {
+	return nil
+}
+
+func (m *MemPager) Close() error {
+	m.pagesMu.Lock()
+	defer m.pagesMu.Unlock()
+
+	m.pages = make(map[uint32]memPage)
+	return nil
+}
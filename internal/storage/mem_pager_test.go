@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func newTestMemPager(t *testing.T) (*MemPager, *DBHeader) {
+	t.Helper()
+	m, err := NewMemPager(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, newTestDatabase(t, m)
+}
+
+func TestMemPagerRollback(t *testing.T) {
+	m, h := newTestMemPager(t)
+
+	m.Begin()
+	kept, _ := m.AllocatePage(h)
+	writeFilled(t, m, kept, 'k')
+	m.WriteHeader(h)
+	if err := Finish(m, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Begin()
+	writeFilled(t, m, kept, 'x')
+	dropped, _ := m.AllocatePage(h)
+	writeFilled(t, m, dropped, 'd')
+	if err := m.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := m.ReadPage(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page[0] != 'k' {
+		t.Fatal("rolled back write is still visible")
+	}
+	ReleasePageBuffer(page)
+
+	if _, err := m.ReadPage(dropped); !errors.Is(err, io.EOF) {
+		t.Fatalf("page allocated by the rolled back write: %v", err)
+	}
+}
+
+func TestMemPagerSnapshot(t *testing.T) {
+	m, h := newTestMemPager(t)
+
+	m.Begin()
+	pageNum, _ := m.AllocatePage(h)
+	writeFilled(t, m, pageNum, 'a')
+	m.WriteHeader(h)
+	Finish(m, nil, nil)
+
+	snap, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	// neither a running write nor a later commit is seen
+	m.Begin()
+	writeFilled(t, m, pageNum, 'b')
+	check := func() {
+		t.Helper()
+		page, err := snap.ReadPage(pageNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page[0] != 'a' {
+			t.Fatalf("snapshot sees %q", page[0])
+		}
+		ReleasePageBuffer(page)
+	}
+	check()
+	if err := Finish(m, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestMemPagerTruncate(t *testing.T) {
+	m, h := newTestMemPager(t)
+
+	m.Begin()
+	var pages []uint32
+	for range 6 {
+		pageNum, _ := m.AllocatePage(h)
+		writeFilled(t, m, pageNum, 'p')
+		pages = append(pages, pageNum)
+	}
+	for _, pageNum := range pages[3:] {
+		m.FreePage(h, pageNum)
+	}
+	m.WriteHeader(h)
+	Finish(m, nil, nil)
+
+	freed, err := m.Truncate(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != 3 || h.PageCount != pages[3] {
+		t.Fatalf("truncated %d pages to %d, want 3 to %d", freed, h.PageCount, pages[3])
+	}
+	if _, err := m.ReadPage(pages[5]); !errors.Is(err, io.EOF) {
+		t.Fatalf("truncated page: %v", err)
+	}
+
+	// the next page allocated extends the store again
+	m.Begin()
+	pageNum, _ := m.AllocatePage(h)
+	writeFilled(t, m, pageNum, 'q')
+	m.WriteHeader(h)
+	Finish(m, nil, nil)
+	if pageNum != pages[3] {
+		t.Fatalf("allocated page %d, want %d", pageNum, pages[3])
+	}
+}
+
+// snapshots and backups are only offered by the stores that can take them
+func TestOptionalInterfaces(t *testing.T) {
+	m, _ := newTestMemPager(t)
+	for name, store := range map[string]PageStore{
+		"memory":   m,
+		"overlay":  NewOverlay(m),
+		"snapshot": &Snapshot{store: m},
+	} {
+		_, snapshots := store.(Snapshotter)
+		_, backups := store.(Backuper)
+		if want := name != "overlay"; snapshots != want {
+			t.Errorf("%s store offers snapshots: %v", name, snapshots)
+		}
+		if want := name == "memory"; backups != want {
+			t.Errorf("%s store offers backups: %v", name, backups)
+		}
+		if err := store.Sync(); err != nil {
+			t.Errorf("%s store: %v", name, err)
+		}
+	}
+}
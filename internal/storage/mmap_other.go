@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import (
+	"fmt"
+	"os"
+)
+
+func openMmapFile(file *os.File, readOnly bool) (dbFile, error) {
+	return nil, fmt.Errorf("memory-mapped database files are not supported on this platform")
+}
@@ -0,0 +1,138 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmapDecodesFromTheMapping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "m.db")
+	p, err := OpenPager(path, &Options{Mmap: true, CachePages: 4, Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.file.(pageViewer); !ok {
+		t.Fatal("mapped file does not lend out its pages")
+	}
+	h := newTestDatabase(t, p)
+
+	p.Begin()
+	for i := range 20 {
+		pageNum, _ := p.AllocatePage(h)
+		writeFilled(t, p, pageNum, byte('a'+i))
+	}
+	p.WriteHeader(h)
+	if err := Finish(p, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cache holds 4 pages, the rest come out of the mapping
+	check := func(p *Pager) {
+		t.Helper()
+		for i := range 20 {
+			page, err := p.ReadPage(uint32(i + 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(page, bytes.Repeat([]byte{byte('a' + i)}, len(page))) {
+				t.Fatalf("page %d does not read back", i+1)
+			}
+			ReleasePageBuffer(page)
+		}
+	}
+	check(p)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = OpenPager(path, &Options{Mmap: true, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(p)
+	p.Close()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'!'}, 7*DefaultPageSize+200)
+	f.Close()
+
+	p, err = OpenPager(path, &Options{Mmap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	_, err = p.ReadPage(7)
+	var cpe *CorruptPageError
+	if !errors.As(err, &cpe) || cpe.PageNum != 7 {
+		t.Fatalf("reading the damaged page: %v", err)
+	}
+}
+
+func TestMmapFollowsTheFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "m.db")
+	p, err := OpenPager(path, &Options{Mmap: true, Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	h := newTestDatabase(t, p)
+
+	p.Begin()
+	var pages []uint32
+	for range 10 {
+		pageNum, _ := p.AllocatePage(h)
+		writeFilled(t, p, pageNum, 'g')
+		pages = append(pages, pageNum)
+	}
+	p.WriteHeader(h)
+	Finish(p, nil, nil)
+
+	p.Begin()
+	for _, pageNum := range pages[5:] {
+		if err := p.FreePage(h, pageNum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.WriteHeader(h)
+	Finish(p, nil, nil)
+
+	freed, err := p.Truncate(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != 5 {
+		t.Fatalf("truncated %d pages, want 5", freed)
+	}
+
+	// the mapping shrank with the file and grows back with it
+	p.Begin()
+	for range 8 {
+		pageNum, _ := p.AllocatePage(h)
+		writeFilled(t, p, pageNum, 'h')
+	}
+	p.WriteHeader(h)
+	Finish(p, nil, nil)
+	if err := p.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	for pageNum := uint32(1); pageNum < h.PageCount; pageNum++ {
+		page, err := p.ReadPage(pageNum)
+		if err != nil {
+			t.Fatalf("page %d: %v", pageNum, err)
+		}
+		ReleasePageBuffer(page)
+	}
+}
@@ -0,0 +1,140 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// mmapFile maps the whole database file. A page that misses the cache is
+// verified and decoded straight out of the mapping into its cache frame,
+// which saves the read syscall and the buffer ReadAt would fill, but not
+// the copy into the frame: pages are not served from the mapping itself,
+// as a checkpoint may write over them and a remap unmaps them while
+// readers still hold them. Writes go through the mapping and the mapping
+// is replaced whenever the file changes size.
+type mmapFile struct {
+	file *os.File
+	prot int
+	mu   sync.RWMutex
+	data []byte
+}
+
+func openMmapFile(file *os.File, readOnly bool) (dbFile, error) {
+	f := &mmapFile{file: file, prot: syscall.PROT_READ | syscall.PROT_WRITE}
+	if readOnly {
+		f.prot = syscall.PROT_READ
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.remap(info.Size()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *mmapFile) remap(size int64) error {
+	if f.data != nil {
+		if err := syscall.Munmap(f.data); err != nil {
+			return err
+		}
+		f.data = nil
+	}
+
+	if size == 0 {
+		return nil // an empty file cannot be mapped
+	}
+
+	data, err := syscall.Mmap(int(f.file.Fd()), 0, int(size), f.prot, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	f.data = data
+	return nil
+}
+
+func (f *mmapFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// view holds off a remap while fn reads the mapping
+func (f *mmapFile) view(off int64, n int, fn func(raw []byte) error) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if off+int64(n) > int64(len(f.data)) {
+		return io.EOF
+	}
+	return fn(f.data[off : off+int64(n) : off+int64(n)])
+}
+
+func (f *mmapFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		if err := f.truncate(end); err != nil {
+			return 0, err
+		}
+	}
+
+	return copy(f.data[off:], p), nil
+}
+
+func (f *mmapFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.truncate(size)
+}
+
+func (f *mmapFile) truncate(size int64) error {
+	if err := f.file.Truncate(size); err != nil {
+		return err
+	}
+	return f.remap(size)
+}
+
+// Sync flushes the mapping with msync, then the file's metadata
+func (f *mmapFile) Sync() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if len(f.data) > 0 {
+		_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&f.data[0])), uintptr(len(f.data)), syscall.MS_SYNC)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return f.file.Sync()
+}
+
+func (f *mmapFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.remap(0); err != nil {
+		return err
+	}
+	return f.file.Close()
+}
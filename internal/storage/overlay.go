@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Overlay is a PageStore that keeps every page written to it in memory, on
+// top of the committed pages of a base store. A transaction builds its
+// changes in one, so nobody reading the base sees them, and Apply hands
+// them all to the base inside the base's own write. An Overlay is not safe
+// for concurrent use.
+type Overlay struct {
+	base   PageStore
+	pages  map[uint32]memPage
+	pinned map[uint32]int // pins held on pages of the base
+}
+
+func NewOverlay(base PageStore) *Overlay {
+	return &Overlay{base: base, pages: make(map[uint32]memPage), pinned: make(map[uint32]int)}
+}
+
+func (o *Overlay) PageSize() int {
+	return o.base.PageSize()
+}
+
+func (o *Overlay) UsableSize() int {
+	return o.base.UsableSize()
+}
+
+func (o *Overlay) ReadOnly() bool {
+	return o.base.ReadOnly()
+}
+
+func (o *Overlay) ReadPage(pageNum uint32) ([]byte, error) {
+	page, ok := o.pages[pageNum]
+	if !ok {
+		return o.base.ReadPage(pageNum)
+	}
+
+	buff := o.GetBuff()
+	copy(buff, page.data)
+	return buff, nil
+}
+
+// PinPage hands out written pages directly, their images are replaced
+// rather than modified by WritePage
+func (o *Overlay) PinPage(pageNum uint32) ([]byte, error) {
+	if page, ok := o.pages[pageNum]; ok {
+		return page.data, nil
+	}
+
+	data, err := o.base.PinPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	o.pinned[pageNum]++
+	return data, nil
+}
+
+func (o *Overlay) UnpinPage(pageNum uint32) {
+	if o.pinned[pageNum] == 0 {
+		return
+	}
+
+	o.pinned[pageNum]--
+	if o.pinned[pageNum] == 0 {
+		delete(o.pinned, pageNum)
+	}
+	o.base.UnpinPage(pageNum)
+}
+
+func (o *Overlay) WritePage(pageNum uint32, kind PageType, data []byte) error {
+	image := make([]byte, o.UsableSize())
+	copy(image, data)
+
+	o.pages[pageNum] = memPage{prologue: PagePrologue{Type: kind}, data: image}
+	return nil
+}
+
+func (o *Overlay) Prologue(pageNum uint32) (PagePrologue, error) {
+	if page, ok := o.pages[pageNum]; ok {
+		return page.prologue, nil
+	}
+	return o.base.Prologue(pageNum)
+}
+
+func (o *Overlay) GetBuff() []byte {
+	return o.base.GetBuff()
+}
+
+func (o *Overlay) ReadHeader() (*DBHeader, error) {
+	return readHeader(o)
+}
+
+func (o *Overlay) WriteHeader(h *DBHeader) error {
+	return writeHeader(o, h)
+}
+
+func (o *Overlay) AllocatePage(h *DBHeader) (uint32, error) {
+	return allocatePage(o, h)
+}
+
+func (o *Overlay) FreePage(h *DBHeader, pageNum uint32) error {
+	return freePage(o, h, pageNum)
+}
+
+func (o *Overlay) Truncate(h *DBHeader) (uint32, error) {
+	return 0, fmt.Errorf("cannot truncate inside a transaction")
+}
+
+// writes to an overlay are already part of a write to the base, so Begin
+// and Commit do nothing and Rollback drops everything written
+func (o *Overlay) Begin() {}
+
+func (o *Overlay) Commit() error {
+	return nil
+}
+
+func (o *Overlay) Rollback() error {
+	clear(o.pages)
+	return nil
+}
+
+func (o *Overlay) Checkpoint() error {
+	return nil
+}
+
+// Sync has nothing to do, none of the pages are committed yet
+func (o *Overlay) Sync() error {
+	return nil
+}
+
+func (o *Overlay) Close() error {
+	clear(o.pages)
+	return nil
+}
+
+// Apply writes every page held to the base. The caller must be inside a
+// write to the base, begun before the overlay was first read.
+func (o *Overlay) Apply() error {
+	for _, pageNum := range slices.Sorted(maps.Keys(o.pages)) {
+		page := o.pages[pageNum]
+		if err := o.base.WritePage(pageNum, page.prologue.Type, page.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
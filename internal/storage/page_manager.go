@@ -2,14 +2,53 @@ package storage
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 )
 
+var Magic = [4]byte{'A', 'A', 'M', 'N'}
+
+// on-disk format history
+// 1: initial layout
+// 2: CRC32C checksum at the start of every page
+// 3: catalog entries carry the root of the collection's free-space map
+// 4: records may be deflate-compressed, catalog entries carry collection flags
+// 5: catalog entries give the length of the collection name in two bytes
+// 6: every page starts with a prologue of checksum, page type and LSN,
+// and the header counts the opens for writing
+const FormatVersion = 6
+
+// MinFormatVersion is the oldest format that can be opened directly. Older
+// files have smaller page prologues, or none, and must be copied into a
+// new file by nanodb upgrade.
+const MinFormatVersion = 6
+
+var ErrNoHeader = errors.New("database has no header")
+var ErrNotDatabase = errors.New("file is not a nanodb database")
+var ErrNeedsUpgrade = errors.New("database format is too old, run nanodb upgrade")
+
 type DBHeader struct {
 	Magic     [4]byte // 4-byte
 	Version   uint16  // 2-byte
 	PageSize  uint32
 	PageCount uint32
 	FreeList  uint32
+	Epoch     uint32 // opens for writing, the high half of LSNs
+}
+
+// Validate checks that the header belongs to a database this version can open
+func (h *DBHeader) Validate() error {
+	if h.Magic != Magic {
+		return ErrNotDatabase
+	}
+	if h.Version < MinFormatVersion {
+		return fmt.Errorf("format version %d: %w", h.Version, ErrNeedsUpgrade)
+	}
+	if h.Version > FormatVersion {
+		return fmt.Errorf("database format version %d is newer than the supported version %d", h.Version, FormatVersion)
+	}
+	return nil
 }
 
 type PageHeader struct {
@@ -18,39 +57,135 @@ type PageHeader struct {
 	NextPage  uint32
 }
 
+// pageIO is the part of a store the header and free-list code works through
+type pageIO interface {
+	ReadPage(pageNum uint32) ([]byte, error)
+	WritePage(pageNum uint32, kind PageType, data []byte) error
+	GetBuff() []byte
+}
+
 func (p *Pager) WriteHeader(h *DBHeader) error {
-	buff := GetBuff()
+	return writeHeader(p, h)
+}
+
+func (p *Pager) ReadHeader() (*DBHeader, error) {
+	if p.prologue == oldPrologueSize {
+		return readOldHeader(p)
+	}
+	return readHeader(p)
+}
+
+func (p *Pager) AllocatePage(h *DBHeader) (uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return allocatePage(p, h)
+}
+
+func (p *Pager) FreePage(h *DBHeader, pageNum uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return freePage(p, h, pageNum)
+}
+
+// Truncate gives the free pages at the end of the file back to the file
+// system and returns how many there were. They are taken off the free list
+// and the page count lowered in a transaction of their own, then the log is
+// checkpointed so the new count is in the file before the file is cut.
+func (p *Pager) Truncate(h *DBHeader) (uint32, error) {
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	p.Begin()
+	if p.backup != nil {
+		// a running backup still copies the pages it counted at its start
+		p.txMu.Unlock()
+		return 0, fmt.Errorf("cannot truncate while a backup is running")
+	}
+
+	committed := *h
+
+	p.mu.Lock()
+	removed, err := truncateFreePages(p, h)
+	p.mu.Unlock()
+
+	err = Finish(p, err, func() {
+		*h = committed
+	})
+	if err != nil && !errors.Is(err, ErrAfterCommit) {
+		return 0, err
+	}
+	if err != nil || removed == 0 {
+		return removed, err
+	}
+
+	p.txMu.Lock()
+	defer p.txMu.Unlock()
+
+	if err := p.cache.flush(); err != nil {
+		return removed, err
+	}
+	if err := checkpoint(p.wal, p.file, p.changes); err != nil {
+		return removed, err
+	}
+
+	p.cache.discard(h.PageCount)
+	if err := p.file.Truncate(int64(h.PageCount) * int64(p.pageSize)); err != nil {
+		return removed, err
+	}
+	if p.sync != SyncOff {
+		return removed, p.file.Sync()
+	}
+	return removed, nil
+}
+
+func writeHeader(p pageIO, h *DBHeader) error {
+	buff := p.GetBuff()
 	defer ReleasePageBuffer(buff)
+
+	// page 0 is stored in the clear, even in an encrypted database, so
+	// nothing left over in the pooled buffer may reach it
+	clear(buff)
 	copy(buff[0:4], h.Magic[:])
 
 	binary.LittleEndian.PutUint16(buff[4:6], h.Version)
 	binary.LittleEndian.PutUint32(buff[6:10], h.PageSize)
 	binary.LittleEndian.PutUint32(buff[10:14], h.PageCount)
 	binary.LittleEndian.PutUint32(buff[14:18], h.FreeList)
-	return p.WritePage(0, buff)
+	binary.LittleEndian.PutUint32(buff[18:22], h.Epoch)
+	return p.WritePage(0, PageTypeHeader, buff)
 }
 
-func (p *Pager) ReadHeader() (*DBHeader, error) {
+// readHeader reads and validates page 0. A store without one returns
+// ErrNoHeader.
+func readHeader(p pageIO) (*DBHeader, error) {
 	buff, err := p.ReadPage(0)
-
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, ErrNoHeader
+	}
 	if err != nil {
 		return nil, err
 	}
+	defer ReleasePageBuffer(buff)
+
+	h := decodeHeader(buff)
+	return h, h.Validate()
+}
+
+func decodeHeader(buff []byte) *DBHeader {
 	h := &DBHeader{}
 	copy(h.Magic[:], buff[0:4])
 	h.Version = binary.LittleEndian.Uint16(buff[4:6])
 	h.PageSize = binary.LittleEndian.Uint32(buff[6:10])
 	h.PageCount = binary.LittleEndian.Uint32(buff[10:14])
 	h.FreeList = binary.LittleEndian.Uint32(buff[14:18])
-
-	ReleasePageBuffer(buff)
-	return h, nil
+	h.Epoch = binary.LittleEndian.Uint32(buff[18:22])
+	return h
 }
 
-func (p *Pager) AllocatePage(h *DBHeader) (uint32, error) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
+func allocatePage(p pageIO, h *DBHeader) (uint32, error) {
 	if h.FreeList != 0 {
 		pageNum := h.FreeList
 		buff, err := p.ReadPage(pageNum)
@@ -60,7 +195,7 @@ func (p *Pager) AllocatePage(h *DBHeader) (uint32, error) {
 		}
 
 		h.FreeList = binary.LittleEndian.Uint32(buff[0:4])
-		err = p.WriteHeader(h)
+		err = writeHeader(p, h)
 		if err != nil {
 			return 0, err
 		}
@@ -72,13 +207,14 @@ func (p *Pager) AllocatePage(h *DBHeader) (uint32, error) {
 	pageNum := h.PageCount
 
 	h.PageCount++
-	err := p.WriteHeader(h)
+	err := writeHeader(p, h)
 	if err != nil {
 		return 0, err
 	}
 
-	emptyPage := GetBuff()
-	err = p.WritePage(pageNum, emptyPage)
+	// the caller writes it again with the type it is allocated for
+	emptyPage := p.GetBuff()
+	err = p.WritePage(pageNum, PageTypeUnknown, emptyPage)
 
 	if err != nil {
 		return 0, err
@@ -87,23 +223,93 @@ func (p *Pager) AllocatePage(h *DBHeader) (uint32, error) {
 	return pageNum, nil
 }
 
-func (p *Pager) FreePage(h *DBHeader, pageNum uint32) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	buff := GetBuff()
+func freePage(p pageIO, h *DBHeader, pageNum uint32) error {
+	buff := p.GetBuff()
 	defer ReleasePageBuffer(buff)
 	binary.LittleEndian.PutUint32(buff[0:4], h.FreeList)
 
-	if err := p.WritePage(pageNum, buff); err != nil {
+	if err := p.WritePage(pageNum, PageTypeFree, buff); err != nil {
 		return err
 	}
 	h.FreeList = pageNum
-	return p.WriteHeader(h)
+	return writeHeader(p, h)
+}
+
+// truncateFreePages takes the free pages at the end of the file off the
+// free list and lowers the page count below them. Pages 0 and 1 are never
+// free, so at least those two are kept.
+func truncateFreePages(p pageIO, h *DBHeader) (uint32, error) {
+	next := make(map[uint32]uint32) // free page -> the page after it on the list
+	var list []uint32
+
+	for pageNum := h.FreeList; pageNum != 0; pageNum = next[pageNum] {
+		if pageNum >= h.PageCount {
+			return 0, fmt.Errorf("free list points at page %d beyond the page count %d", pageNum, h.PageCount)
+		}
+		if _, ok := next[pageNum]; ok {
+			return 0, fmt.Errorf("free list loops back to page %d", pageNum)
+		}
+
+		buff, err := p.ReadPage(pageNum)
+		if err != nil {
+			return 0, err
+		}
+		next[pageNum] = binary.LittleEndian.Uint32(buff[0:4])
+		ReleasePageBuffer(buff)
+
+		list = append(list, pageNum)
+	}
+
+	count := h.PageCount
+	for count > 2 {
+		if _, ok := next[count-1]; !ok {
+			break
+		}
+		count--
+	}
+	if count == h.PageCount {
+		return 0, nil
+	}
+
+	// relink the pages that stay, only rewriting those whose successor changed
+	var kept []uint32
+	for _, pageNum := range list {
+		if pageNum < count {
+			kept = append(kept, pageNum)
+		}
+	}
+
+	buff := p.GetBuff()
+	defer ReleasePageBuffer(buff)
+
+	for i, pageNum := range kept {
+		var after uint32
+		if i+1 < len(kept) {
+			after = kept[i+1]
+		}
+		if next[pageNum] == after {
+			continue
+		}
+
+		clear(buff)
+		binary.LittleEndian.PutUint32(buff[0:4], after)
+		if err := p.WritePage(pageNum, PageTypeFree, buff); err != nil {
+			return 0, err
+		}
+	}
+
+	removed := h.PageCount - count
+	h.FreeList = 0
+	if len(kept) > 0 {
+		h.FreeList = kept[0]
+	}
+	h.PageCount = count
+
+	return removed, writeHeader(p, h)
 }
 
 func InitDataPage(page []byte) {
-	binary.LittleEndian.PutUint16(page[0:2], 0)                // slot count
-	binary.LittleEndian.PutUint16(page[2:4], uint16(PageSize)) // free start
+	binary.LittleEndian.PutUint16(page[0:2], 0)                 // slot count
+	binary.LittleEndian.PutUint16(page[2:4], uint16(len(page))) // free start
 	binary.LittleEndian.PutUint32(page[4:8], 0)
 }
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// PageType says what a page holds. It is stored in the prologue of every
+// page, so a page can be identified without knowing who owns it.
+type PageType uint8
+
+const (
+	PageTypeUnknown      PageType = iota // written before format 6, or allocated and not written yet
+	PageTypeHeader                       // page 0
+	PageTypeFree                         // on the free list
+	PageTypeCatalog                      // slotted page of collection entries
+	PageTypeData                         // slotted page of documents
+	PageTypeOverflow                     // part of a document too large for a data page
+	PageTypeIndex                        // _id B-tree node, leaf or internal
+	PageTypeVector                       // vectors of one bucket
+	PageTypeFreeSpaceMap                 // free space of a collection's data pages
+)
+
+func (t PageType) String() string {
+	switch t {
+	case PageTypeUnknown:
+		return "unknown"
+	case PageTypeHeader:
+		return "header"
+	case PageTypeFree:
+		return "free"
+	case PageTypeCatalog:
+		return "catalog"
+	case PageTypeData:
+		return "data"
+	case PageTypeOverflow:
+		return "overflow"
+	case PageTypeIndex:
+		return "index"
+	case PageTypeVector:
+		return "vector"
+	case PageTypeFreeSpaceMap:
+		return "free-space map"
+	}
+	return fmt.Sprintf("type %d", uint8(t))
+}
+
+// PagePrologue is what a page says about itself on disk. LSN is the log
+// sequence number of the transaction that last wrote the page: the high
+// 32 bits count the times the database was opened for writing, the low
+// 32 bits the commits since then.
+type PagePrologue struct {
+	Type PageType
+	LSN  uint64
+}
+
+// prologue layout: [crc 4] [type 1] [reserved 3] [lsn 8]
+// the crc covers everything after it, prologue and body
+
+const PageChecksumSize = 4
+const PagePrologueSize = 16
+
+// pages of format 2 to 5 start with the checksum alone
+const oldPrologueSize = PageChecksumSize
+
+func putPrologue(raw []byte, pr PagePrologue) {
+	raw[4] = byte(pr.Type)
+	binary.LittleEndian.PutUint64(raw[8:16], pr.LSN)
+}
+
+func readPrologue(raw []byte, prologueSize int) PagePrologue {
+	if prologueSize < PagePrologueSize {
+		return PagePrologue{}
+	}
+	return PagePrologue{Type: PageType(raw[4]), LSN: binary.LittleEndian.Uint64(raw[8:16])}
+}
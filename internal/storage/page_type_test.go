@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPrologueIsStored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.db")
+	p, err := OpenPager(path, &Options{Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestDatabase(t, p)
+
+	kinds := []PageType{PageTypeData, PageTypeIndex, PageTypeOverflow, PageTypeVector}
+	p.Begin()
+	for _, kind := range kinds {
+		pageNum, _ := p.AllocatePage(h)
+		buff := p.GetBuff()
+		p.WritePage(pageNum, kind, buff)
+		ReleasePageBuffer(buff)
+	}
+	p.WriteHeader(h)
+	if err := Finish(p, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := p.Prologue(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = OpenPager(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if pr, _ := p.Prologue(0); pr.Type != PageTypeHeader {
+		t.Fatalf("page 0 is labelled %v", pr.Type)
+	}
+	for i, kind := range kinds {
+		pr, err := p.Prologue(uint32(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pr.Type != kind || pr.LSN != first.LSN {
+			t.Fatalf("page %d is labelled %v at %x, want %v at %x", i+1, pr.Type, pr.LSN, kind, first.LSN)
+		}
+	}
+
+	// every open for writing starts a new epoch in the high bits
+	p.Begin()
+	writeFilled(t, p, 1, 'e')
+	Finish(p, nil, nil)
+	pr, _ := p.Prologue(1)
+	if pr.LSN>>32 <= first.LSN>>32 {
+		t.Fatalf("write after reopening has LSN %x, the one before %x", pr.LSN, first.LSN)
+	}
+}
+
+func TestPageTypeNames(t *testing.T) {
+	for kind := PageTypeUnknown; kind <= PageTypeFreeSpaceMap; kind++ {
+		if name := kind.String(); name == "" || name[:4] == "type" {
+			t.Errorf("page type %d has no name", kind)
+		}
+	}
+	if PageType(200).String() != "type 200" {
+		t.Fatal("unknown page type named")
+	}
+}
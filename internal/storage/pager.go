@@ -1,61 +1,756 @@
 package storage
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
-const PageSize = 4096
+const DefaultPageSize = 4096
+const MinPageSize = 4096
+const MaxPageSize = 65536
 
 type Pager struct {
-	file *os.File
-	mu   sync.Mutex
+	path     string
+	file     dbFile
+	wal      *WAL
+	cache    *bufferPool
+	pageSize int
+	prologue int // PagePrologueSize, or oldPrologueSize when opened for upgrade
+	readOnly bool
+	sync     SyncMode
+	cipher   *pageCipher    // nil unless the database is encrypted
+	changes  *changeTracker // nil when read-only
+	lsn      uint64         // of the transaction being written, guarded by txMu
+	closed   atomic.Bool    // set by ReplaceFile
+	versions *versionStore  // lsn is also guarded by its mu once open
+	mu       sync.Mutex
+	txMu     sync.Mutex
+
+	// pages written since a running backup copied them, guarded by txMu
+	backup map[uint32]struct{}
+}
+
+var ErrReadOnly = errors.New("database is opened read-only")
+
+// ErrClosed is returned by reads and writes of a pager whose file was
+// replaced
+var ErrClosed = errors.New("database file was replaced")
+
+// SyncMode says when the pager forces written data to stable storage
+type SyncMode int
+
+const (
+	// SyncNormal syncs the log at every commit and the database file at
+	// every checkpoint. Concurrent commits share one sync of the log.
+	SyncNormal SyncMode = iota
+	// SyncOff never syncs. Commits survive a crash of the process but not
+	// of the machine.
+	SyncOff
+	// SyncFull syncs the log after every frame written to it
+	SyncFull
+)
+
+func ParseSyncMode(name string) (SyncMode, error) {
+	switch name {
+	case "", "normal":
+		return SyncNormal, nil
+	case "off":
+		return SyncOff, nil
+	case "full":
+		return SyncFull, nil
+	}
+	return 0, fmt.Errorf("unknown sync mode %q", name)
+}
+
+type Options struct {
+	PageSize   int // only used when the database is created
+	CachePages int
+	Mmap       bool   // serve page reads from a memory mapping of the file
+	ReadOnly   bool   // reject every write; the file must already exist
+	Passphrase string // encrypts a new database file; required to open an encrypted one
+	Sync       SyncMode
+
+	// give the free pages at the end of the file back on close, see
+	// Pager.Truncate
+	TruncateOnClose bool
+
+	// never write over a node of a collection's _id index, see
+	// btree.Btree.CopyOnWrite
+	CopyOnWriteIndex bool
+}
+
+// one buffer pool per supported page size and encryption, keyed by usable size
+var pagePools = make(map[int]*sync.Pool)
+
+func init() {
+	for size := MinPageSize; size <= MaxPageSize; size *= 2 {
+		for _, prologue := range []int{PagePrologueSize, oldPrologueSize} {
+			pagePools[size-prologue] = newPagePool(size - prologue)
+			pagePools[size-prologue-EncryptionOverhead] = newPagePool(size - prologue - EncryptionOverhead)
+		}
+	}
+}
+
+func newPagePool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() any {
+			return make([]byte, size)
+		},
+	}
+}
+
+func ValidPageSize(size int) bool {
+	return size >= MinPageSize && size <= MaxPageSize && size&(size-1) == 0
+}
+
+// OpenPager opens the database file together with its write-ahead log.
+// Committed frames left in the log by a crash are replayed into the
+// database file before the pager is returned. The page size of an
+// existing database is read from its header; opts only applies to new files.
+//
+// The file is locked for as long as the pager is open, exclusively by a
+// writer and shared by read-only pagers, so other processes cannot open it
+// for writing meanwhile. A read-only pager leaves the log in place and
+// serves committed frames from it instead of checkpointing.
+//
+// With opts.Passphrase a new database is encrypted page by page. Opening an
+// encrypted database without it, or with the wrong one, fails.
+//
+// Every writer that opens the database starts a new epoch, the high half
+// of the LSNs it stamps on pages.
+func OpenPager(filename string, opts *Options) (*Pager, error) {
+	return openPager(filename, opts, false)
+}
+
+// OpenForUpgrade opens a database of format 2 to 5, whose pages start with
+// a checksum but no prologue, so that nanodb upgrade can copy it into the
+// current format. Its log is checkpointed first, after that the pager is
+// read-only, but it keeps the file locked exclusively.
+func OpenForUpgrade(filename string, opts *Options) (*Pager, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	o.ReadOnly = false
+
+	return openPager(filename, &o, true)
+}
+
+// LockFile opens the database file at filename and locks it as a writer
+// does, for a caller that has to hold the lock before the file is in
+// place. OpenLocked opens the pager on it later.
+func LockFile(filename string) (*os.File, error) {
+	osFile, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(osFile, false); err != nil {
+		osFile.Close()
+		return nil, err
+	}
+	return osFile, nil
 }
 
-var pagePool = sync.Pool{
-	New: func() any {
-		return make([]byte, PageSize)
-	},
+// OpenLocked is OpenPager for a file opened with LockFile, which may have
+// been renamed to filename since. The pager takes the file over, the lock
+// is never let go in between.
+func OpenLocked(osFile *os.File, filename string, opts *Options) (*Pager, error) {
+	if opts != nil && opts.ReadOnly {
+		osFile.Close()
+		return nil, fmt.Errorf("a locked file is opened for writing")
+	}
+	return openFile(osFile, filename, opts, false)
 }
 
-func OpenPager(filename string) (*Pager, error) {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+func openPager(filename string, opts *Options, upgrade bool) (*Pager, error) {
+	readOnly := opts != nil && opts.ReadOnly
+
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+
+	osFile, err := os.OpenFile(filename, flag, 0644)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &Pager{file: file}, nil
+	if err := lockFile(osFile, readOnly); err != nil {
+		osFile.Close()
+		return nil, err
+	}
+
+	return openFile(osFile, filename, opts, upgrade)
+}
+
+// openFile opens the pager on a database file already opened and locked
+func openFile(osFile *os.File, filename string, opts *Options, upgrade bool) (*Pager, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	var err error
+	var file dbFile = osFile
+	if opts.Mmap {
+		file, err = openMmapFile(osFile, opts.ReadOnly)
+		if err != nil {
+			osFile.Close()
+			return nil, err
+		}
+	}
+
+	pageSize, err := detectPageSize(file, filename+"-wal")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if pageSize == 0 {
+		pageSize = opts.PageSize
+		if pageSize == 0 {
+			pageSize = DefaultPageSize
+		}
+	}
+
+	if !ValidPageSize(pageSize) {
+		file.Close()
+		return nil, fmt.Errorf("invalid page size %d", pageSize)
+	}
+
+	var wal *WAL
+	if opts.ReadOnly {
+		wal, err = openWALReadOnly(filename+"-wal", pageSize)
+	} else {
+		wal, err = OpenWAL(filename+"-wal", pageSize, opts.Sync)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	prologue, err := detectPrologue(wal, file, pageSize)
+	switch {
+	case upgrade && errors.Is(err, ErrNeedsUpgrade):
+		err = nil
+	case upgrade && err == nil:
+		err = fmt.Errorf("database is already in the current format")
+	}
+	if err != nil {
+		wal.Close()
+		file.Close()
+		return nil, err
+	}
+
+	// a database being upgraded is not tracked, its pages are all copied
+	var changes *changeTracker
+	if !opts.ReadOnly && !upgrade {
+		changes, err = openChangeTracker(filename+"-changes", opts.Sync)
+	}
+	if err == nil && !opts.ReadOnly {
+		err = checkpoint(wal, file, changes)
+	}
+	if err != nil {
+		if changes != nil {
+			changes.Close()
+		}
+		wal.Close()
+		file.Close()
+		return nil, err
+	}
+
+	pc, err := loadPageCipher(wal, file, pageSize, prologue, opts.Passphrase)
+	if err != nil {
+		if changes != nil {
+			changes.Close()
+		}
+		wal.Close()
+		file.Close()
+		return nil, err
+	}
+
+	cachePages := opts.CachePages
+	if cachePages <= 0 {
+		cachePages = DefaultCachePages
+	}
+
+	p := &Pager{
+		path:     filename,
+		file:     file,
+		wal:      wal,
+		pageSize: pageSize,
+		prologue: prologue,
+		readOnly: opts.ReadOnly || upgrade,
+		sync:     opts.Sync,
+		cipher:   pc,
+		changes:  changes,
+		versions: newVersionStore(),
+	}
+	p.cache = newBufferPool(cachePages, p.UsableSize(), p.storePage)
+
+	if !p.readOnly {
+		if err := p.startEpoch(); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// startEpoch counts this open in the header, so that the LSNs stamped from
+// now on are above those of every earlier session. A new database starts
+// in epoch 0 without a header.
+func (p *Pager) startEpoch() error {
+	p.Begin()
+
+	h, err := readHeader(p)
+	if errors.Is(err, ErrNoHeader) {
+		p.txMu.Unlock()
+		return nil
+	}
+	if err != nil {
+		p.txMu.Unlock()
+		return err
+	}
+
+	h.Epoch++
+	p.lsn = uint64(h.Epoch) << 32
+	return Finish(p, writeHeader(p, h), nil)
+}
+
+// detectPageSize returns the page size recorded in an existing database,
+// or 0 if neither the file nor its log hold any pages yet
+func detectPageSize(file dbFile, walName string) (int, error) {
+	raw := make([]byte, PagePrologueSize+10)
+
+	n, err := file.ReadAt(raw, 0)
+	if err == nil {
+		// format 1 files start with the header itself, there is no checksum
+		if [4]byte(raw[0:4]) == Magic {
+			return 0, fmt.Errorf("format version 1: %w", ErrNeedsUpgrade)
+		}
+		for _, prologue := range []int{PagePrologueSize, oldPrologueSize} {
+			if [4]byte(raw[prologue:prologue+4]) == Magic {
+				return int(binary.LittleEndian.Uint32(raw[prologue+6:])), nil
+			}
+		}
+		return 0, ErrNotDatabase
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, ErrNotDatabase
+	}
+
+	// a database that crashed before its first checkpoint only exists in the log
+	return walPageSize(walName)
+}
+
+// detectPrologue tells the current page layout from that of format 2 to 5
+// by where the header of page 0 starts. It looks through the log, which
+// is all there is of a database that crashed before its first checkpoint.
+func detectPrologue(wal *WAL, file dbFile, pageSize int) (int, error) {
+	raw := make([]byte, pageSize)
+
+	err := wal.ReadPage(0, raw, file)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return PagePrologueSize, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if [4]byte(raw[PagePrologueSize:PagePrologueSize+4]) == Magic {
+		return PagePrologueSize, nil
+	}
+	if [4]byte(raw[oldPrologueSize:oldPrologueSize+4]) == Magic {
+		version := binary.LittleEndian.Uint16(raw[oldPrologueSize+4:]) &^ encryptedFlag
+		return oldPrologueSize, fmt.Errorf("format version %d: %w", version, ErrNeedsUpgrade)
+	}
+	return 0, ErrNotDatabase
+}
+
+// PageSize is the size of a page on disk
+func (p *Pager) PageSize() int {
+	return p.pageSize
+}
+
+func (p *Pager) ReadOnly() bool {
+	return p.readOnly
 }
 
+// UsableSize is the size of the page body handed out by ReadPage and GetBuff
+func (p *Pager) UsableSize() int {
+	if p.cipher != nil {
+		return p.pageSize - p.prologue - EncryptionOverhead
+	}
+	return p.pageSize - p.prologue
+}
+
+// ReadPage returns a private copy of the page body that the caller may
+// modify and must hand back with ReleasePageBuffer.
 func (p *Pager) ReadPage(pageNum uint32) ([]byte, error) {
-	buff := pagePool.Get().([]byte)
-	_, err := p.file.ReadAt(buff, int64(pageNum)*PageSize)
+	data, err := p.PinPage(pageNum)
 	if err != nil {
-		pagePool.Put(buff)
 		return nil, err
 	}
+
+	buff := p.GetBuff()
+	copy(buff, data)
+	p.UnpinPage(pageNum)
+
 	return buff, nil
 }
 
+// PinPage returns the cached image of the page without copying it and
+// keeps it resident until UnpinPage. The slice must not be modified.
+func (p *Pager) PinPage(pageNum uint32) ([]byte, error) {
+	data, _, err := p.cache.pin(pageNum, func(body []byte) (PagePrologue, error) {
+		return p.loadPage(pageNum, body)
+	})
+	return data, err
+}
+
+// Prologue returns what the newest image of a page says about itself
+func (p *Pager) Prologue(pageNum uint32) (PagePrologue, error) {
+	_, pr, err := p.cache.pin(pageNum, func(body []byte) (PagePrologue, error) {
+		return p.loadPage(pageNum, body)
+	})
+	if err != nil {
+		return PagePrologue{}, err
+	}
+
+	p.cache.unpin(pageNum)
+	return pr, nil
+}
+
+// loadPage reads the newest on-disk image of a page and verifies its checksum
+func (p *Pager) loadPage(pageNum uint32, body []byte) (pr PagePrologue, err error) {
+	if p.closed.Load() {
+		return PagePrologue{}, ErrClosed
+	}
+	err = p.wal.ViewPage(pageNum, p.file, func(raw []byte) error {
+		pr, err = p.decode(pageNum, raw, body)
+		return err
+	})
+	return pr, err
+}
+
+// loadCommitted is loadPage for the image of the last commit, ignoring
+// frames a running write has already logged
+func (p *Pager) loadCommitted(pageNum uint32, body []byte) (pr PagePrologue, err error) {
+	if p.closed.Load() {
+		return PagePrologue{}, ErrClosed
+	}
+	err = p.wal.ViewCommitted(pageNum, p.file, func(raw []byte) error {
+		pr, err = p.decode(pageNum, raw, body)
+		return err
+	})
+	return pr, err
+}
+
+func (p *Pager) decode(pageNum uint32, raw []byte, body []byte) (PagePrologue, error) {
+	if p.cipher != nil {
+		return p.cipher.decode(pageNum, raw, body, p.prologue)
+	}
+	return decodePage(pageNum, raw, body, p.prologue)
+}
+
+// Snapshot returns a read-only view of the database as of the last commit
+func (p *Pager) Snapshot() (*Snapshot, error) {
+	if p.readOnly {
+		return &Snapshot{store: p, lsn: math.MaxUint64}, nil
+	}
+
+	p.versions.mu.Lock()
+	defer p.versions.mu.Unlock()
+	return p.versions.open(p, p.lsn), nil
+}
+
+// readAt returns the image of a page a snapshot at lsn sees: the cached one
+// unless a later write replaced it, then the last committed one unless a
+// later commit replaced it, then the one that commit kept
+func (p *Pager) readAt(pageNum uint32, lsn uint64) ([]byte, PagePrologue, error) {
+	// frames are replaced rather than modified, so the image outlives the pin
+	data, pr, err := p.cache.pin(pageNum, func(body []byte) (PagePrologue, error) {
+		return p.loadPage(pageNum, body)
+	})
+	if err == nil {
+		p.cache.unpin(pageNum)
+		if pr.LSN < lsn {
+			return data, pr, nil
+		}
+
+		body := make([]byte, p.UsableSize())
+		if pr, err = p.loadCommitted(pageNum, body); err == nil && pr.LSN < lsn {
+			return body, pr, nil
+		}
+	}
+
+	// pages freed and truncated away since the snapshot only have versions
+	if data, pr, ok := p.versions.find(pageNum, lsn); ok {
+		return data, pr, nil
+	}
+	if err != nil {
+		return nil, PagePrologue{}, err
+	}
+	return nil, PagePrologue{}, visibleAt(pageNum, lsn)
+}
+
+// keepVersions saves the committed images of the pages about to be
+// replaced for the open snapshots, the caller holds versions.mu
+func (p *Pager) keepVersions() error {
+	if !p.versions.active() {
+		return nil
+	}
+
+	for _, pageNum := range p.wal.Uncommitted() {
+		body := make([]byte, p.UsableSize())
+		pr, err := p.loadCommitted(pageNum, body)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			continue // allocated by this write
+		}
+		if err != nil {
+			return err
+		}
+		p.versions.keep(pageNum, pr, body, p.lsn)
+	}
+	return nil
+}
+
+// storePage stamps a page body with its prologue and checksum, encrypting
+// it first if needed, and appends it to the log
+func (p *Pager) storePage(pageNum uint32, pr PagePrologue, body []byte) error {
+	if p.cipher != nil {
+		return p.wal.AppendPage(pageNum, p.cipher.encode(pageNum, pr, body))
+	}
+	return p.wal.AppendPage(pageNum, encodePage(pr, body))
+}
+
+func (p *Pager) UnpinPage(pageNum uint32) {
+	p.cache.unpin(pageNum)
+}
+
+func (p *Pager) CacheStats() CacheStats {
+	return p.cache.stats()
+}
+
 func ReleasePageBuffer(b []byte) {
-	if cap(b) != PageSize {
+	pool, ok := pagePools[cap(b)]
+	if !ok {
 		panic(fmt.Sprintf("ReleasePageBuffer: attempting to release invalid buffer with cap %d", cap(b)))
 	}
-	pagePool.Put(b)
+	pool.Put(b[:cap(b)])
 }
 
-func GetBuff() []byte {
-	b := pagePool.Get().([]byte)
+func (p *Pager) GetBuff() []byte {
+	b := pagePools[p.UsableSize()].Get().([]byte)
 	return b
 }
 
-func (p *Pager) WritePage(pageNum uint32, data []byte) error {
-	_, err := p.file.WriteAt(data, int64(pageNum)*PageSize)
+// WritePage stores the page image in the cache as a dirty frame, labelled
+// with kind and the LSN of the running transaction. Dirty frames reach the
+// write-ahead log on commit or when they are evicted.
+func (p *Pager) WritePage(pageNum uint32, kind PageType, data []byte) error {
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	if p.backup != nil {
+		p.backup[pageNum] = struct{}{}
+	}
+	return p.cache.put(pageNum, PagePrologue{Type: kind, LSN: p.lsn}, data)
+}
+
+// Begin starts a write. Writes are serialised across the whole database
+// so that every commit marker covers exactly one writer's pages.
+func (p *Pager) Begin() {
+	p.txMu.Lock()
+}
+
+// Commit logs the pages dirtied since Begin, seals them with a commit
+// marker and checkpoints the log once it grows past walAutoCheckpoint frames.
+// With SyncNormal it then waits for the log to reach disk after letting
+// the next writer in, so that writers committing meanwhile share the sync.
+// If the pages or the marker cannot be logged the write stays open for
+// Rollback.
+func (p *Pager) Commit() error {
+	seq, err := p.commit()
+	if err != nil || p.sync != SyncNormal {
+		return err
+	}
+
+	if err := p.wal.SyncTo(seq); err != nil {
+		return fmt.Errorf("%w, but not synced: %w", ErrAfterCommit, err)
+	}
+	return nil
+}
+
+func (p *Pager) commit() (uint64, error) {
+	if p.readOnly {
+		return 0, ErrReadOnly
+	}
+	if p.closed.Load() {
+		return 0, ErrClosed
+	}
+
+	if err := p.cache.flush(); err != nil {
+		return 0, err
+	}
+
+	// snapshots are opened either before the commit or after it, never
+	// between keeping what it replaces and moving to the next LSN
+	p.versions.mu.Lock()
+	if err := p.keepVersions(); err != nil {
+		p.versions.mu.Unlock()
+		return 0, err
+	}
+	seq, err := p.wal.AppendCommit()
+	if err != nil {
+		p.versions.mu.Unlock()
+		return 0, err
+	}
+	p.lsn++
+	p.versions.mu.Unlock()
+
+	defer p.txMu.Unlock()
+
+	// a checkpoint that fails leaves the log as it was, with the commit in it
+	if p.wal.Frames() >= walAutoCheckpoint {
+		if err := checkpoint(p.wal, p.file, p.changes); err != nil {
+			return seq, fmt.Errorf("%w, but not checkpointed: %w", ErrAfterCommit, err)
+		}
+	}
+	return seq, nil
+}
+
+// Rollback ends a write without committing it. The pages written since
+// Begin are dropped from the cache and the log, so they read as they were
+// at the last commit again.
+func (p *Pager) Rollback() error {
+	defer p.txMu.Unlock()
+
+	if p.readOnly || p.closed.Load() {
+		return nil
+	}
+
+	pages, err := p.wal.Rollback()
+	p.cache.rollback(pages)
 	return err
 }
 
+// Checkpoint copies every logged page back into the database file.
+func (p *Pager) Checkpoint() error {
+	if p.readOnly {
+		return nil
+	}
+
+	p.txMu.Lock()
+	defer p.txMu.Unlock()
+
+	if p.closed.Load() {
+		return ErrClosed
+	}
+	if err := p.cache.flush(); err != nil {
+		return err
+	}
+
+	return checkpoint(p.wal, p.file, p.changes)
+}
+
+// Sync forces the database file and the log, with every commit in it, to
+// stable storage
+func (p *Pager) Sync() error {
+	if p.readOnly {
+		return nil
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	return p.wal.SyncTo(math.MaxUint64)
+}
+
+// checkpoint marks the logged pages as changed since the last backup and
+// copies them into the database file
+func checkpoint(wal *WAL, file dbFile, changes *changeTracker) error {
+	if changes != nil {
+		if err := changes.mark(wal.Pages()); err != nil {
+			return err
+		}
+	}
+	return wal.Checkpoint(file)
+}
+
+// ReplaceFile renames the database file at src over the pager's file and
+// closes the pager, inside the write the caller began so that no commit
+// lands in between. The log is checkpointed first, leaving nothing in it
+// for the new file to recover. If the rename fails the write is rolled
+// back and the pager carries on with its own file; after it, every read
+// and write fails with ErrClosed, including those waiting for the lock.
+// The caller locks src beforehand and syncs the directory after, the
+// lock on the replaced file goes with it.
+func (p *Pager) ReplaceFile(src string) error {
+	if p.readOnly {
+		p.txMu.Unlock()
+		return ErrReadOnly
+	}
+
+	err := p.cache.flush()
+	if err == nil {
+		err = checkpoint(p.wal, p.file, p.changes)
+	}
+	// every page moves, so earlier backups cannot be built on; removing
+	// the tracker first means a fresh one is started even after a crash
+	if err == nil {
+		err = os.Remove(p.changes.file.Name())
+	}
+	if err == nil {
+		err = os.Rename(src, p.path)
+	}
+	if err != nil {
+		return errors.Join(err, p.Rollback())
+	}
+
+	defer p.txMu.Unlock()
+
+	// reads fail from here on too, none are served from the cache
+	p.closed.Store(true)
+	p.cache.discard(0)
+
+	// the log is empty and the file out of place, errors closing them
+	// change nothing
+	walName := p.wal.file.Name()
+	p.wal.Close()
+	p.changes.Close()
+	p.file.Close()
+	os.Remove(walName)
+	return nil
+}
+
+// Close checkpoints the log and closes the files. Every file is closed
+// even when something fails first, so that the descriptor and the lock are
+// not kept until the process exits. The log is only removed once all of
+// it is in the database file.
 func (p *Pager) Close() error {
-	return p.file.Close()
+	if p.readOnly {
+		return errors.Join(p.wal.Close(), p.file.Close())
+	}
+
+	err := p.Checkpoint()
+
+	walName := p.wal.file.Name()
+	err = errors.Join(err, p.wal.Close(), p.changes.Close())
+	if err == nil {
+		err = os.Remove(walName)
+	}
+
+	return errors.Join(err, p.file.Close())
 }
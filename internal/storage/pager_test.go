@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestValidPageSize(t *testing.T) {
+	for size, want := range map[int]bool{
+		2048:    false,
+		4096:    true,
+		6144:    false,
+		16384:   true,
+		65536:   true,
+		1 << 17: false,
+	} {
+		if ValidPageSize(size) != want {
+			t.Errorf("ValidPageSize(%d) = %v", size, !want)
+		}
+	}
+
+	if _, err := OpenPager(filepath.Join(t.TempDir(), "p.db"), &Options{PageSize: 6144}); err == nil {
+		t.Fatal("opened a database with 6144 byte pages")
+	}
+}
+
+func TestPageSizeIsReadFromTheHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "p.db")
+
+	p, err := OpenPager(path, &Options{PageSize: 16384, Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestDatabase(t, p)
+	if h.PageSize != 16384 || p.UsableSize() != 16384-PagePrologueSize {
+		t.Fatalf("new database has %d byte pages, %d usable", h.PageSize, p.UsableSize())
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the size asked for only applies to new files
+	p, err = OpenPager(path, &Options{PageSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if p.PageSize() != 16384 {
+		t.Fatalf("reopened with %d byte pages, want 16384", p.PageSize())
+	}
+	h, err = p.ReadHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.PageSize != 16384 {
+		t.Fatalf("header records %d byte pages", h.PageSize)
+	}
+}
+
+// a database that crashed before its first checkpoint has its page size
+// in the log only
+func TestPageSizeIsReadFromTheLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "p.db")
+
+	p, err := OpenPager(path, &Options{PageSize: 32768, Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestDatabase(t, p)
+	crashed := crashImage(t, path)
+	p.Close()
+
+	p, err = OpenPager(crashed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if p.PageSize() != 32768 {
+		t.Fatalf("recovered with %d byte pages, want 32768", p.PageSize())
+	}
+}
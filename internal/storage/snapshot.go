@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Snapshot is a read-only PageStore showing a store as it was at one
+// commit. Later writes do not change what it reads and do not wait for
+// it: a commit keeps the images it replaces for as long as a snapshot
+// taken before it is open, so snapshots should be closed as soon as they
+// are done with. A Snapshot is safe for concurrent use.
+type Snapshot struct {
+	store    versioned
+	versions *versionStore // nil for a store that is never written
+	lsn      uint64        // commits below it are visible
+	closed   atomic.Bool
+}
+
+// versioned is a store that can read its pages as of an earlier commit
+type versioned interface {
+	PageStore
+	readAt(pageNum uint32, lsn uint64) ([]byte, PagePrologue, error)
+}
+
+// versionStore keeps the images pages had before a commit replaced them,
+// for as long as a snapshot that cannot see the commit is open
+type versionStore struct {
+	mu        sync.Mutex
+	snapshots map[uint64]int // open snapshots by LSN
+	pages     map[uint32][]pageVersion
+}
+
+type pageVersion struct {
+	prologue PagePrologue // its LSN is that of the commit that wrote the image
+	until    uint64       // LSN of the commit that replaced it
+	data     []byte
+}
+
+func newVersionStore() *versionStore {
+	return &versionStore{snapshots: make(map[uint64]int), pages: make(map[uint32][]pageVersion)}
+}
+
+// open registers a snapshot at lsn, the caller holds mu
+func (vs *versionStore) open(store versioned, lsn uint64) *Snapshot {
+	vs.snapshots[lsn]++
+	return &Snapshot{store: store, versions: vs, lsn: lsn}
+}
+
+func (vs *versionStore) release(lsn uint64) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	vs.snapshots[lsn]--
+	if vs.snapshots[lsn] == 0 {
+		delete(vs.snapshots, lsn)
+	}
+
+	if len(vs.snapshots) == 0 {
+		clear(vs.pages)
+		return
+	}
+
+	// a version is seen by the snapshots from just above its own LSN up
+	// to the commit that replaced it
+	oldest := uint64(math.MaxUint64)
+	for lsn := range vs.snapshots {
+		oldest = min(oldest, lsn)
+	}
+	for pageNum, versions := range vs.pages {
+		kept := versions[:0]
+		for _, v := range versions {
+			if v.until >= oldest {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == 0 {
+			delete(vs.pages, pageNum)
+		} else {
+			vs.pages[pageNum] = kept
+		}
+	}
+}
+
+// active reports whether a commit has to keep what it replaces, the caller
+// holds mu
+func (vs *versionStore) active() bool {
+	return len(vs.snapshots) > 0
+}
+
+// keep saves the image pageNum had before the commit at until, unless no
+// open snapshot can see it. The caller holds mu.
+func (vs *versionStore) keep(pageNum uint32, pr PagePrologue, data []byte, until uint64) {
+	for lsn := range vs.snapshots {
+		if pr.LSN < lsn {
+			vs.pages[pageNum] = append(vs.pages[pageNum], pageVersion{prologue: pr, until: until, data: data})
+			return
+		}
+	}
+}
+
+// find returns the kept image of pageNum a snapshot at lsn sees
+func (vs *versionStore) find(pageNum uint32, lsn uint64) ([]byte, PagePrologue, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	for _, v := range vs.pages[pageNum] {
+		if v.prologue.LSN < lsn && lsn <= v.until {
+			return v.data, v.prologue, true
+		}
+	}
+	return nil, PagePrologue{}, false
+}
+
+// visibleAt is the error of a page a snapshot has no image of
+func visibleAt(pageNum uint32, lsn uint64) error {
+	return fmt.Errorf("page %d has no version visible at LSN %x", pageNum, lsn)
+}
+
+// LSN is the LSN of the first commit the snapshot does not see
+func (s *Snapshot) LSN() uint64 {
+	return s.lsn
+}
+
+func (s *Snapshot) PageSize() int {
+	return s.store.PageSize()
+}
+
+func (s *Snapshot) UsableSize() int {
+	return s.store.UsableSize()
+}
+
+func (s *Snapshot) ReadOnly() bool {
+	return true
+}
+
+func (s *Snapshot) ReadPage(pageNum uint32) ([]byte, error) {
+	data, _, err := s.store.readAt(pageNum, s.lsn)
+	if err != nil {
+		return nil, err
+	}
+
+	buff := s.GetBuff()
+	copy(buff, data)
+	return buff, nil
+}
+
+// PinPage needs no pin, the images a snapshot reads are never modified
+func (s *Snapshot) PinPage(pageNum uint32) ([]byte, error) {
+	data, _, err := s.store.readAt(pageNum, s.lsn)
+	return data, err
+}
+
+func (s *Snapshot) UnpinPage(pageNum uint32) {}
+
+func (s *Snapshot) WritePage(pageNum uint32, kind PageType, data []byte) error {
+	return ErrReadOnly
+}
+
+func (s *Snapshot) Prologue(pageNum uint32) (PagePrologue, error) {
+	_, pr, err := s.store.readAt(pageNum, s.lsn)
+	return pr, err
+}
+
+func (s *Snapshot) GetBuff() []byte {
+	return s.store.GetBuff()
+}
+
+func (s *Snapshot) ReadHeader() (*DBHeader, error) {
+	return readHeader(s)
+}
+
+func (s *Snapshot) WriteHeader(h *DBHeader) error {
+	return ErrReadOnly
+}
+
+func (s *Snapshot) AllocatePage(h *DBHeader) (uint32, error) {
+	return 0, ErrReadOnly
+}
+
+func (s *Snapshot) FreePage(h *DBHeader, pageNum uint32) error {
+	return ErrReadOnly
+}
+
+func (s *Snapshot) Truncate(h *DBHeader) (uint32, error) {
+	return 0, ErrReadOnly
+}
+
+func (s *Snapshot) Begin() {}
+
+func (s *Snapshot) Commit() error {
+	return ErrReadOnly
+}
+
+func (s *Snapshot) Rollback() error {
+	return nil
+}
+
+func (s *Snapshot) Checkpoint() error {
+	return nil
+}
+
+// Snapshot opens another snapshot at the same commit
+func (s *Snapshot) Snapshot() (*Snapshot, error) {
+	if s.versions == nil {
+		return &Snapshot{store: s.store, lsn: s.lsn}, nil
+	}
+
+	s.versions.mu.Lock()
+	defer s.versions.mu.Unlock()
+	return s.versions.open(s.store, s.lsn), nil
+}
+
+func (s *Snapshot) Sync() error {
+	return nil
+}
+
+// Close lets the store drop the page versions kept for the snapshot
+func (s *Snapshot) Close() error {
+	if s.closed.Swap(true) || s.versions == nil {
+		return nil
+	}
+
+	s.versions.release(s.lsn)
+	return nil
+}
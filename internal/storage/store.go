@@ -0,0 +1,87 @@
+package storage
+
+import "errors"
+
+// PageStore is what the layers above storage need from a database: page
+// access, the header and free list, write transactions and syncing. Pager
+// keeps pages in a file; MemPager keeps them in memory. What only some
+// stores can do is in Snapshotter and Backuper.
+type PageStore interface {
+	PageSize() int
+	UsableSize() int
+	ReadOnly() bool
+
+	ReadPage(pageNum uint32) ([]byte, error)
+	PinPage(pageNum uint32) ([]byte, error)
+	UnpinPage(pageNum uint32)
+	WritePage(pageNum uint32, kind PageType, data []byte) error
+	Prologue(pageNum uint32) (PagePrologue, error)
+	GetBuff() []byte
+
+	ReadHeader() (*DBHeader, error)
+	WriteHeader(h *DBHeader) error
+	AllocatePage(h *DBHeader) (uint32, error)
+	FreePage(h *DBHeader, pageNum uint32) error
+	Truncate(h *DBHeader) (uint32, error)
+
+	// Begin starts a write, Commit or Rollback ends it. A Commit that
+	// fails leaves the write open to be rolled back, unless the error is
+	// an ErrAfterCommit.
+	Begin()
+	Commit() error
+	Rollback() error
+	Checkpoint() error
+	// Sync forces every commit made so far to stable storage, whatever
+	// the store's sync mode
+	Sync() error
+	Close() error
+}
+
+// Snapshotter is a PageStore that can be read as of its last commit while
+// writes go on, see Snapshot
+type Snapshotter interface {
+	Snapshot() (*Snapshot, error)
+}
+
+// Backuper is a PageStore that can copy itself to a backup file
+type Backuper interface {
+	Backup(path string) error
+	BackupIncremental(path string) error
+}
+
+// ErrAfterCommit wraps the errors of what Commit does once the commit is
+// made: syncing the log in SyncNormal and checkpointing it. The write is
+// committed and visible, though it may not survive a crash.
+var ErrAfterCommit = errors.New("committed")
+
+// Finish ends the write begun on s. It commits when err is nil, and when
+// err is not or the commit fails it calls undo, if any, to put back the
+// in-memory state the write changed and rolls the write back. It returns
+// err or the error of the commit.
+func Finish(s PageStore, err error, undo func()) error {
+	if err == nil {
+		err = s.Commit()
+		if err == nil || errors.Is(err, ErrAfterCommit) {
+			return err
+		}
+	}
+
+	if undo != nil {
+		undo()
+	}
+	if rollbackErr := s.Rollback(); rollbackErr != nil {
+		return rollbackErr
+	}
+	return err
+}
+
+// MemoryPath opens a database that only lives in memory
+const MemoryPath = ":memory:"
+
+// Open returns a MemPager for MemoryPath and a file-backed Pager otherwise
+func Open(filename string, opts *Options) (PageStore, error) {
+	if filename == MemoryPath {
+		return NewMemPager(opts)
+	}
+	return OpenPager(filename, opts)
+}
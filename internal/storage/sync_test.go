@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestParseSyncMode(t *testing.T) {
+	for name, want := range map[string]SyncMode{"": SyncNormal, "normal": SyncNormal, "off": SyncOff, "full": SyncFull} {
+		if mode, err := ParseSyncMode(name); err != nil || mode != want {
+			t.Errorf("ParseSyncMode(%q) = %v, %v", name, mode, err)
+		}
+	}
+	if _, err := ParseSyncMode("sometimes"); err == nil {
+		t.Fatal("parsed an unknown sync mode")
+	}
+}
+
+// one sync covers every commit appended before it started
+func TestSyncToCoversEarlierCommits(t *testing.T) {
+	w, err := OpenWAL(filepath.Join(t.TempDir(), "db-wal"), testPageSize, SyncNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var seqs []uint64
+	for i := range 3 {
+		w.AppendPage(uint32(i+1), filled('s'))
+		seq, err := w.AppendCommit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, seq)
+	}
+	if w.synced != 0 {
+		t.Fatalf("%d commits synced before any sync", w.synced)
+	}
+
+	if err := w.SyncTo(seqs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if w.synced != seqs[2] {
+		t.Fatalf("sync for commit %d covered up to %d, want %d", seqs[0], w.synced, seqs[2])
+	}
+}
+
+func TestSyncFullSyncsEveryCommit(t *testing.T) {
+	w, err := OpenWAL(filepath.Join(t.TempDir(), "db-wal"), testPageSize, SyncFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.AppendPage(1, filled('f'))
+	seq, err := w.AppendCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.synced != seq {
+		t.Fatalf("commit %d not synced as it was appended", seq)
+	}
+}
+
+func TestConcurrentCommits(t *testing.T) {
+	for name, mode := range map[string]SyncMode{"off": SyncOff, "normal": SyncNormal, "full": SyncFull} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "s.db")
+			p, err := OpenPager(path, &Options{Sync: mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := newTestDatabase(t, p)
+
+			var wg sync.WaitGroup
+			for i := range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range 20 {
+						p.Begin()
+						pageNum, _ := p.AllocatePage(h)
+						writeFilled(t, p, pageNum, byte('a'+i))
+						p.WriteHeader(h)
+						if err := Finish(p, nil, nil); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if p.wal.synced != 0 && mode == SyncOff {
+				t.Fatal("synced with sync off")
+			}
+			if mode == SyncNormal && p.wal.synced != p.wal.commits {
+				t.Fatalf("%d of %d commits synced", p.wal.synced, p.wal.commits)
+			}
+			if err := p.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			p, err = OpenPager(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			h, err = p.ReadHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.PageCount != 1+8*20 {
+				t.Fatalf("%d pages after reopening, want %d", h.PageCount, 1+8*20)
+			}
+		})
+	}
+}
+
+// an explicit sync covers the commits SyncOff left unsynced
+func TestPagerSync(t *testing.T) {
+	p, err := OpenPager(filepath.Join(t.TempDir(), "p.db"), &Options{Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	h := newTestDatabase(t, p)
+	p.Begin()
+	pageNum, _ := p.AllocatePage(h)
+	writeFilled(t, p, pageNum, 's')
+	if err := p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if p.wal.synced == p.wal.commits {
+		t.Fatal("commit synced with SyncOff")
+	}
+
+	if err := p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if p.wal.synced != p.wal.commits {
+		t.Fatalf("%d of %d commits synced after Sync", p.wal.synced, p.wal.commits)
+	}
+}
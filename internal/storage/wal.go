@@ -0,0 +1,455 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+)
+
+// frame layout: [pageNum 4] [flags 4] [crc 4] [pageSize 4] [page image]
+// commit frames carry no page image
+
+const walFrameHeaderSize = 16
+
+const (
+	walFramePage   uint32 = 0
+	walFrameCommit uint32 = 1
+)
+
+// checkpoint once the log holds this many page frames
+const walAutoCheckpoint = 1000
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type WAL struct {
+	file     *os.File
+	pageSize int
+	sync     SyncMode
+	mu       sync.RWMutex
+	size     int64
+	index    map[uint32]int64 // page -> offset of its newest frame
+	frames   int
+	commits  uint64 // commit markers appended since open
+	synced   uint64 // commits known to be on stable storage
+	syncMu   sync.Mutex
+
+	// where the log stood at the last commit marker, for Rollback
+	committed       int64
+	committedFrames int
+	undo            map[uint32]int64 // page -> its offset then, -1 for none
+}
+
+func OpenWAL(filename string, pageSize int, mode SyncMode) (*WAL, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{file: file, pageSize: pageSize, sync: mode, index: make(map[uint32]int64), undo: make(map[uint32]int64)}
+
+	if err := w.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// openWALReadOnly indexes the committed frames of an existing log without
+// modifying it. A missing log is treated as empty.
+func openWALReadOnly(filename string, pageSize int) (*WAL, error) {
+	w := &WAL{pageSize: pageSize, index: make(map[uint32]int64)}
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w.file = file
+	if err := w.scan(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// replay rebuilds the index from every committed frame and cuts off
+// anything written after the last commit marker
+func (w *WAL) replay() error {
+	if err := w.scan(); err != nil {
+		return err
+	}
+	return w.file.Truncate(w.size)
+}
+
+// scan indexes every frame up to the last commit marker and sets size to
+// the end of that marker
+func (w *WAL) scan() error {
+	header := make([]byte, walFrameHeaderSize)
+	page := make([]byte, w.pageSize)
+
+	pending := make(map[uint32]int64)
+	pendingFrames := 0
+
+	var offset int64
+	var committed int64
+
+	for {
+		if _, err := w.file.ReadAt(header, offset); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+
+		pageNum := binary.LittleEndian.Uint32(header[0:4])
+		flags := binary.LittleEndian.Uint32(header[4:8])
+		sum := binary.LittleEndian.Uint32(header[8:12])
+
+		if flags == walFrameCommit {
+			if crc32.Checksum(header[0:8], castagnoli) != sum {
+				break
+			}
+
+			offset += walFrameHeaderSize
+			for pg, off := range pending {
+				w.index[pg] = off
+			}
+			w.frames += pendingFrames
+			clear(pending)
+			pendingFrames = 0
+			committed = offset
+			continue
+		}
+
+		if _, err := w.file.ReadAt(page, offset+walFrameHeaderSize); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break // torn frame at the tail
+			}
+			return err
+		}
+
+		crc := crc32.Update(crc32.Checksum(header[0:8], castagnoli), castagnoli, page)
+		if crc != sum {
+			break
+		}
+
+		pending[pageNum] = offset
+		pendingFrames++
+		offset += walFrameHeaderSize + int64(w.pageSize)
+	}
+
+	w.size = committed
+	w.committed = committed
+	w.committedFrames = w.frames
+	return nil
+}
+
+// walPageSize returns the page size recorded in the first frame of a log,
+// or 0 if there is no log
+func walPageSize(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, walFrameHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	pageSize := int(binary.LittleEndian.Uint32(header[12:16]))
+	if !ValidPageSize(pageSize) {
+		return 0, nil // torn first frame, replay will discard it
+	}
+	return pageSize, nil
+}
+
+func (w *WAL) appendFrame(pageNum uint32, flags uint32, data []byte) error {
+	frame := make([]byte, walFrameHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(frame[0:4], pageNum)
+	binary.LittleEndian.PutUint32(frame[4:8], flags)
+	binary.LittleEndian.PutUint32(frame[12:16], uint32(w.pageSize))
+	copy(frame[walFrameHeaderSize:], data)
+
+	crc := crc32.Checksum(frame[0:8], castagnoli)
+	crc = crc32.Update(crc, castagnoli, data)
+	binary.LittleEndian.PutUint32(frame[8:12], crc)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.WriteAt(frame, w.size); err != nil {
+		return err
+	}
+
+	if w.sync == SyncFull {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if flags == walFramePage {
+		if _, ok := w.undo[pageNum]; !ok {
+			w.undo[pageNum] = -1
+			if offset, ok := w.index[pageNum]; ok {
+				w.undo[pageNum] = offset
+			}
+		}
+		w.index[pageNum] = w.size
+		w.frames++
+	} else {
+		w.commits++
+		if w.sync == SyncFull {
+			w.synced = w.commits
+		}
+	}
+	w.size += int64(len(frame))
+
+	if flags == walFrameCommit {
+		w.committed = w.size
+		w.committedFrames = w.frames
+		clear(w.undo)
+	}
+	return nil
+}
+
+func (w *WAL) AppendPage(pageNum uint32, data []byte) error {
+	return w.appendFrame(pageNum, walFramePage, data[:w.pageSize])
+}
+
+// AppendCommit seals the frames written since the last commit and returns
+// the sequence number of the commit for SyncTo
+func (w *WAL) AppendCommit() (uint64, error) {
+	if err := w.appendFrame(0, walFrameCommit, nil); err != nil {
+		return 0, err
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.commits, nil
+}
+
+// SyncTo returns once commit seq is on stable storage. Committers that
+// queue up behind a running fsync are all covered by the next one, so
+// concurrent writers share a single sync.
+func (w *WAL) SyncTo(seq uint64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	w.mu.RLock()
+	synced, commits := w.synced, w.commits
+	w.mu.RUnlock()
+
+	if synced >= seq {
+		return nil
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.synced = max(w.synced, commits)
+	w.mu.Unlock()
+	return nil
+}
+
+// Rollback cuts off the frames appended since the last commit marker and
+// returns the pages they held
+func (w *WAL) Rollback() ([]uint32, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pages := make([]uint32, 0, len(w.undo))
+	for pageNum, offset := range w.undo {
+		if offset < 0 {
+			delete(w.index, pageNum)
+		} else {
+			w.index[pageNum] = offset
+		}
+		pages = append(pages, pageNum)
+	}
+	clear(w.undo)
+	w.frames = w.committedFrames
+
+	if w.size == w.committed {
+		return pages, nil
+	}
+	w.size = w.committed
+	return pages, w.file.Truncate(w.committed)
+}
+
+// ReadPage copies the newest logged image of pageNum into buff, falling
+// back to the main database file when the page has no frame in the log.
+func (w *WAL) ReadPage(pageNum uint32, buff []byte, db dbFile) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if offset, ok := w.index[pageNum]; ok {
+		_, err := w.file.ReadAt(buff[:w.pageSize], offset+walFrameHeaderSize)
+		return err
+	}
+
+	_, err := db.ReadAt(buff[:w.pageSize], int64(pageNum)*int64(w.pageSize))
+	return err
+}
+
+// ReadCommitted is ReadPage ignoring the frames appended since the last
+// commit marker
+func (w *WAL) ReadCommitted(pageNum uint32, buff []byte, db dbFile) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	offset, ok := w.undo[pageNum]
+	if !ok {
+		offset, ok = w.index[pageNum]
+	}
+	if ok && offset >= 0 {
+		_, err := w.file.ReadAt(buff[:w.pageSize], offset+walFrameHeaderSize)
+		return err
+	}
+
+	_, err := db.ReadAt(buff[:w.pageSize], int64(pageNum)*int64(w.pageSize))
+	return err
+}
+
+// ViewPage is ReadPage handing the image to fn, in place when the page is
+// in a main file that can lend out its bytes. fn must not keep the image.
+func (w *WAL) ViewPage(pageNum uint32, db dbFile, fn func(raw []byte) error) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	offset, ok := w.index[pageNum]
+	return w.view(pageNum, offset, ok, db, fn)
+}
+
+// ViewCommitted is ViewPage ignoring the frames appended since the last
+// commit marker
+func (w *WAL) ViewCommitted(pageNum uint32, db dbFile, fn func(raw []byte) error) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	offset, ok := w.undo[pageNum]
+	if !ok {
+		offset, ok = w.index[pageNum]
+	}
+	return w.view(pageNum, offset, ok && offset >= 0, db, fn)
+}
+
+// view runs fn on the frame at offset when logged, else on the page in db
+func (w *WAL) view(pageNum uint32, offset int64, logged bool, db dbFile, fn func(raw []byte) error) error {
+	if v, ok := db.(pageViewer); ok && !logged {
+		return v.view(int64(pageNum)*int64(w.pageSize), w.pageSize, fn)
+	}
+
+	raw := make([]byte, w.pageSize)
+	var err error
+	if logged {
+		_, err = w.file.ReadAt(raw, offset+walFrameHeaderSize)
+	} else {
+		_, err = db.ReadAt(raw, int64(pageNum)*int64(w.pageSize))
+	}
+	if err != nil {
+		return err
+	}
+	return fn(raw)
+}
+
+// Uncommitted returns the pages with a frame appended since the last
+// commit marker
+func (w *WAL) Uncommitted() []uint32 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return slices.Collect(maps.Keys(w.undo))
+}
+
+// Pages returns the pages that have a frame in the log
+func (w *WAL) Pages() []uint32 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return slices.Collect(maps.Keys(w.index))
+}
+
+func (w *WAL) Frames() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.frames
+}
+
+// Checkpoint copies the newest image of every logged page into the main
+// database file, syncs it unless running with SyncOff and resets the log.
+func (w *WAL) Checkpoint(db dbFile) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.index) == 0 {
+		return nil
+	}
+
+	buff := make([]byte, w.pageSize)
+
+	// highest page first, so the file grows at most once
+	pages := slices.Sorted(maps.Keys(w.index))
+	slices.Reverse(pages)
+
+	for _, pageNum := range pages {
+		offset := w.index[pageNum]
+		if _, err := w.file.ReadAt(buff, offset+walFrameHeaderSize); err != nil {
+			return err
+		}
+		if _, err := db.WriteAt(buff, int64(pageNum)*int64(w.pageSize)); err != nil {
+			return err
+		}
+	}
+
+	if w.sync != SyncOff {
+		if err := db.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if w.sync != SyncOff {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		w.synced = w.commits
+	}
+
+	clear(w.index)
+	clear(w.undo)
+	w.size = 0
+	w.frames = 0
+	w.committed = 0
+	w.committedFrames = 0
+	return nil
+}
+
+func (w *WAL) Sync() error {
+	return w.file.Sync()
+}
+
+func (w *WAL) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const testPageSize = 4096
+
+func filled(b byte) []byte {
+	return bytes.Repeat([]byte{b}, testPageSize)
+}
+
+func openTestWAL(t *testing.T, path string) *WAL {
+	t.Helper()
+	w, err := OpenWAL(path, testPageSize, SyncOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// emptyFile stands in for the database file behind a log
+func emptyFile(t *testing.T) *os.File {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func readLogged(t *testing.T, w *WAL, pageNum uint32) []byte {
+	t.Helper()
+	buff := make([]byte, testPageSize)
+	if err := w.ReadPage(pageNum, buff, emptyFile(t)); err != nil {
+		t.Fatal(err)
+	}
+	return buff
+}
+
+func TestWALReplayDropsUncommittedFrames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db-wal")
+
+	w := openTestWAL(t, path)
+	if err := w.AppendPage(1, filled('a')); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.AppendCommit(); err != nil {
+		t.Fatal(err)
+	}
+	// a writer that crashed before its commit marker
+	if err := w.AppendPage(1, filled('b')); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.AppendPage(2, filled('b')); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	w = openTestWAL(t, path)
+	defer w.Close()
+
+	if pages := w.Pages(); !slices.Equal(pages, []uint32{1}) {
+		t.Fatalf("replayed pages %v, want [1]", pages)
+	}
+	if !bytes.Equal(readLogged(t, w, 1), filled('a')) {
+		t.Fatal("page 1 does not hold its committed image")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(2*walFrameHeaderSize + testPageSize); info.Size() != want {
+		t.Fatalf("log is %d bytes after replay, want %d", info.Size(), want)
+	}
+}
+
+func TestWALReplayStopsAtTornFrame(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db-wal")
+
+	w := openTestWAL(t, path)
+	w.AppendPage(3, filled('a'))
+	if _, err := w.AppendCommit(); err != nil {
+		t.Fatal(err)
+	}
+	w.AppendPage(3, filled('b'))
+	w.AppendCommit()
+	w.Close()
+
+	// tear the last page frame in half, its commit marker goes with it
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-walFrameHeaderSize-testPageSize/2); err != nil {
+		t.Fatal(err)
+	}
+
+	w = openTestWAL(t, path)
+	defer w.Close()
+
+	if !bytes.Equal(readLogged(t, w, 3), filled('a')) {
+		t.Fatal("page 3 does not hold the image of the last whole commit")
+	}
+}
+
+func TestWALRollback(t *testing.T) {
+	w := openTestWAL(t, filepath.Join(t.TempDir(), "db-wal"))
+	defer w.Close()
+
+	w.AppendPage(1, filled('a'))
+	w.AppendCommit()
+	w.AppendPage(1, filled('b'))
+	w.AppendPage(2, filled('b'))
+
+	pages, err := w.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(pages)
+	if !slices.Equal(pages, []uint32{1, 2}) {
+		t.Fatalf("rolled back pages %v, want [1 2]", pages)
+	}
+	if len(w.Uncommitted()) != 0 {
+		t.Fatal("uncommitted pages left after rollback")
+	}
+	if !bytes.Equal(readLogged(t, w, 1), filled('a')) {
+		t.Fatal("page 1 does not hold its committed image")
+	}
+	if slices.Contains(w.Pages(), 2) {
+		t.Fatal("page 2 is still logged")
+	}
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// crashImage copies a database and its log as a crash would leave them
+func crashImage(t *testing.T, path string) string {
+	t.Helper()
+	crashed := filepath.Join(t.TempDir(), "crashed.db")
+	copyFile(t, path, crashed)
+	copyFile(t, path+"-wal", crashed+"-wal")
+	return crashed
+}
+
+// newTestDatabase writes the header of an empty database, as the layers
+// above storage do on a new file
+func newTestDatabase(t *testing.T, p PageStore) *DBHeader {
+	t.Helper()
+	p.Begin()
+	h := &DBHeader{Magic: Magic, Version: FormatVersion, PageSize: uint32(p.PageSize()), PageCount: 1}
+	if err := Finish(p, p.WriteHeader(h), nil); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func writeFilled(t *testing.T, p PageStore, pageNum uint32, b byte) {
+	t.Helper()
+	buff := p.GetBuff()
+	defer ReleasePageBuffer(buff)
+	copy(buff, bytes.Repeat([]byte{b}, len(buff)))
+	if err := p.WritePage(pageNum, PageTypeData, buff); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPagerRecoversCommittedWritesOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.db")
+	p, err := OpenPager(path, &Options{CachePages: 4, Sync: SyncOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestDatabase(t, p)
+
+	p.Begin()
+	pageNum, err := p.AllocatePage(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFilled(t, p, pageNum, 'c')
+	if err := Finish(p, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a write whose pages reached the log but not its commit marker
+	p.Begin()
+	writeFilled(t, p, pageNum, 'u')
+	if err := p.cache.flush(); err != nil {
+		t.Fatal(err)
+	}
+	crashed := crashImage(t, path)
+	p.Rollback()
+	p.Close()
+
+	p, err = OpenPager(crashed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	page, err := p.ReadPage(pageNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ReleasePageBuffer(page)
+	if page[0] != 'c' || page[len(page)-1] != 'c' {
+		t.Fatalf("page %d reads %q after recovery, want the committed image", pageNum, page[0])
+	}
+}